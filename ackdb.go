@@ -0,0 +1,72 @@
+package notifier
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// AckTrigger stores acknowledgement of trigger incident by user, it lasts until trigger returns to OK
+func (connector *DbConnector) AckTrigger(triggerID, user string) error {
+	c := connector.Pool.Get()
+	defer c.Close()
+	if _, err := c.Do("SET", triggerAckKey(triggerID), user, "EX", incidentTTL); err != nil {
+		return err
+	}
+	return nil
+}
+
+// MuteTrigger stores mute of trigger notifications by user for given duration
+func (connector *DbConnector) MuteTrigger(triggerID, user string, duration time.Duration) error {
+	c := connector.Pool.Get()
+	defer c.Close()
+	if _, err := c.Do("SET", triggerMuteKey(triggerID), user, "EX", int64(duration.Seconds())); err != nil {
+		return err
+	}
+	return nil
+}
+
+// IsTriggerMuted returns true if trigger incident is acknowledged or trigger notifications are muted
+func (connector *DbConnector) IsTriggerMuted(triggerID string) (bool, error) {
+	c := connector.Pool.Get()
+	defer c.Close()
+	for _, key := range []string{triggerAckKey(triggerID), triggerMuteKey(triggerID)} {
+		exists, err := redis.Bool(c.Do("EXISTS", key))
+		if err != nil {
+			return false, err
+		}
+		if exists {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// RemoveTriggerAck removes acknowledgement when trigger incident is over
+func (connector *DbConnector) RemoveTriggerAck(triggerID string) error {
+	c := connector.Pool.Get()
+	defer c.Close()
+	if _, err := c.Do("DEL", triggerAckKey(triggerID)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// UnmuteTrigger removes trigger mute and acknowledgement
+func (connector *DbConnector) UnmuteTrigger(triggerID string) error {
+	c := connector.Pool.Get()
+	defer c.Close()
+	if _, err := c.Do("DEL", triggerAckKey(triggerID), triggerMuteKey(triggerID)); err != nil {
+		return err
+	}
+	return nil
+}
+
+func triggerAckKey(triggerID string) string {
+	return fmt.Sprintf("moira-notifier-trigger-ack:%s", triggerID)
+}
+
+func triggerMuteKey(triggerID string) string {
+	return fmt.Sprintf("moira-notifier-trigger-mute:%s", triggerID)
+}
@@ -1,6 +1,7 @@
 package notifier
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
 	"strings"
@@ -24,23 +25,172 @@ func (connector *DbConnector) GetIDByUsername(messenger, username string) (strin
 	return result, err
 }
 
-// SetUsernameID store id of username
+// SetUsernameID store id of username and moves username to chat users index of new id
 func (connector *DbConnector) SetUsernameID(messenger, username, id string) error {
 	c := connector.Pool.Get()
 	defer c.Close()
-	if _, err := c.Do("SET", usernameKey(messenger, username), id); err != nil {
+	if username == botUsername {
+		_, err := c.Do("SET", usernameKey(messenger, username), id)
+		return err
+	}
+	previous, err := redis.String(c.Do("GET", usernameKey(messenger, username)))
+	if err != nil && err != redis.ErrNil {
+		return err
+	}
+	c.Send("MULTI")
+	c.Send("SET", usernameKey(messenger, username), id)
+	if previous != "" && previous != id {
+		c.Send("SREM", chatUsersKey(messenger, previous), username)
+	}
+	c.Send("SADD", chatUsersKey(messenger, id), username)
+	if _, err := c.Do("EXEC"); err != nil {
+		return err
+	}
+	return nil
+}
+
+// SetLinkCode stores id of chat which requested one-time link code, code expires unless contact
+// with code value claims it with LinkContact
+func (connector *DbConnector) SetLinkCode(messenger, code, id string) error {
+	c := connector.Pool.Get()
+	defer c.Close()
+	c.Send("MULTI")
+	c.Send("SET", usernameKey(messenger, code), id, "EX", linkCodeTTL)
+	c.Send("SADD", chatUsersKey(messenger, id), code)
+	c.Send("SADD", linkCodesKey(messenger), code)
+	if _, err := c.Do("EXEC"); err != nil {
 		return err
 	}
 	return nil
 }
 
+// GetLinkCodes returns chat ids by link codes which are not claimed yet, expired codes are removed
+func (connector *DbConnector) GetLinkCodes(messenger string) (map[string]string, error) {
+	c := connector.Pool.Get()
+	defer c.Close()
+
+	codes, err := redis.Strings(c.Do("SMEMBERS", linkCodesKey(messenger)))
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string]string, len(codes))
+	for _, code := range codes {
+		id, err := redis.String(c.Do("GET", usernameKey(messenger, code)))
+		if err == redis.ErrNil {
+			if _, err := c.Do("SREM", linkCodesKey(messenger), code); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		result[code] = id
+	}
+	return result, nil
+}
+
+// contactChat is chat contact is linked to with value contact had when it claimed link code
+type contactChat struct {
+	Value  string `json:"value"`
+	ChatID string `json:"chat_id"`
+}
+
+// LinkContact permanently stores chat of contact which value is link code and removes the code
+func (connector *DbConnector) LinkContact(messenger, contactID, code, id string) error {
+	value, err := json.Marshal(&contactChat{Value: code, ChatID: id})
+	if err != nil {
+		return err
+	}
+	c := connector.Pool.Get()
+	defer c.Close()
+	c.Send("MULTI")
+	c.Send("SET", contactChatKey(messenger, contactID), value)
+	c.Send("SADD", chatContactsKey(messenger, id), contactID)
+	c.Send("DEL", usernameKey(messenger, code))
+	c.Send("SREM", chatUsersKey(messenger, id), code)
+	c.Send("SREM", linkCodesKey(messenger), code)
+	if _, err := c.Do("EXEC"); err != nil {
+		return err
+	}
+	return nil
+}
+
+// GetContactChatID returns id of chat contact is linked to, empty id is returned if contact is not linked
+// or its value has changed since it was linked
+func (connector *DbConnector) GetContactChatID(messenger, contactID, value string) (string, error) {
+	c := connector.Pool.Get()
+	defer c.Close()
+
+	linked, err := getContactChat(c, messenger, contactID)
+	if err != nil || linked == nil || linked.Value != value {
+		return "", err
+	}
+	return linked.ChatID, nil
+}
+
+// GetChatContactIDs returns ids of contacts linked to chat
+func (connector *DbConnector) GetChatContactIDs(messenger, id string) ([]string, error) {
+	c := connector.Pool.Get()
+	defer c.Close()
+
+	contactIDs, err := redis.Strings(c.Do("SMEMBERS", chatContactsKey(messenger, id)))
+	if err != nil {
+		return nil, err
+	}
+	var result []string
+	for _, contactID := range contactIDs {
+		linked, err := getContactChat(c, messenger, contactID)
+		if err != nil {
+			return nil, err
+		}
+		if linked != nil && linked.ChatID == id {
+			result = append(result, contactID)
+		}
+	}
+	return result, nil
+}
+
+func getContactChat(c redis.Conn, messenger, contactID string) (*contactChat, error) {
+	value, err := redis.Bytes(c.Do("GET", contactChatKey(messenger, contactID)))
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	linked := &contactChat{}
+	if err := json.Unmarshal(value, linked); err != nil {
+		return nil, fmt.Errorf("Failed to parse linked chat of contact %s: %s", contactID, err.Error())
+	}
+	return linked, nil
+}
+
 func usernameKey(messenger, username string) string {
 	return fmt.Sprintf("moira-%s-users:%s", messenger, username)
 }
 
+func chatUsersKey(messenger, id string) string {
+	return fmt.Sprintf("moira-%s-chat-users:%s", messenger, id)
+}
+
+func linkCodesKey(messenger string) string {
+	return fmt.Sprintf("moira-%s-link-codes", messenger)
+}
+
+func contactChatKey(messenger, contactID string) string {
+	return fmt.Sprintf("moira-%s-contact-chat:%s", messenger, contactID)
+}
+
+func chatContactsKey(messenger, id string) string {
+	return fmt.Sprintf("moira-%s-chat-contacts:%s", messenger, id)
+}
+
 const (
 	botUsername  = "moira-bot-host"
 	deregistered = "deregistered"
+	// linkCodeTTL is time in seconds user has to enter link code in Moira
+	linkCodeTTL = 60 * 60
 )
 
 var messengers = make(map[string]bool)
@@ -95,3 +245,49 @@ func (connector *DbConnector) DeregisterBot(messenger string) error {
 	log.Debugf("Notifier on host %s did't exist. Removing skipped.", host)
 	return nil
 }
+
+// GetUsernamesByID returns messenger usernames and chat titles registered with given chat id,
+// usernames registered with another id since and expired link codes are removed from chat users index
+func (connector *DbConnector) GetUsernamesByID(messenger, id string) ([]string, error) {
+	c := connector.Pool.Get()
+	defer c.Close()
+
+	members, err := redis.Strings(c.Do("SMEMBERS", chatUsersKey(messenger, id)))
+	if err != nil {
+		return nil, err
+	}
+	var usernames []string
+	for _, username := range members {
+		value, err := redis.String(c.Do("GET", usernameKey(messenger, username)))
+		if err != nil && err != redis.ErrNil {
+			return nil, err
+		}
+		if value == id {
+			usernames = append(usernames, username)
+			continue
+		}
+		if _, err := c.Do("SREM", chatUsersKey(messenger, id), username); err != nil {
+			return nil, err
+		}
+	}
+	return usernames, nil
+}
+
+// IndexChatUser adds username registered with chat id before chat users index was introduced to the index,
+// username registered with another id is not added
+func (connector *DbConnector) IndexChatUser(messenger, username, id string) error {
+	c := connector.Pool.Get()
+	defer c.Close()
+
+	registered, err := redis.String(c.Do("GET", usernameKey(messenger, username)))
+	if err == redis.ErrNil || (err == nil && registered != id) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := c.Do("SADD", chatUsersKey(messenger, id), username); err != nil {
+		return err
+	}
+	return nil
+}
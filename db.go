@@ -18,6 +18,7 @@ type Database interface {
 	FetchEvent() (*EventData, error)
 	GetTrigger(id string) (TriggerData, error)
 	GetTriggerTags(id string) ([]string, error)
+	GetTriggerState(id string) (string, error)
 	GetTagsSubscriptions(tags []string) ([]SubscriptionData, error)
 	GetSubscription(id string) (SubscriptionData, error)
 	GetContact(id string) (ContactData, error)
@@ -27,6 +28,8 @@ type Database interface {
 	GetTriggerThrottlingTimestamps(id string) (time.Time, time.Time)
 	GetTriggerEventsCount(id string, from int64) int64
 	SetTriggerThrottlingTimestamp(id string, next time.Time) error
+	IsTriggerMuted(id string) (bool, error)
+	RemoveTriggerAck(id string) error
 	GetNotifications(to int64) ([]*ScheduledNotification, error)
 	GetMetricsCount() (int64, error)
 	GetChecksCount() (int64, error)
@@ -177,7 +180,7 @@ func (connector *DbConnector) GetContacts() ([]ContactData, error) {
 	return result, err
 }
 
-// SetContact store contact information
+// SetContact store contact information and adds contact to index of contacts by value
 func (connector *DbConnector) SetContact(contact *ContactData) error {
 	id := contact.ID
 	contactString, err := json.Marshal(contact)
@@ -187,7 +190,94 @@ func (connector *DbConnector) SetContact(contact *ContactData) error {
 
 	c := connector.Pool.Get()
 	defer c.Close()
-	if _, err := c.Do("SET", fmt.Sprintf("moira-contact:%s", id), contactString); err != nil {
+	c.Send("MULTI")
+	c.Send("SET", fmt.Sprintf("moira-contact:%s", id), contactString)
+	c.Send("SADD", contactValueKey(contact.Type, contact.Value), id)
+	if _, err := c.Do("EXEC"); err != nil {
+		return err
+	}
+	return nil
+}
+
+// IndexContactValue adds contact to index of contacts by value. Contacts saved by SetContact are indexed,
+// contacts saved by API are indexed when notifier loads them
+func (connector *DbConnector) IndexContactValue(contact ContactData) error {
+	c := connector.Pool.Get()
+	defer c.Close()
+	if _, err := c.Do("SADD", contactValueKey(contact.Type, contact.Value), contact.ID); err != nil {
+		return err
+	}
+	return nil
+}
+
+// GetContactsByValue returns indexed contacts of given type and value,
+// contacts removed or changed since they were indexed are removed from index
+func (connector *DbConnector) GetContactsByValue(contactType, value string) ([]ContactData, error) {
+	c := connector.Pool.Get()
+	defer c.Close()
+
+	key := contactValueKey(contactType, value)
+	ids, err := redis.Strings(c.Do("SMEMBERS", key))
+	if err != nil {
+		return nil, err
+	}
+	var contacts []ContactData
+	for _, id := range ids {
+		var contact ContactData
+		contactString, err := redis.Bytes(c.Do("GET", fmt.Sprintf("moira-contact:%s", id)))
+		if err != nil && err != redis.ErrNil {
+			return nil, err
+		}
+		if err == nil {
+			if err := json.Unmarshal(contactString, &contact); err != nil {
+				return nil, fmt.Errorf("Failed to parse contact json %s: %s", contactString, err.Error())
+			}
+		}
+		if contact.Type != contactType || contact.Value != value {
+			if _, err := c.Do("SREM", key, id); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		contact.ID = id
+		contacts = append(contacts, contact)
+	}
+	return contacts, nil
+}
+
+func contactValueKey(contactType, value string) string {
+	return fmt.Sprintf("moira-contact-value:%s:%s", contactType, value)
+}
+
+// SetContactUnreachable marks contact with given value as unable to receive notifications
+func (connector *DbConnector) SetContactUnreachable(contactID, value string) error {
+	c := connector.Pool.Get()
+	defer c.Close()
+	if _, err := c.Do("SET", fmt.Sprintf("moira-notifier-unreachable-contact:%s", contactID), value); err != nil {
+		return err
+	}
+	return nil
+}
+
+// IsContactUnreachable returns true if contact is marked unreachable and its value has not been changed since
+func (connector *DbConnector) IsContactUnreachable(contact ContactData) (bool, error) {
+	c := connector.Pool.Get()
+	defer c.Close()
+	value, err := redis.String(c.Do("GET", fmt.Sprintf("moira-notifier-unreachable-contact:%s", contact.ID)))
+	if err == redis.ErrNil {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return value == contact.Value, nil
+}
+
+// RemoveContactUnreachable removes unreachable mark when contact is able to receive notifications again
+func (connector *DbConnector) RemoveContactUnreachable(contactID string) error {
+	c := connector.Pool.Get()
+	defer c.Close()
+	if _, err := c.Do("DEL", fmt.Sprintf("moira-notifier-unreachable-contact:%s", contactID)); err != nil {
 		return err
 	}
 	return nil
@@ -214,6 +304,78 @@ func (connector *DbConnector) GetSubscription(id string) (SubscriptionData, erro
 	return sub, nil
 }
 
+// GetUserSubscriptions returns subscriptions of user
+func (connector *DbConnector) GetUserSubscriptions(login string) ([]SubscriptionData, error) {
+	c := connector.Pool.Get()
+	defer c.Close()
+
+	ids, err := redis.Strings(c.Do("SMEMBERS", fmt.Sprintf("moira-user-subscriptions:%s", login)))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to retrieve subscriptions of user %s: %s", login, err.Error())
+	}
+	var subscriptions []SubscriptionData
+	for _, id := range ids {
+		sub, err := connector.GetSubscription(id)
+		if err != nil {
+			log.Warning(err.Error())
+			continue
+		}
+		subscriptions = append(subscriptions, sub)
+	}
+	return subscriptions, nil
+}
+
+// GetTagsTriggers returns ids of triggers having all given tags
+func (connector *DbConnector) GetTagsTriggers(tags []string) ([]string, error) {
+	c := connector.Pool.Get()
+	defer c.Close()
+
+	var triggerIDs []string
+	for i, tag := range tags {
+		ids, err := redis.Strings(c.Do("SMEMBERS", fmt.Sprintf("moira-tag-triggers:%s", tag)))
+		if err != nil {
+			return nil, fmt.Errorf("Failed to retrieve triggers of tag %s: %s", tag, err.Error())
+		}
+		if i == 0 {
+			triggerIDs = ids
+			continue
+		}
+		tagged := make(map[string]bool, len(ids))
+		for _, id := range ids {
+			tagged[id] = true
+		}
+		intersection := triggerIDs[:0]
+		for _, id := range triggerIDs {
+			if tagged[id] {
+				intersection = append(intersection, id)
+			}
+		}
+		triggerIDs = intersection
+	}
+	return triggerIDs, nil
+}
+
+// GetTriggerState returns state of last trigger check, empty state is returned if trigger was not checked yet
+func (connector *DbConnector) GetTriggerState(triggerID string) (string, error) {
+	c := connector.Pool.Get()
+	defer c.Close()
+
+	checkString, err := redis.Bytes(c.Do("GET", fmt.Sprintf("moira-metric-last-check:%s", triggerID)))
+	if err == redis.ErrNil {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("Failed to get last check of trigger %s: %s", triggerID, err.Error())
+	}
+	var check struct {
+		State string `json:"state"`
+	}
+	if err := json.Unmarshal(checkString, &check); err != nil {
+		return "", fmt.Errorf("Failed to parse last check json %s: %s", checkString, err.Error())
+	}
+	return check.State, nil
+}
+
 // GetTriggerTags returns trigger tags
 func (connector *DbConnector) GetTriggerTags(triggerID string) ([]string, error) {
 	c := connector.Pool.Get()
@@ -0,0 +1,68 @@
+package notifier
+
+import (
+	"fmt"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// deliveryTTL limits lifetime of delivery statuses that are never reported by external service
+const deliveryTTL = 7 * 24 * 60 * 60
+
+// GetDelivery returns value stored by sender of given kind for message sent to external service.
+// Empty value is returned if message is unknown
+func (connector *DbConnector) GetDelivery(kind, messageID string) (string, error) {
+	c := connector.Pool.Get()
+	defer c.Close()
+
+	result, err := redis.String(c.Do("GET", deliveryKey(kind, messageID)))
+	if err == redis.ErrNil {
+		return "", nil
+	}
+	return result, err
+}
+
+// SetDelivery stores value of sender of given kind with delivery status of message sent to external service
+func (connector *DbConnector) SetDelivery(kind, messageID, value string) error {
+	c := connector.Pool.Get()
+	defer c.Close()
+	if _, err := c.Do("SET", deliveryKey(kind, messageID), value, "EX", deliveryTTL); err != nil {
+		return err
+	}
+	return nil
+}
+
+// AddPendingDelivery adds message sent by sender of given kind to messages which status is polled by sender
+func (connector *DbConnector) AddPendingDelivery(kind, messageID string) error {
+	c := connector.Pool.Get()
+	defer c.Close()
+	if _, err := c.Do("SADD", pendingDeliveriesKey(kind), messageID); err != nil {
+		return err
+	}
+	return nil
+}
+
+// GetPendingDeliveries returns messages sent by sender of given kind which status is polled by sender
+func (connector *DbConnector) GetPendingDeliveries(kind string) ([]string, error) {
+	c := connector.Pool.Get()
+	defer c.Close()
+	return redis.Strings(c.Do("SMEMBERS", pendingDeliveriesKey(kind)))
+}
+
+// RemovePendingDelivery stops polling status of message when it is final
+func (connector *DbConnector) RemovePendingDelivery(kind, messageID string) error {
+	c := connector.Pool.Get()
+	defer c.Close()
+	if _, err := c.Do("SREM", pendingDeliveriesKey(kind), messageID); err != nil {
+		return err
+	}
+	return nil
+}
+
+func deliveryKey(kind, messageID string) string {
+	return fmt.Sprintf("moira-notifier-delivery:%s:%s", kind, messageID)
+}
+
+func pendingDeliveriesKey(kind string) string {
+	return fmt.Sprintf("moira-notifier-pending-deliveries:%s", kind)
+}
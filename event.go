@@ -1,7 +1,10 @@
 package notifier
 
 import (
+	"fmt"
+	"sort"
 	"sync"
+	"time"
 )
 
 var (
@@ -53,6 +56,10 @@ func ProcessEvent(event EventData) error {
 			return err
 		}
 
+		if skip := applyTriggerAck(event); skip {
+			return nil
+		}
+
 		tags, err = db.GetTriggerTags(event.TriggerID)
 		if err != nil {
 			return err
@@ -84,6 +91,11 @@ func ProcessEvent(event EventData) error {
 					log.Warning(err.Error())
 					continue
 				}
+				if err := validateContact(contact); err != nil {
+					log.Warningf("Skip invalid contact %s: %s", contact.ID, err.Error())
+					continue
+				}
+				applyScheduleTimezone(&contact, subscription.Schedule)
 				event.SubscriptionID = subscription.ID
 				notification := scheduleNotification(event, trigger, contact, false, 0)
 				key := notification.GetKey()
@@ -105,6 +117,60 @@ func ProcessEvent(event EventData) error {
 	return nil
 }
 
+// applyTriggerAck clears acknowledgement when the whole trigger returns to OK and
+// returns true if notifications about event should be skipped as trigger is acknowledged or muted
+func applyTriggerAck(event EventData) bool {
+	if event.State == "OK" {
+		state, err := db.GetTriggerState(event.TriggerID)
+		if err != nil {
+			log.Warning(err.Error())
+			return false
+		}
+		if state == "OK" {
+			if err := db.RemoveTriggerAck(event.TriggerID); err != nil {
+				log.Warning(err.Error())
+			}
+		}
+		return false
+	}
+	muted, err := db.IsTriggerMuted(event.TriggerID)
+	if err != nil {
+		log.Warning(err.Error())
+		return false
+	}
+	if muted {
+		log.Debugf("Trigger %s is acknowledged or muted, skip notifications", event.TriggerID)
+	}
+	return muted
+}
+
+// applyScheduleTimezone checks timezone of contact and replaces missing or unknown one with
+// timezone offset of subscription schedule, which web interface takes from browser of subscription owner
+func applyScheduleTimezone(contact *ContactData, schedule ScheduleData) {
+	if contact.Timezone != "" {
+		_, err := time.LoadLocation(contact.Timezone)
+		if err == nil {
+			return
+		}
+		log.Warningf("Contact %s has unknown timezone %s: %s", contact.ID, contact.Timezone, err.Error())
+	}
+	contact.Timezone = scheduleTimezone(schedule)
+}
+
+// scheduleTimezone returns tz database zone of schedule offset given in minutes behind UTC like javascript
+// Date.getTimezoneOffset does. Empty zone is returned for zero offset and offsets without such zone
+func scheduleTimezone(schedule ScheduleData) string {
+	offset := schedule.TimezoneOffset
+	if offset == 0 || offset%60 != 0 {
+		return ""
+	}
+	timezone := fmt.Sprintf("Etc/GMT%+d", offset/60)
+	if _, err := time.LoadLocation(timezone); err != nil {
+		return ""
+	}
+	return timezone
+}
+
 // FetchEvents is a cycle that fetches events from database
 func FetchEvents(shutdown chan bool, wg *sync.WaitGroup) {
 	defer wg.Done()
@@ -149,3 +215,33 @@ func (events EventsData) GetSubjectState() string {
 	}
 	return result
 }
+
+// GetMostCriticalEvents returns up to count events starting from the most critical states,
+// events with the same state keep their order
+func (events EventsData) GetMostCriticalEvents(count int) EventsData {
+	sorted := make(EventsData, len(events))
+	copy(sorted, events)
+	sort.Stable(eventsByState(sorted))
+	if count < len(sorted) {
+		sorted = sorted[:count]
+	}
+	return sorted
+}
+
+// eventsByState sorts events by descending criticality of state
+type eventsByState EventsData
+
+func (events eventsByState) Len() int      { return len(events) }
+func (events eventsByState) Swap(i, j int) { events[i], events[j] = events[j], events[i] }
+func (events eventsByState) Less(i, j int) bool {
+	return stateCriticality(events[i].State) > stateCriticality(events[j].State)
+}
+
+func stateCriticality(state string) int {
+	for i, known := range eventStates {
+		if known == state {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,88 @@
+package notifier
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	httpReadTimeout  = 10 * time.Second
+	httpWriteTimeout = 30 * time.Second
+)
+
+var (
+	httpHandlers     = make(map[string]http.Handler)
+	httpHandlersLock sync.RWMutex
+)
+
+// RegisterHandler serves requests to path by handler, handler registered for the same path is replaced.
+// Error is returned if notifier http_listen is not set as registered handler would never be called
+func RegisterHandler(path string, handler http.Handler) error {
+	if settings := getSettings(); settings == nil || settings.Notifier.HTTPListen == "" {
+		return fmt.Errorf("Can not serve %s: notifier http_listen is not set", path)
+	}
+	httpHandlersLock.Lock()
+	defer httpHandlersLock.Unlock()
+	httpHandlers[path] = handler
+	return nil
+}
+
+// UnregisterHandler stops serving path by handler unless it has been replaced by another one
+func UnregisterHandler(path string, handler http.Handler) {
+	httpHandlersLock.Lock()
+	defer httpHandlersLock.Unlock()
+	if httpHandlers[path] == handler {
+		delete(httpHandlers, path)
+	}
+}
+
+// handlerRegistry dispatches requests to registered handlers by exact path
+type handlerRegistry struct{}
+
+func (handlerRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	httpHandlersLock.RLock()
+	handler, found := httpHandlers[r.URL.Path]
+	httpHandlersLock.RUnlock()
+	if !found {
+		http.NotFound(w, r)
+		return
+	}
+	handler.ServeHTTP(w, r)
+}
+
+// httpListener waits until server stops accepting connections when it is closed
+type httpListener struct {
+	net.Listener
+	stopped chan bool
+}
+
+func (listener *httpListener) Close() error {
+	err := listener.Listener.Close()
+	<-listener.stopped
+	return err
+}
+
+// StartHTTPServer serves registered handlers on listen address until returned listener is closed
+func StartHTTPServer(listen string) (net.Listener, error) {
+	listener, err := net.Listen("tcp", listen)
+	if err != nil {
+		return nil, err
+	}
+	server := &http.Server{
+		Handler:      handlerRegistry{},
+		ReadTimeout:  httpReadTimeout,
+		WriteTimeout: httpWriteTimeout,
+	}
+	stopped := make(chan bool)
+	go func() {
+		defer close(stopped)
+		if err := server.Serve(listener); err != nil {
+			log.Debugf("HTTP server on %s stopped: %s", listener.Addr(), err.Error())
+		}
+	}()
+	log.Infof("HTTP server listening on %s", listener.Addr())
+	return &httpListener{Listener: listener, stopped: stopped}, nil
+}
@@ -0,0 +1,48 @@
+package notifier
+
+import (
+	"fmt"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// incidentTTL limits lifetime of incidents of triggers that never returned to OK
+const incidentTTL = 30 * 24 * 60 * 60
+
+// GetTriggerIncident returns value stored by sender of given kind for contact and trigger incident.
+// Empty value is returned if there is no incident in progress. Incidents are kept by contact ID,
+// so contacts sharing the same address have separate incidents
+func (connector *DbConnector) GetTriggerIncident(kind, contactID, triggerID string) (string, error) {
+	c := connector.Pool.Get()
+	defer c.Close()
+
+	result, err := redis.String(c.Do("GET", incidentKey(kind, contactID, triggerID)))
+	if err == redis.ErrNil {
+		return "", nil
+	}
+	return result, err
+}
+
+// SetTriggerIncident stores value of sender of given kind for contact and trigger incident
+func (connector *DbConnector) SetTriggerIncident(kind, contactID, triggerID, value string) error {
+	c := connector.Pool.Get()
+	defer c.Close()
+	if _, err := c.Do("SET", incidentKey(kind, contactID, triggerID), value, "EX", incidentTTL); err != nil {
+		return err
+	}
+	return nil
+}
+
+// RemoveTriggerIncident removes value of sender of given kind when trigger incident is over
+func (connector *DbConnector) RemoveTriggerIncident(kind, contactID, triggerID string) error {
+	c := connector.Pool.Get()
+	defer c.Close()
+	if _, err := c.Do("DEL", incidentKey(kind, contactID, triggerID)); err != nil {
+		return err
+	}
+	return nil
+}
+
+func incidentKey(kind, contactID, triggerID string) string {
+	return fmt.Sprintf("moira-notifier-incident:%s:%s:%s", kind, contactID, triggerID)
+}
@@ -1,5 +1,10 @@
 package notifier
 
+import (
+	"context"
+	"fmt"
+)
+
 // EventData represents trigger state changes event
 type EventData struct {
 	Timestamp      int64   `json:"timestamp"`
@@ -28,10 +33,14 @@ type TriggerData struct {
 
 // ContactData represents contact object
 type ContactData struct {
-	Type  string `json:"type"`
-	Value string `json:"value"`
-	ID    string `json:"id"`
-	User  string `json:"user"`
+	Type       string            `json:"type"`
+	Value      string            `json:"value"`
+	ID         string            `json:"id"`
+	User       string            `json:"user"`
+	Language   string            `json:"language,omitempty"`
+	Timezone   string            `json:"timezone,omitempty"`
+	DateFormat string            `json:"date_format,omitempty"`
+	Settings   map[string]string `json:"settings,omitempty"`
 }
 
 //SubscriptionData respresent user subscription
@@ -81,8 +90,25 @@ type Logger interface {
 	Warningf(format string, args ...interface{})
 }
 
-// Sender interface for implementing specified contact type sender
+// Sender interface for implementing specified contact type sender.
+// SendEvents must return as soon as ctx is done. Sender implementing io.Closer is closed when it is stopped
 type Sender interface {
-	SendEvents(events EventsData, contact ContactData, trigger TriggerData, throttled bool) error
+	SendEvents(ctx context.Context, events EventsData, contact ContactData, trigger TriggerData, throttled bool) error
 	Init(senderSettings map[string]string, logger Logger) error
 }
+
+// UnreachableContactError is returned by sender if contact can not receive notifications until user fixes it,
+// e.g. user blocked messenger bot. Such notifications are not resent
+type UnreachableContactError struct {
+	Reason string
+}
+
+func (err *UnreachableContactError) Error() string {
+	return fmt.Sprintf("Contact is unreachable: %s", err.Reason)
+}
+
+// ContactValidator can be implemented by sender to check contacts when they are loaded.
+// Notifications are not scheduled for invalid contacts
+type ContactValidator interface {
+	ValidateContact(contact ContactData) error
+}
@@ -0,0 +1,186 @@
+package mail
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+
+	"github.com/moira-alert/notifier"
+)
+
+const (
+	chartWidth   = 600
+	chartHeight  = 200
+	chartPadding = 10
+)
+
+var (
+	chartBackground = color.RGBA{0xff, 0xff, 0xff, 0xff}
+	chartWarnColor  = color.RGBA{0xcc, 0xcc, 0x32, 0xff}
+	chartErrorColor = color.RGBA{0xcc, 0x00, 0x32, 0xff}
+	chartPalette    = []color.RGBA{
+		{0x1f, 0x77, 0xb4, 0xff},
+		{0xff, 0x7f, 0x0e, 0xff},
+		{0x2c, 0xa0, 0x2c, 0xff},
+		{0x94, 0x67, 0xbd, 0xff},
+		{0x8c, 0x56, 0x4b, 0xff},
+		{0xe3, 0x77, 0xc2, 0xff},
+		{0x7f, 0x7f, 0x7f, 0xff},
+		{0x17, 0xbe, 0xcf, 0xff},
+	}
+)
+
+// chartSeries represents values of one metric drawn on chart
+type chartSeries struct {
+	Metric string
+	Color  string
+	color  color.RGBA
+	points []chartPoint
+}
+
+type chartPoint struct {
+	timestamp int64
+	value     float64
+}
+
+// chart draws package events values, one series per metric, with trigger warn and error levels
+type chart struct {
+	Series     []*chartSeries
+	warnValue  float64
+	errorValue float64
+	minX, maxX int64
+	minY, maxY float64
+}
+
+// newChart groups events by metric, returns nil if there are no events to draw
+func newChart(events notifier.EventsData, trigger notifier.TriggerData) *chart {
+	if len(events) == 0 {
+		return nil
+	}
+	c := &chart{
+		warnValue:  trigger.WarnValue,
+		errorValue: trigger.ErrorValue,
+		minX:       events[0].Timestamp,
+		maxX:       events[0].Timestamp,
+		minY:       trigger.WarnValue,
+		maxY:       trigger.WarnValue,
+	}
+	c.extendY(trigger.ErrorValue)
+	metrics := make(map[string]*chartSeries)
+	for _, event := range events {
+		series, ok := metrics[event.Metric]
+		if !ok {
+			seriesColor := chartPalette[len(c.Series)%len(chartPalette)]
+			series = &chartSeries{
+				Metric: event.Metric,
+				Color:  fmt.Sprintf("#%02x%02x%02x", seriesColor.R, seriesColor.G, seriesColor.B),
+				color:  seriesColor,
+			}
+			metrics[event.Metric] = series
+			c.Series = append(c.Series, series)
+		}
+		series.points = append(series.points, chartPoint{event.Timestamp, event.Value})
+		if event.Timestamp < c.minX {
+			c.minX = event.Timestamp
+		}
+		if event.Timestamp > c.maxX {
+			c.maxX = event.Timestamp
+		}
+		c.extendY(event.Value)
+	}
+	return c
+}
+
+func (c *chart) extendY(value float64) {
+	if value < c.minY {
+		c.minY = value
+	}
+	if value > c.maxY {
+		c.maxY = value
+	}
+}
+
+// Draw returns chart image
+func (c *chart) Draw() image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, chartWidth, chartHeight))
+	draw.Draw(img, img.Bounds(), &image.Uniform{chartBackground}, image.ZP, draw.Src)
+
+	drawHorizontalLine(img, c.y(c.warnValue), chartWarnColor)
+	drawHorizontalLine(img, c.y(c.errorValue), chartErrorColor)
+	for _, series := range c.Series {
+		for i, point := range series.points {
+			x, y := c.x(point.timestamp), c.y(point.value)
+			drawPoint(img, x, y, series.color)
+			if i > 0 {
+				previous := series.points[i-1]
+				drawLine(img, c.x(previous.timestamp), c.y(previous.value), x, y, series.color)
+			}
+		}
+	}
+	return img
+}
+
+func (c *chart) x(timestamp int64) int {
+	if c.maxX == c.minX {
+		return chartWidth / 2
+	}
+	return chartPadding + int(float64(timestamp-c.minX)/float64(c.maxX-c.minX)*float64(chartWidth-2*chartPadding-1))
+}
+
+func (c *chart) y(value float64) int {
+	if c.maxY == c.minY {
+		return chartHeight / 2
+	}
+	return chartHeight - 1 - chartPadding - int((value-c.minY)/(c.maxY-c.minY)*float64(chartHeight-2*chartPadding-1))
+}
+
+func drawHorizontalLine(img *image.RGBA, y int, lineColor color.RGBA) {
+	for x := 0; x < chartWidth; x++ {
+		if x%8 < 5 {
+			img.SetRGBA(x, y, lineColor)
+		}
+	}
+}
+
+func drawPoint(img *image.RGBA, x, y int, pointColor color.RGBA) {
+	for dx := -1; dx <= 1; dx++ {
+		for dy := -1; dy <= 1; dy++ {
+			img.SetRGBA(x+dx, y+dy, pointColor)
+		}
+	}
+}
+
+// drawLine draws line from (x0, y0) to (x1, y1) using Bresenham's algorithm
+func drawLine(img *image.RGBA, x0, y0, x1, y1 int, lineColor color.RGBA) {
+	dx, dy := abs(x1-x0), -abs(y1-y0)
+	sx, sy := 1, 1
+	if x0 > x1 {
+		sx = -1
+	}
+	if y0 > y1 {
+		sy = -1
+	}
+	e := dx + dy
+	for {
+		img.SetRGBA(x0, y0, lineColor)
+		if x0 == x1 && y0 == y1 {
+			return
+		}
+		if 2*e >= dy {
+			e += dy
+			x0 += sx
+		}
+		if 2*e <= dx {
+			e += dx
+			y0 += sy
+		}
+	}
+}
+
+func abs(value int) int {
+	if value < 0 {
+		return -value
+	}
+	return value
+}
@@ -0,0 +1,188 @@
+package mail
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	gomail "gopkg.in/gomail.v2"
+)
+
+// dkimHeaders are signed if message has them
+var dkimHeaders = []string{
+	"From", "Sender", "To", "Cc", "Subject", "Date", "Message-ID",
+	"In-Reply-To", "References", "MIME-Version", "Content-Type",
+}
+
+// DKIMSigner adds DKIM-Signature header with rsa-sha256 signature and relaxed/relaxed canonicalization
+type DKIMSigner struct {
+	Domain   string
+	Selector string
+	key      *rsa.PrivateKey
+}
+
+// NewDKIMSigner returns signer with RSA private key read from PEM file
+func NewDKIMSigner(domain, selector, keyFile string) (*DKIMSigner, error) {
+	if domain == "" || selector == "" || keyFile == "" {
+		return nil, fmt.Errorf("dkim_domain, dkim_selector and dkim_private_key must be set together")
+	}
+	keyData, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read DKIM private key: %s", err.Error())
+	}
+	block, _ := pem.Decode(keyData)
+	if block == nil {
+		return nil, fmt.Errorf("Failed to decode DKIM private key %s: no PEM data found", keyFile)
+	}
+	var key interface{}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse DKIM private key %s: %s", keyFile, err.Error())
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("DKIM private key %s is not RSA key", keyFile)
+	}
+	return &DKIMSigner{Domain: domain, Selector: selector, key: rsaKey}, nil
+}
+
+// Sign returns message with DKIM-Signature header
+func (signer *DKIMSigner) Sign(message io.WriterTo) ([]byte, error) {
+	var buffer bytes.Buffer
+	if _, err := message.WriteTo(&buffer); err != nil {
+		return nil, err
+	}
+	raw := buffer.Bytes()
+	separator := bytes.Index(raw, []byte("\r\n\r\n"))
+	if separator == -1 {
+		return nil, fmt.Errorf("Failed to sign message: no header separator found")
+	}
+	headers := parseHeaders(string(raw[:separator+2]))
+
+	bodyHash := sha256.Sum256(relaxedBody(raw[separator+4:]))
+	signedNames := make([]string, 0, len(dkimHeaders))
+	hash := sha256.New()
+	for _, name := range dkimHeaders {
+		if value, ok := headers[strings.ToLower(name)]; ok {
+			signedNames = append(signedNames, strings.ToLower(name))
+			io.WriteString(hash, relaxedHeader(name, value)+"\r\n")
+		}
+	}
+
+	signature := fmt.Sprintf("v=1; a=rsa-sha256; c=relaxed/relaxed; d=%s; s=%s; t=%d; h=%s; bh=%s; b=",
+		signer.Domain, signer.Selector, time.Now().Unix(), strings.Join(signedNames, ":"),
+		base64.StdEncoding.EncodeToString(bodyHash[:]))
+	io.WriteString(hash, relaxedHeader("DKIM-Signature", signature))
+	signed, err := rsa.SignPKCS1v15(rand.Reader, signer.key, crypto.SHA256, hash.Sum(nil))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to sign message: %s", err.Error())
+	}
+
+	result := bytes.NewBufferString("DKIM-Signature: ")
+	result.WriteString(strings.Replace(signature, "; ", ";\r\n\t", -1))
+	result.WriteString(base64.StdEncoding.EncodeToString(signed))
+	result.WriteString("\r\n")
+	result.Write(raw)
+	return result.Bytes(), nil
+}
+
+// signedSender signs messages before sending them with wrapped sender
+type signedSender struct {
+	signer *DKIMSigner
+	sender gomail.Sender
+}
+
+func (s *signedSender) Send(from string, to []string, message io.WriterTo) error {
+	signed, err := s.signer.Sign(message)
+	if err != nil {
+		return err
+	}
+	return s.sender.Send(from, to, rawMessage(signed))
+}
+
+type rawMessage []byte
+
+func (message rawMessage) WriteTo(w io.Writer) (int64, error) {
+	n, err := w.Write(message)
+	return int64(n), err
+}
+
+// parseHeaders returns unfolded values of header fields by lower case name, the last field wins
+// as signer must sign the bottom instance of repeated field (RFC 6376 section 5.4.2)
+func parseHeaders(header string) map[string]string {
+	result := make(map[string]string)
+	var name, value string
+	flush := func() {
+		if name != "" {
+			result[name] = value
+		}
+	}
+	for _, line := range strings.Split(strings.TrimSuffix(header, "\r\n"), "\r\n") {
+		if strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t") {
+			value += line
+			continue
+		}
+		flush()
+		name, value = "", ""
+		if colon := strings.Index(line, ":"); colon != -1 {
+			name, value = strings.ToLower(strings.TrimRight(line[:colon], " \t")), line[colon+1:]
+		}
+	}
+	flush()
+	return result
+}
+
+// relaxedHeader canonicalizes header field according to RFC 6376 section 3.4.2
+func relaxedHeader(name, value string) string {
+	return fmt.Sprintf("%s:%s", strings.ToLower(strings.TrimSpace(name)), strings.TrimSpace(collapseWhitespace(value)))
+}
+
+// relaxedBody canonicalizes message body according to RFC 6376 section 3.4.4
+func relaxedBody(body []byte) []byte {
+	lines := strings.Split(string(body), "\r\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(collapseWhitespace(line), " ")
+	}
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+	return []byte(strings.Join(lines, "\r\n") + "\r\n")
+}
+
+func collapseWhitespace(value string) string {
+	var buffer bytes.Buffer
+	whitespace := false
+	for _, r := range value {
+		if r == ' ' || r == '\t' || r == '\r' || r == '\n' {
+			whitespace = true
+			continue
+		}
+		if whitespace {
+			buffer.WriteByte(' ')
+			whitespace = false
+		}
+		buffer.WriteRune(r)
+	}
+	if whitespace {
+		buffer.WriteByte(' ')
+	}
+	return buffer.String()
+}
@@ -1,66 +1,91 @@
 package mail
 
 import (
+	"bytes"
+	"context"
+	"crypto/rand"
 	"crypto/tls"
+	"encoding/hex"
 	"fmt"
 	"html/template"
+	"image/png"
 	"io"
+	netmail "net/mail"
 	"net/smtp"
 	"strconv"
+	"strings"
 	"time"
 
+	"github.com/gosexy/to"
 	"github.com/moira-alert/notifier"
+	"github.com/moira-alert/notifier/render"
 	gomail "gopkg.in/gomail.v2"
 )
 
-var tpl = template.Must(template.New("mail").Parse(`
-<html>
+const (
+	defaultMaxEvents   = 50
+	defaultPoolSize    = 1
+	defaultIdleTimeout = 30 * time.Second
+	chartName          = "chart.png"
+)
+
+var defaultTemplate = template.Must(template.New("mail").Parse(`<!DOCTYPE html>
+<html lang="{{ .Language }}">
 	<head>
+		<meta charset="utf-8">
+		<title>{{ .Subject }}</title>
 		<style type="text/css">
+			body { font-family: Arial, sans-serif; font-size: 14px; color: black; }
 			table { border-collapse: collapse; }
-			table th, table td { padding: 0.5em; }
-			tr.OK { background-color: #33cc99; color: white; }
-			tr.WARN { background-color: #cccc32; color: white; }
-			tr.ERROR { background-color: #cc0032; color: white; }
-			tr.NODATA { background-color: #d3d3d3; color: black; }
-			tr.EXCEPTION { background-color: #e14f4f; color: white; }
-			th, td { border: 1px solid black; }
+			caption { text-align: left; font-weight: bold; padding: 0.5em 0; }
+			table th, table td { padding: 0.25em 0.5em; border: 1px solid black; text-align: left; }
+			.OK { background-color: #33cc99; color: black; }
+			.WARN { background-color: #cccc32; color: black; }
+			.ERROR { background-color: #cc0032; color: white; }
+			.NODATA { background-color: #d3d3d3; color: black; }
+			.EXCEPTION { background-color: #e14f4f; color: white; }
+			.state { display: inline-block; padding: 0.25em 0.5em; font-weight: bold; }
 		</style>
 	</head>
 	<body>
+		<h1 style="font-size: 18px;">{{ .Subject }}</h1>
+		<p>
+			{{range .States}}<span class="state {{ .State }}">{{ .State }}: {{ .Count }}</span> {{end}}
+		</p>
+		<p>{{call .T "warn"}}: {{ .WarnValue }}, {{call .T "error"}}: {{ .ErrorValue }}</p>
+		{{if .Description}}<p>{{call .T "description"}}: {{ .Description }}</p>{{end}}
+		<p><a href="{{ .Link }}">{{ .Link }}</a></p>
+		{{if .Chart}}
+		<p><img src="{{ .Chart }}" alt="{{call .T "chart"}}" width="600" height="200"></p>
+		<p>{{range .ChartSeries}}<span style="color: {{ .Color }};">&#9632;</span> {{ .Metric }} {{end}}</p>
+		{{end}}
 		<table>
+			<caption>{{call .T "events"}}</caption>
 			<thead>
 				<tr>
-					<th>Timestamp</th>
-					<th>Target</th>
-					<th>Value</th>
-					<th>Warn</th>
-					<th>Error</th>
-					<th>From</th>
-					<th>To</th>
-					<th>Note</th>
+					<th scope="col">{{call .T "timestamp"}}</th>
+					<th scope="col">{{call .T "target"}}</th>
+					<th scope="col">{{call .T "value"}}</th>
+					<th scope="col">{{call .T "from"}}</th>
+					<th scope="col">{{call .T "to"}}</th>
+					<th scope="col">{{call .T "note"}}</th>
 				</tr>
 			</thead>
 			<tbody>
 				{{range .Items}}
-				<tr class="{{ .State }}">
+				<tr>
 					<td>{{ .Timestamp }}</td>
 					<td>{{ .Metric }}</td>
 					<td>{{ .Value }}</td>
-					<td>{{ .WarnValue }}</td>
-					<td>{{ .ErrorValue }}</td>
-					<td>{{ .Oldstate }}</td>
-					<td>{{ .State }}</td>
+					<td class="{{ .Oldstate }}">{{ .Oldstate }}</td>
+					<td class="{{ .State }}">{{ .State }}</td>
 					<td>{{ .Message }}</td>
 				</tr>
 				{{end}}
 			</tbody>
 		</table>
-		<p>Description: {{ .Description }}</p>
-		<p><a href="{{ .Link }}">{{ .Link }}</a></p>
-		{{if .Throttled}}
-		<p>Please, <b>fix your system or tune this trigger</b> to generate less events.</p>
-		{{end}}
+		{{if .More}}<p>{{call .T "more" .More}}</p>{{end}}
+		{{if .Throttled}}<p>{{call .T "throttled_html"}}</p>{{end}}
 	</body>
 </html>
 `))
@@ -78,16 +103,50 @@ type templateRow struct {
 	Message    string
 }
 
+// TemplateData represents data available in mail html template.
+// Items contain at most max_events package events, More is the number of omitted ones.
+// Chart is the source of inline chart image of ChartSeries metrics, empty if there is no chart.
+// T returns catalog text of contact language
+type TemplateData struct {
+	Subject     string
+	Language    string
+	States      []render.StateCount
+	WarnValue   string
+	ErrorValue  string
+	Link        string
+	Description string
+	Throttled   bool
+	Items       []*templateRow
+	More        int
+	Chart       template.URL
+	ChartSeries []*chartSeries
+	T           func(key string, args ...interface{}) template.HTML
+}
+
+// Database stores Message-ID of first mail of trigger incident, incident is over when the whole trigger is OK
+type Database interface {
+	GetTriggerIncident(kind, contactID, triggerID string) (string, error)
+	SetTriggerIncident(kind, contactID, triggerID, value string) error
+	RemoveTriggerIncident(kind, contactID, triggerID string) error
+	GetTriggerState(triggerID string) (string, error)
+}
+
 // Sender implements moira sender interface via pushover
 type Sender struct {
-	From        string
-	SMTPhost    string
-	SMTPport    int64
-	FrontURI    string
-	InsecureTLS bool
-	Password    string
-	Username    string
-	SSL         bool
+	DB           Database
+	From         string
+	SMTPhost     string
+	SMTPport     int64
+	FrontURI     string
+	InsecureTLS  bool
+	Password     string
+	Username     string
+	SSL          bool
+	MaxEvents    int
+	DKIM         *DKIMSigner
+	renderer     *render.Renderer
+	htmlTemplate *template.Template
+	pool         *smtpPool
 }
 
 // Init read yaml config
@@ -104,100 +163,260 @@ func (sender *Sender) Init(senderSettings map[string]string, logger notifier.Log
 		sender.Username = sender.From
 	}
 	sender.SSL, _ = strconv.ParseBool(senderSettings["ssl"])
+	sender.MaxEvents, _ = strconv.Atoi(senderSettings["max_events"])
 
 	if sender.From == "" {
 		return fmt.Errorf("mail_from can't be empty")
 	}
-	t, err := smtp.Dial(fmt.Sprintf("%s:%d", sender.SMTPhost, sender.SMTPport))
-	if err != nil {
+	if sender.SMTPhost == "" {
+		return fmt.Errorf("smtp_host can't be empty")
+	}
+	if sender.SMTPport <= 0 {
+		return fmt.Errorf("Can not read smtp_port from config: %s", senderSettings["smtp_port"])
+	}
+	var err error
+	if sender.renderer, err = render.New(senderSettings["type"], senderSettings["templates_dir"], senderSettings["language"]); err != nil {
 		return err
 	}
-	defer t.Close()
-	if sender.Password != "" {
-		err = t.StartTLS(&tls.Config{
-			InsecureSkipVerify: sender.InsecureTLS,
-			ServerName:         sender.SMTPhost,
-		})
-		if err != nil {
+	if senderSettings["dkim_domain"] != "" || senderSettings["dkim_selector"] != "" || senderSettings["dkim_private_key"] != "" {
+		if sender.DKIM, err = NewDKIMSigner(senderSettings["dkim_domain"], senderSettings["dkim_selector"], senderSettings["dkim_private_key"]); err != nil {
 			return err
 		}
-		err = t.Auth(smtp.PlainAuth("", sender.Username, sender.Password, sender.SMTPhost))
-		if err != nil {
-			return err
+	}
+	if templateFile := senderSettings["html_template"]; templateFile != "" {
+		if sender.htmlTemplate, err = template.ParseFiles(templateFile); err != nil {
+			return fmt.Errorf("Failed to parse mail html template %s: %s", templateFile, err.Error())
 		}
 	}
+	sender.pool = sender.newPool(senderSettings)
+	go func() {
+		if err := sender.pool.Check(); err != nil {
+			logger.Warningf("SMTP server %s:%d is unavailable: %s", sender.SMTPhost, sender.SMTPport, err.Error())
+		}
+	}()
 	return nil
 }
 
+// Close closes pooled SMTP connections
+func (sender *Sender) Close() error {
+	if sender.pool == nil {
+		return nil
+	}
+	return sender.pool.Close()
+}
+
+func (sender *Sender) newPool(senderSettings map[string]string) *smtpPool {
+	dialer := &gomail.Dialer{
+		Host: sender.SMTPhost,
+		Port: int(sender.SMTPport),
+		TLSConfig: &tls.Config{
+			InsecureSkipVerify: sender.InsecureTLS,
+			ServerName:         sender.SMTPhost,
+		},
+		SSL: sender.SSL,
+	}
+	if sender.Password != "" {
+		dialer.Auth = smtp.PlainAuth("", sender.Username, sender.Password, sender.SMTPhost)
+	}
+	size := defaultPoolSize
+	if senderSettings["smtp_pool_size"] != "" {
+		size, _ = strconv.Atoi(senderSettings["smtp_pool_size"])
+	}
+	idleTimeout := defaultIdleTimeout
+	if senderSettings["smtp_idle_timeout"] != "" {
+		idleTimeout = to.Duration(senderSettings["smtp_idle_timeout"])
+	}
+	return newSMTPPool(dialer, size, idleTimeout)
+}
+
 // SetLogger for test purposes
 func (sender *Sender) SetLogger(logger notifier.Logger) {
 	log = logger
 }
 
+// ValidateContact checks contact value and cc, bcc settings contain valid address lists
+func (sender *Sender) ValidateContact(contact notifier.ContactData) error {
+	_, err := parseRecipients(contact)
+	return err
+}
+
+// parseRecipients returns addresses from contact value and cc, bcc contact settings by header name.
+// Addresses in lists are separated by commas or semicolons
+func parseRecipients(contact notifier.ContactData) (map[string][]*netmail.Address, error) {
+	recipients := make(map[string][]*netmail.Address)
+	for header, list := range map[string]string{
+		"To":  contact.Value,
+		"Cc":  contact.Settings["cc"],
+		"Bcc": contact.Settings["bcc"],
+	} {
+		list = strings.TrimSpace(strings.Replace(list, ";", ",", -1))
+		if list == "" {
+			continue
+		}
+		addresses, err := netmail.ParseAddressList(list)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid %s address list %s: %s", header, list, err.Error())
+		}
+		recipients[header] = addresses
+	}
+	if len(recipients["To"]) == 0 {
+		return nil, fmt.Errorf("Contact %s has no recipient address", contact.ID)
+	}
+	return recipients, nil
+}
+
 // MakeMessage prepare message to send
-func (sender *Sender) MakeMessage(events notifier.EventsData, contact notifier.ContactData, trigger notifier.TriggerData, throttled bool) *gomail.Message {
-	state := events.GetSubjectState()
-	tags := trigger.GetTags()
-
-	subject := fmt.Sprintf("%s %s %s (%d)", state, trigger.Name, tags, len(events))
-
-	templateData := struct {
-		Link        string
-		Description string
-		Throttled   bool
-		Items       []*templateRow
-	}{
-		Link:        fmt.Sprintf("%s/#/events/%s", sender.FrontURI, events[0].TriggerID),
+func (sender *Sender) MakeMessage(events notifier.EventsData, contact notifier.ContactData, trigger notifier.TriggerData, throttled bool) (*gomail.Message, error) {
+	if sender.renderer == nil {
+		sender.renderer = render.Default("mail")
+	}
+	htmlTemplate := sender.htmlTemplate
+	if htmlTemplate == nil {
+		htmlTemplate = defaultTemplate
+	}
+	maxEvents := sender.MaxEvents
+	if maxEvents <= 0 {
+		maxEvents = defaultMaxEvents
+	}
+
+	renderer := sender.renderer.Contact(contact)
+	view := render.NewView(events, contact, trigger, throttled, sender.FrontURI)
+	subject, err := renderer.Render("subject", view)
+	if err != nil {
+		return nil, err
+	}
+	text, err := renderer.Render("text", view)
+	if err != nil {
+		return nil, err
+	}
+
+	templateData := TemplateData{
+		Subject:     subject,
+		Language:    renderer.Language(),
+		States:      view.States,
+		WarnValue:   strconv.FormatFloat(trigger.WarnValue, 'f', -1, 64),
+		ErrorValue:  strconv.FormatFloat(trigger.ErrorValue, 'f', -1, 64),
+		Link:        view.Link,
 		Description: trigger.Desc,
 		Throttled:   throttled,
 		Items:       make([]*templateRow, 0, len(events)),
+		T: func(key string, args ...interface{}) template.HTML {
+			return template.HTML(renderer.Translate(key, args...))
+		},
 	}
 
-	for _, event := range events {
+	chart := newChart(events, trigger)
+	if chart != nil {
+		templateData.Chart = template.URL("cid:" + chartName)
+		templateData.ChartSeries = chart.Series
+	}
+
+	for i, event := range events {
+		if i >= maxEvents {
+			templateData.More = len(events) - maxEvents
+			break
+		}
 		templateData.Items = append(templateData.Items, &templateRow{
 			Metric:     event.Metric,
-			Timestamp:  time.Unix(event.Timestamp, 0).Format("15:04 02.01.2006"),
+			Timestamp:  renderer.FormatDateTime(event.Timestamp),
 			Oldstate:   event.OldState,
 			State:      event.State,
 			Value:      strconv.FormatFloat(event.Value, 'f', -1, 64),
-			WarnValue:  strconv.FormatFloat(trigger.WarnValue, 'f', -1, 64),
-			ErrorValue: strconv.FormatFloat(trigger.ErrorValue, 'f', -1, 64),
+			WarnValue:  templateData.WarnValue,
+			ErrorValue: templateData.ErrorValue,
 			Message:    event.Message,
 		})
 	}
 
+	var html bytes.Buffer
+	if err := htmlTemplate.Execute(&html, templateData); err != nil {
+		return nil, fmt.Errorf("Failed to render mail html template: %s", err.Error())
+	}
+
 	m := gomail.NewMessage()
 	m.SetHeader("From", sender.From)
-	m.SetHeader("To", contact.Value)
+	recipients, err := parseRecipients(contact)
+	if err != nil {
+		return nil, err
+	}
+	for _, header := range []string{"To", "Cc", "Bcc"} {
+		if len(recipients[header]) == 0 {
+			continue
+		}
+		addresses := make([]string, 0, len(recipients[header]))
+		for _, address := range recipients[header] {
+			addresses = append(addresses, m.FormatAddress(address.Address, address.Name))
+		}
+		m.SetHeader(header, addresses...)
+	}
 	m.SetHeader("Subject", subject)
-	m.AddAlternativeWriter("text/html", func(w io.Writer) error {
-		return tpl.Execute(w, templateData)
-	})
+	m.SetHeader("Message-ID", sender.newMessageID())
+	m.SetBody("text/plain", text)
+	m.AddAlternative("text/html", html.String())
+	if chart != nil {
+		m.Embed(chartName, gomail.SetCopyFunc(func(w io.Writer) error {
+			return png.Encode(w, chart.Draw())
+		}))
+	}
 
-	return m
+	return m, nil
 }
 
 //SendEvents implements Sender interface Send
-func (sender *Sender) SendEvents(events notifier.EventsData, contact notifier.ContactData, trigger notifier.TriggerData, throttled bool) error {
+func (sender *Sender) SendEvents(ctx context.Context, events notifier.EventsData, contact notifier.ContactData, trigger notifier.TriggerData, throttled bool) error {
 
-	m := sender.MakeMessage(events, contact, trigger, throttled)
+	m, err := sender.MakeMessage(events, contact, trigger, throttled)
+	if err != nil {
+		return err
+	}
 
-	d := gomail.Dialer{
-		Host: sender.SMTPhost,
-		Port: int(sender.SMTPport),
-		TLSConfig: &tls.Config{
-			InsecureSkipVerify: sender.InsecureTLS,
-			ServerName:         sender.SMTPhost,
-		},
-		SSL: sender.SSL,
+	if sender.pool == nil {
+		sender.pool = sender.newPool(nil)
 	}
 
-	if sender.Password != "" {
-		d.Auth = smtp.PlainAuth("", sender.Username, sender.Password, sender.SMTPhost)
+	threaded := sender.DB != nil && trigger.ID != ""
+	var incidentID string
+	if threaded {
+		if incidentID, err = sender.DB.GetTriggerIncident("mail", contact.ID, trigger.ID); err != nil {
+			log.Warningf("Failed to get mail thread of trigger %s: %s", trigger.ID, err.Error())
+		}
+		if incidentID != "" {
+			m.SetHeader("In-Reply-To", incidentID)
+			m.SetHeader("References", incidentID)
+		}
 	}
 
-	if err := d.DialAndSend(m); err != nil {
+	err = sender.pool.Send(ctx, func(s gomail.Sender) error {
+		if sender.DKIM != nil {
+			return gomail.Send(&signedSender{signer: sender.DKIM, sender: s}, m)
+		}
+		return gomail.Send(s, m)
+	})
+	if err != nil || !threaded {
 		return err
 	}
+
+	if events.GetSubjectState() == "OK" {
+		var state string
+		if state, err = sender.DB.GetTriggerState(trigger.ID); err == nil && state == "OK" {
+			err = sender.DB.RemoveTriggerIncident("mail", contact.ID, trigger.ID)
+		}
+	} else if incidentID == "" {
+		err = sender.DB.SetTriggerIncident("mail", contact.ID, trigger.ID, m.GetHeader("Message-ID")[0])
+	}
+	if err != nil {
+		log.Warningf("Failed to save mail thread of trigger %s: %s", trigger.ID, err.Error())
+	}
 	return nil
 }
+
+// newMessageID returns unique Message-ID in domain of sender address
+func (sender *Sender) newMessageID() string {
+	domain := "moira"
+	if at := strings.LastIndex(sender.From, "@"); at != -1 && at < len(sender.From)-1 {
+		domain = sender.From[at+1:]
+	}
+	random := make([]byte, 8)
+	rand.Read(random)
+	return fmt.Sprintf("<%d.%s@%s>", time.Now().UnixNano(), hex.EncodeToString(random), domain)
+}
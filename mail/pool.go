@@ -0,0 +1,240 @@
+package mail
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/smtp"
+	"strconv"
+	"sync"
+	"time"
+
+	gomail "gopkg.in/gomail.v2"
+)
+
+// commandTimeout limits dialing SMTP server and commands sent outside of message sending
+const commandTimeout = 10 * time.Second
+
+// smtpConnection is SMTP connection kept open between sendings
+type smtpConnection struct {
+	conn     net.Conn
+	client   *smtp.Client
+	lastUsed time.Time
+	// mailAccepted is set once server accepted MAIL FROM of current sending,
+	// message can not be safely sent once more after that
+	mailAccepted bool
+}
+
+// Send implements gomail.Sender interface
+func (conn *smtpConnection) Send(from string, to []string, msg io.WriterTo) error {
+	if err := conn.client.Mail(from); err != nil {
+		return err
+	}
+	conn.mailAccepted = true
+	for _, address := range to {
+		if err := conn.client.Rcpt(address); err != nil {
+			return err
+		}
+	}
+	writer, err := conn.client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := msg.WriteTo(writer); err != nil {
+		writer.Close()
+		return err
+	}
+	return writer.Close()
+}
+
+// Close says QUIT to server and closes connection
+func (conn *smtpConnection) Close() error {
+	conn.conn.SetDeadline(time.Now().Add(commandTimeout))
+	if err := conn.client.Quit(); err != nil {
+		return conn.client.Close()
+	}
+	return nil
+}
+
+// check sends NOOP to make sure pooled connection has not been closed by server
+func (conn *smtpConnection) check(ctx context.Context) error {
+	conn.conn.SetDeadline(commandDeadline(ctx))
+	return conn.client.Noop()
+}
+
+// commandDeadline returns deadline of SMTP command, it is not later than deadline of ctx
+func commandDeadline(ctx context.Context) time.Time {
+	deadline := time.Now().Add(commandTimeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		return ctxDeadline
+	}
+	return deadline
+}
+
+// smtpPool keeps up to size idle SMTP connections for idleTimeout and reconnects broken ones.
+// Sender worker sends packages one by one and uses single connection, more connections are kept
+// only if SendEvents of sender is called concurrently
+type smtpPool struct {
+	dialer      *gomail.Dialer
+	size        int
+	idleTimeout time.Duration
+	mutex       sync.Mutex
+	idle        []*smtpConnection
+	closed      bool
+}
+
+func newSMTPPool(dialer *gomail.Dialer, size int, idleTimeout time.Duration) *smtpPool {
+	return &smtpPool{
+		dialer:      dialer,
+		size:        size,
+		idleTimeout: idleTimeout,
+	}
+}
+
+// Send sends message with pooled connection checked by NOOP. Message is sent once more with new connection
+// only if pooled one fails before server accepted MAIL FROM, so server never gets the message twice.
+// Connection deadline is set to deadline of ctx
+func (pool *smtpPool) Send(ctx context.Context, send func(gomail.Sender) error) error {
+	conn, pooled, err := pool.get(ctx)
+	if err != nil {
+		return err
+	}
+	deadline, _ := ctx.Deadline()
+	conn.conn.SetDeadline(deadline)
+	if err = send(conn); err != nil && pooled && !conn.mailAccepted {
+		conn.client.Close()
+		log.Debugf("Reconnecting to SMTP server %s: %s", pool.dialer.Host, err.Error())
+		if conn, err = pool.dial(ctx); err != nil {
+			return err
+		}
+		conn.conn.SetDeadline(deadline)
+		err = send(conn)
+	}
+	if err != nil {
+		conn.client.Close()
+		return err
+	}
+	pool.put(conn)
+	return nil
+}
+
+// Check dials SMTP server and keeps connection in pool
+func (pool *smtpPool) Check() error {
+	conn, err := pool.dial(context.Background())
+	if err != nil {
+		return err
+	}
+	pool.put(conn)
+	return nil
+}
+
+// Close closes idle connections, connections in use are closed when returned
+func (pool *smtpPool) Close() error {
+	pool.mutex.Lock()
+	idle := pool.idle
+	pool.idle = nil
+	pool.closed = true
+	pool.mutex.Unlock()
+	for _, conn := range idle {
+		conn.Close()
+	}
+	return nil
+}
+
+// get returns live idle connection or dials new one if there is none
+func (pool *smtpPool) get(ctx context.Context) (*smtpConnection, bool, error) {
+	for {
+		conn := pool.takeIdle()
+		if conn == nil {
+			break
+		}
+		if time.Since(conn.lastUsed) > pool.idleTimeout {
+			conn.Close()
+			continue
+		}
+		if err := conn.check(ctx); err != nil {
+			log.Debugf("Reconnecting to SMTP server %s: %s", pool.dialer.Host, err.Error())
+			conn.client.Close()
+			continue
+		}
+		conn.mailAccepted = false
+		return conn, true, nil
+	}
+	conn, err := pool.dial(ctx)
+	return conn, false, err
+}
+
+func (pool *smtpPool) takeIdle() *smtpConnection {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	if len(pool.idle) == 0 {
+		return nil
+	}
+	conn := pool.idle[len(pool.idle)-1]
+	pool.idle = pool.idle[:len(pool.idle)-1]
+	return conn
+}
+
+func (pool *smtpPool) put(conn *smtpConnection) {
+	conn.lastUsed = time.Now()
+	pool.mutex.Lock()
+	if !pool.closed && len(pool.idle) < pool.size {
+		pool.idle = append(pool.idle, conn)
+		conn = nil
+	}
+	pool.mutex.Unlock()
+	if conn != nil {
+		conn.Close()
+	}
+}
+
+// dial connects to SMTP server the same way gomail.Dialer does, but keeps network connection
+// to check pooled connections and limit commands by deadlines
+func (pool *smtpPool) dial(ctx context.Context) (*smtpConnection, error) {
+	dialer := pool.dialer
+	netDialer := &net.Dialer{Timeout: commandTimeout}
+	conn, err := netDialer.DialContext(ctx, "tcp", net.JoinHostPort(dialer.Host, strconv.Itoa(dialer.Port)))
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(commandDeadline(ctx))
+	netConn := conn
+	if dialer.SSL {
+		netConn = tls.Client(conn, dialer.TLSConfig)
+	}
+	client, err := smtp.NewClient(netConn, dialer.Host)
+	if err != nil {
+		netConn.Close()
+		return nil, err
+	}
+	if err := pool.handshake(client); err != nil {
+		client.Close()
+		return nil, err
+	}
+	return &smtpConnection{conn: conn, client: client}, nil
+}
+
+func (pool *smtpPool) handshake(client *smtp.Client) error {
+	dialer := pool.dialer
+	if dialer.LocalName != "" {
+		if err := client.Hello(dialer.LocalName); err != nil {
+			return err
+		}
+	}
+	if !dialer.SSL {
+		if ok, _ := client.Extension("STARTTLS"); ok {
+			if err := client.StartTLS(dialer.TLSConfig); err != nil {
+				return err
+			}
+		}
+	}
+	if dialer.Auth != nil {
+		if ok, _ := client.Extension("AUTH"); ok {
+			if err := client.Auth(dialer.Auth); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
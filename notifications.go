@@ -164,7 +164,7 @@ func ProcessScheduledNotifications() error {
 	}
 	var sendingWG sync.WaitGroup
 	for _, pkg := range notificationPackages {
-		ch, found := sending[pkg.Contact.Type]
+		ch, found := getSenderChannel(pkg.Contact.Type)
 		if !found {
 			pkg.resend(fmt.Sprintf("Unknown contact type [%s]", pkg))
 			continue
@@ -176,7 +176,7 @@ func ProcessScheduledNotifications() error {
 			select {
 			case ch <- *pkg:
 				break
-			case <-time.After(senderTimeout):
+			case <-time.After(getSenderTimeout()):
 				pkg.resend(fmt.Sprintf("Timeout sending %s", pkg))
 				break
 			}
@@ -188,11 +188,9 @@ func ProcessScheduledNotifications() error {
 
 func (pkg notificationPackage) resend(reason string) {
 	sendingFailed.Mark(1)
-	if metric, found := sendersFailedMetrics[pkg.Contact.Type]; found {
-		metric.Mark(1)
-	}
+	markSenderMeter(sendersFailedMetrics, pkg.Contact.Type)
 	log.Warningf("Can't send message after %d try: %s. Retry again after 1 min", pkg.FailCount, reason)
-	if time.Duration(pkg.FailCount)*time.Minute > resendingTimeout {
+	if time.Duration(pkg.FailCount)*time.Minute > getResendingTimeout() {
 		log.Error("Stop resending. Notification interval is timed out")
 	} else {
 		for _, event := range pkg.Events {
@@ -15,11 +15,17 @@ var (
 	eventsProcessingFailed = metrics.NewRegisteredMeter("events.failed", metrics.DefaultRegistry)
 	subsMalformed          = metrics.NewRegisteredMeter("subs.malformed", metrics.DefaultRegistry)
 	sendingFailed          = metrics.NewRegisteredMeter("sending.failed", metrics.DefaultRegistry)
+	sendingTimedOut        = metrics.NewRegisteredMeter("sending.timeout", metrics.DefaultRegistry)
 	senderTimeout          time.Duration
 	resendingTimeout       time.Duration
+	deliveryTimeout        time.Duration
 	sending                = make(map[string]chan notificationPackage)
+	senderWorkers          = make(map[string]*senderWorker)
+	sendingLock            sync.RWMutex
+	settingsLock           sync.RWMutex
 	sendersOkMetrics       = make(map[string]metrics.Meter)
 	sendersFailedMetrics   = make(map[string]metrics.Meter)
+	sendersTimeoutMetrics  = make(map[string]metrics.Meter)
 
 	log    Logger
 	db     Database
@@ -46,9 +52,36 @@ func SetDb(connector Database) {
 	db = connector
 }
 
-// SetSettings allows you to redefine config in tests
+// SetSettings allows you to redefine config in tests and on configuration reload
 func SetSettings(c *Config) {
+	settingsLock.Lock()
+	defer settingsLock.Unlock()
 	config = c
 	senderTimeout = to.Duration(config.Notifier.SenderTimeout)
 	resendingTimeout = to.Duration(config.Notifier.ResendingTimeout)
+	deliveryTimeout = to.Duration(config.Notifier.DeliveryTimeout)
+}
+
+func getSettings() *Config {
+	settingsLock.RLock()
+	defer settingsLock.RUnlock()
+	return config
+}
+
+func getSenderTimeout() time.Duration {
+	settingsLock.RLock()
+	defer settingsLock.RUnlock()
+	return senderTimeout
+}
+
+func getResendingTimeout() time.Duration {
+	settingsLock.RLock()
+	defer settingsLock.RUnlock()
+	return resendingTimeout
+}
+
+func getDeliveryTimeout() time.Duration {
+	settingsLock.RLock()
+	defer settingsLock.RUnlock()
+	return deliveryTimeout
 }
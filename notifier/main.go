@@ -5,11 +5,13 @@ import (
 	"flag"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"os"
 	"os/signal"
 	"path/filepath"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 
 	//	"moira/notifier/kontur"
@@ -33,8 +35,22 @@ var (
 	printVersion   = flag.Bool("version", false, "Print current version and exit")
 	convertDb      = flag.Bool("convert", false, "Convert telegram contacts and exit")
 	Version        = "latest"
+	// createSender creates senders of configured types
+	createSender = newSender
 )
 
+// selfStateMonitor is started and stopped by settings reload when self state monitoring is enabled or disabled
+var selfStateMonitor struct {
+	shutdown chan bool
+	wg       sync.WaitGroup
+}
+
+// httpServer serves sender handlers, it is restarted by settings reload when http_listen is changed
+var httpServer struct {
+	listener net.Listener
+	listen   string
+}
+
 type worker func(chan bool, *sync.WaitGroup)
 
 func run(worker worker, shutdown chan bool, wg *sync.WaitGroup) {
@@ -72,26 +88,39 @@ func main() {
 	}
 	notifier.InitMetrics()
 
+	if err := configureHTTPServer(config.Notifier.HTTPListen); err != nil {
+		log.Fatalf("Can not start HTTP server: %s", err.Error())
+	}
+	defer configureHTTPServer("")
+
 	shutdown := make(chan bool)
 	var wg sync.WaitGroup
 	run(notifier.FetchEvents, shutdown, &wg)
 	run(notifier.FetchScheduledNotifications, shutdown, &wg)
-	if notifier.ToBool(config.Notifier.SelfState.Enabled) {
-		run(notifier.SelfStateMonitor, shutdown, &wg)
-	} else {
-		log.Debugf("Moira Self State Monitoring disabled")
-	}
+	configureSelfStateMonitor(true)
 
 	log.Infof("Moira Notifier Started. Version: %s", Version)
-	ch := make(chan os.Signal)
-	signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM)
-	log.Info(fmt.Sprint(<-ch))
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	handleSignals(ch, reloadSettings)
 	close(shutdown)
+	configureSelfStateMonitor(false)
 	wg.Wait()
 	db.DeregisterBots()
 	log.Infof("Moira Notifier Stopped. Version: %s", Version)
 }
 
+// handleSignals calls reload on every SIGHUP and returns when any other signal is received
+func handleSignals(ch chan os.Signal, reload func()) {
+	for sig := range ch {
+		log.Info(fmt.Sprint(sig))
+		if sig != syscall.SIGHUP {
+			return
+		}
+		reload()
+	}
+}
+
 func configureLog() error {
 	var err error
 	log, err = logging.GetLogger("notifier")
@@ -99,11 +128,6 @@ func configureLog() error {
 		return fmt.Errorf("Can't initialize logger: %s", err.Error())
 	}
 	var logBackend *logging.LogBackend
-	logLevel, err := logging.LogLevel(config.Notifier.LogLevel)
-	if err != nil {
-		logLevel = logging.DEBUG
-	}
-	logging.SetFormatter(logging.MustStringFormatter("%{time:2006-01-02 15:04:05}\t%{level}\t%{message}"))
 	logFileName := config.Notifier.LogFile
 	if logFileName == "stdout" || logFileName == "" {
 		logBackend = logging.NewLogBackend(os.Stdout, "", 0)
@@ -119,57 +143,163 @@ func configureLog() error {
 		logBackend = logging.NewLogBackend(logFile, "", 0)
 	}
 	logBackend.Color = notifier.ToBool(config.Notifier.LogColor)
-	logging.SetBackend(logBackend)
-	logging.SetLevel(logLevel, "notifier")
+	formatter := logging.MustStringFormatter("%{time:2006-01-02 15:04:05}\t%{level}\t%{message}")
+	logging.SetBackend(&levelBackend{Backend: logging.NewBackendFormatter(logBackend, formatter)})
+	configureLogLevel()
 	notifier.SetLogger(log)
 	return nil
 }
 
+// levelBackend filters records by level shared by all modules. Unlike default go-logging leveled backend
+// its level can be changed by settings reload while other goroutines are logging
+type levelBackend struct {
+	logging.Backend
+	level int32
+}
+
+func (backend *levelBackend) GetLevel(module string) logging.Level {
+	return logging.Level(atomic.LoadInt32(&backend.level))
+}
+
+func (backend *levelBackend) SetLevel(level logging.Level, module string) {
+	atomic.StoreInt32(&backend.level, int32(level))
+}
+
+func (backend *levelBackend) IsEnabledFor(level logging.Level, module string) bool {
+	return level <= backend.GetLevel(module)
+}
+
+func (backend *levelBackend) Log(level logging.Level, calldepth int, record *logging.Record) error {
+	if !backend.IsEnabledFor(level, record.Module) {
+		return nil
+	}
+	return backend.Backend.Log(level, calldepth+1, record)
+}
+
+func configureLogLevel() {
+	logLevel, err := logging.LogLevel(config.Notifier.LogLevel)
+	if err != nil {
+		logLevel = logging.DEBUG
+	}
+	logging.SetLevel(logLevel, "notifier")
+}
+
+// reloadSettings rereads config file and applies timeouts, log level, http_listen, self state settings and changed senders.
+// Scheduled notifications and events fetching are not interrupted
+func reloadSettings() {
+	newConfig, err := readSettings(*configFileName)
+	if err != nil {
+		log.Errorf("Can not reload settings: %s", err.Error())
+		return
+	}
+	config = newConfig
+	notifier.SetSettings(config)
+	configureLogLevel()
+	if err := configureHTTPServer(config.Notifier.HTTPListen); err != nil {
+		log.Errorf("Can not restart HTTP server on %s, keep serving on %s: %s", config.Notifier.HTTPListen, httpServer.listen, err.Error())
+	}
+	for _, senderSettings := range config.Notifier.Senders {
+		prepareSenderSettings(senderSettings)
+	}
+	if err := notifier.ReloadSenders(config.Notifier.Senders, createSender); err != nil {
+		log.Errorf("Can not reload senders: %s", err.Error())
+	}
+	selfStateConfigured := true
+	if err := notifier.CheckSelfStateMonitorSettings(); err != nil {
+		log.Errorf("Self state monitor misconfigured and stopped: %s", err.Error())
+		selfStateConfigured = false
+	}
+	configureSelfStateMonitor(selfStateConfigured)
+	log.Infof("Settings reloaded from %s", *configFileName)
+}
+
+// configureSelfStateMonitor runs self state monitor if it is enabled in settings and can be run, and stops it otherwise
+func configureSelfStateMonitor(canRun bool) {
+	enabled := canRun && notifier.ToBool(config.Notifier.SelfState.Enabled)
+	running := selfStateMonitor.shutdown != nil
+	if enabled && !running {
+		selfStateMonitor.shutdown = make(chan bool)
+		run(notifier.SelfStateMonitor, selfStateMonitor.shutdown, &selfStateMonitor.wg)
+		return
+	}
+	if !enabled && running {
+		close(selfStateMonitor.shutdown)
+		selfStateMonitor.wg.Wait()
+		selfStateMonitor.shutdown = nil
+	}
+	if !enabled {
+		log.Debugf("Moira Self State Monitoring disabled")
+	}
+}
+
+// configureHTTPServer starts HTTP server on listen address and then stops server listening on previous address,
+// server is only stopped if listen address is empty
+func configureHTTPServer(listen string) error {
+	if listen == httpServer.listen {
+		return nil
+	}
+	var listener net.Listener
+	if listen != "" {
+		var err error
+		if listener, err = notifier.StartHTTPServer(listen); err != nil {
+			return err
+		}
+	}
+	if httpServer.listener != nil {
+		httpServer.listener.Close()
+	}
+	httpServer.listener, httpServer.listen = listener, listen
+	return nil
+}
+
 func configureSenders() error {
 	for _, senderSettings := range config.Notifier.Senders {
-		senderSettings["front_uri"] = config.Front.URI
-		switch senderSettings["type"] {
-		case "pushover":
-			if err := notifier.RegisterSender(senderSettings, &pushover.Sender{}); err != nil {
-				log.Fatalf("Can not register sender %s: %s", senderSettings["type"], err)
-			}
-		case "slack":
-			if err := notifier.RegisterSender(senderSettings, &slack.Sender{}); err != nil {
-				log.Fatalf("Can not register sender %s: %s", senderSettings["type"], err)
-			}
-		case "mail":
-			if err := notifier.RegisterSender(senderSettings, &mail.Sender{}); err != nil {
-				log.Fatalf("Can not register sender %s: %s", senderSettings["type"], err)
-			}
-		case "script":
-			if err := notifier.RegisterSender(senderSettings, &script.Sender{}); err != nil {
-				log.Fatalf("Can not register sender %s: %s", senderSettings["type"], err)
-			}
-		case "telegram":
-			if err := notifier.RegisterSender(senderSettings, &telegram.Sender{DB: db}); err != nil {
-				log.Fatalf("Can not register sender %s: %s", senderSettings["type"], err)
-			}
-		case "twilio sms":
-			if err := notifier.RegisterSender(senderSettings, &twilio.Sender{}); err != nil {
-				log.Fatalf("Can not register sender %s: %s", senderSettings["type"], err)
-			}
-		case "twilio voice":
-			if err := notifier.RegisterSender(senderSettings, &twilio.Sender{}); err != nil {
-				log.Fatalf("Can not register sender %s: %s", senderSettings["type"], err)
-			}
-			//		case "email":
-			//			if err := notifier.RegisterSender(senderSettings, &kontur.MailSender{}); err != nil {
-			//			}
-			//		case "phone":
-			//			if err := notifier.RegisterSender(senderSettings, &kontur.SmsSender{}); err != nil {
-			//			}
-		default:
-			return fmt.Errorf("Unknown sender type [%s]", senderSettings["type"])
+		prepareSenderSettings(senderSettings)
+		sender, err := createSender(senderSettings)
+		if err != nil {
+			return err
+		}
+		if err := notifier.RegisterSender(senderSettings, sender); err != nil {
+			log.Fatalf("Can not register sender %s: %s", senderSettings["type"], err)
 		}
 	}
 	return nil
 }
 
+// prepareSenderSettings adds common notifier settings to sender settings
+func prepareSenderSettings(senderSettings map[string]string) {
+	senderSettings["front_uri"] = config.Front.URI
+	if senderSettings["templates_dir"] == "" {
+		senderSettings["templates_dir"] = config.Notifier.TemplatesDir
+	}
+	if senderSettings["language"] == "" {
+		senderSettings["language"] = config.Notifier.Language
+	}
+}
+
+func newSender(senderSettings map[string]string) (notifier.Sender, error) {
+	switch senderSettings["type"] {
+	case "pushover":
+		return &pushover.Sender{DB: db}, nil
+	case "slack":
+		return &slack.Sender{DB: db}, nil
+	case "mail":
+		return &mail.Sender{DB: db}, nil
+	case "script":
+		return &script.Sender{}, nil
+	case "telegram":
+		return &telegram.Sender{DB: db}, nil
+	case "twilio sms", "twilio voice":
+		return &twilio.Sender{DB: db}, nil
+		//		case "email":
+		//			return &kontur.MailSender{}, nil
+		//		case "phone":
+		//			return &kontur.SmsSender{}, nil
+	default:
+		return nil, fmt.Errorf("Unknown sender type [%s]", senderSettings["type"])
+	}
+}
+
 func convertDatabase(db notifier.Database) {
 	fmt.Println("This will convert all telegram contacts from @ notation to #.")
 	fmt.Print("Continue? [y/N]: ")
@@ -210,6 +340,8 @@ func readSettings(configFileName string) (*notifier.Config, error) {
 			LogColor:         "false",
 			SenderTimeout:    "10s0ms",
 			ResendingTimeout: "24:00",
+			DeliveryTimeout:  "30s",
+			Language:         "en",
 			SelfState: notifier.SelfStateConfig{
 				Enabled:                 "false",
 				RedisDisconectDelay:     30,
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"testing"
+
+	"github.com/moira-alert/notifier"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestNotifierMain(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Notifier Main Suite")
+}
+
+// journalSender records initialization and closing with its settings value
+type journalSender struct {
+	journal *[]string
+	mutex   *sync.Mutex
+	value   string
+}
+
+func (sender *journalSender) record(entry string) {
+	sender.mutex.Lock()
+	defer sender.mutex.Unlock()
+	*sender.journal = append(*sender.journal, entry)
+}
+
+func (sender *journalSender) Init(senderSettings map[string]string, logger notifier.Logger) error {
+	sender.value = senderSettings["value"]
+	sender.record("init " + sender.value)
+	return nil
+}
+
+func (sender *journalSender) SendEvents(ctx context.Context, events notifier.EventsData, contact notifier.ContactData, trigger notifier.TriggerData, throttled bool) error {
+	return nil
+}
+
+func (sender *journalSender) Close() error {
+	sender.record("close " + sender.value)
+	return nil
+}
+
+var _ = Describe("Notifier main", func() {
+	var configFile *os.File
+	var journal []string
+	var journalMutex sync.Mutex
+
+	writeConfig := func(configYaml string) {
+		Expect(ioutil.WriteFile(configFile.Name(), []byte(configYaml), 0644)).Should(Succeed())
+	}
+	getJournal := func() []string {
+		journalMutex.Lock()
+		defer journalMutex.Unlock()
+		return append([]string(nil), journal...)
+	}
+
+	BeforeEach(func() {
+		var err error
+		configFile, err = ioutil.TempFile("", "notifier")
+		Expect(err).ShouldNot(HaveOccurred())
+		configFile.Close()
+		*configFileName = configFile.Name()
+		config = &notifier.Config{}
+		Expect(configureLog()).Should(Succeed())
+		journal = nil
+		createSender = func(senderSettings map[string]string) (notifier.Sender, error) {
+			return &journalSender{journal: &journal, mutex: &journalMutex}, nil
+		}
+	})
+
+	AfterEach(func() {
+		configureSelfStateMonitor(false)
+		configureHTTPServer("")
+		notifier.StopSenders()
+		createSender = newSender
+		os.Remove(configFile.Name())
+	})
+
+	Context("When SIGHUP is received", func() {
+		It("should replace changed senders and stop removed ones until other signal", func() {
+			writeConfig(`
+notifier:
+  http_listen: 127.0.0.1:0
+  senders:
+    - type: changed
+      value: first
+    - type: kept
+      value: kept
+    - type: removed
+      value: removed
+`)
+			var err error
+			config, err = readSettings(*configFileName)
+			Expect(err).ShouldNot(HaveOccurred())
+			notifier.SetSettings(config)
+			Expect(configureSenders()).Should(Succeed())
+			Expect(configureHTTPServer(config.Notifier.HTTPListen)).Should(Succeed())
+			configureSelfStateMonitor(true)
+			Expect(selfStateMonitor.shutdown).To(BeNil())
+			firstAddress := httpServer.listener.Addr().String()
+
+			writeConfig(`
+notifier:
+  log_level: info
+  http_listen: localhost:0
+  senders:
+    - type: changed
+      value: second
+    - type: kept
+      value: kept
+  moira_selfstate:
+    enabled: "true"
+    contacts:
+      - type: kept
+        value: admin
+`)
+
+			ch := make(chan os.Signal, 2)
+			ch <- syscall.SIGHUP
+			ch <- syscall.SIGTERM
+			handleSignals(ch, reloadSettings)
+
+			Expect(config.Notifier.LogLevel).To(Equal("info"))
+			Expect(getJournal()).To(Equal([]string{
+				"init first", "init kept", "init removed",
+				"close first", "init second", "close removed",
+			}))
+			Expect(notifier.CheckSelfStateMonitorSettings()).Should(Succeed())
+			Expect(selfStateMonitor.shutdown).NotTo(BeNil())
+			Expect(httpServer.listen).To(Equal("localhost:0"))
+			_, err = net.Dial("tcp", firstAddress)
+			Expect(err).Should(HaveOccurred())
+			Expect(ch).To(BeEmpty())
+		})
+
+		It("should stop self state monitor when it is disabled", func() {
+			writeConfig(`
+notifier:
+  senders:
+    - type: admin
+  moira_selfstate:
+    enabled: "true"
+    contacts:
+      - type: admin
+        value: admin
+`)
+			var err error
+			config, err = readSettings(*configFileName)
+			Expect(err).ShouldNot(HaveOccurred())
+			notifier.SetSettings(config)
+			Expect(configureSenders()).Should(Succeed())
+			configureSelfStateMonitor(true)
+			Expect(selfStateMonitor.shutdown).NotTo(BeNil())
+
+			writeConfig(`
+notifier:
+  senders:
+    - type: admin
+`)
+			reloadSettings()
+			Expect(selfStateMonitor.shutdown).To(BeNil())
+		})
+	})
+})
@@ -0,0 +1,119 @@
+package pushover
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// DefaultAPIURL is Pushover API base url
+const DefaultAPIURL = "https://api.pushover.net/1"
+
+// Message priorities of Pushover API
+const (
+	PriorityLowest    = -2
+	PriorityLow       = -1
+	PriorityNormal    = 0
+	PriorityHigh      = 1
+	PriorityEmergency = 2
+)
+
+// response is common part of Pushover API responses
+type response struct {
+	Status  int      `json:"status"`
+	Request string   `json:"request"`
+	Receipt string   `json:"receipt"`
+	Errors  []string `json:"errors"`
+}
+
+// apiResult is response or API method result embedding it
+type apiResult interface {
+	common() *response
+}
+
+func (r *response) common() *response {
+	return r
+}
+
+// receipt represents status of emergency message
+type receipt struct {
+	response
+	Acknowledged         int    `json:"acknowledged"`
+	AcknowledgedAt       int64  `json:"acknowledged_at"`
+	AcknowledgedBy       string `json:"acknowledged_by"`
+	AcknowledgedByDevice string `json:"acknowledged_by_device"`
+	Expired              int    `json:"expired"`
+}
+
+// apiClient sends messages and manages receipts of emergency messages with Pushover API
+type apiClient struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+func newAPIClient(apiURL, token string) *apiClient {
+	if apiURL == "" {
+		apiURL = DefaultAPIURL
+	}
+	return &apiClient{url: strings.TrimSuffix(apiURL, "/"), token: token, client: &http.Client{}}
+}
+
+// sendMessage sends message to user and returns receipt of emergency message
+func (api *apiClient) sendMessage(ctx context.Context, params url.Values) (string, error) {
+	result := &response{}
+	if err := api.call(ctx, "POST", "messages.json", params, result); err != nil {
+		return "", err
+	}
+	return result.Receipt, nil
+}
+
+func (api *apiClient) getReceipt(ctx context.Context, id string) (*receipt, error) {
+	result := &receipt{}
+	if err := api.call(ctx, "GET", fmt.Sprintf("receipts/%s.json", id), url.Values{}, result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// cancelReceipt stops retries of emergency message
+func (api *apiClient) cancelReceipt(ctx context.Context, id string) error {
+	return api.call(ctx, "POST", fmt.Sprintf("receipts/%s/cancel.json", id), url.Values{}, &response{})
+}
+
+// call requests API method with application token and decodes response into result
+func (api *apiClient) call(ctx context.Context, method, path string, params url.Values, result apiResult) error {
+	params.Set("token", api.token)
+	var request *http.Request
+	var err error
+	if method == "GET" {
+		request, err = http.NewRequest(method, fmt.Sprintf("%s/%s?%s", api.url, path, params.Encode()), nil)
+	} else {
+		request, err = http.NewRequest(method, fmt.Sprintf("%s/%s", api.url, path), strings.NewReader(params.Encode()))
+		if err == nil {
+			request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+	}
+	if err != nil {
+		return err
+	}
+	httpResponse, err := api.client.Do(request.WithContext(ctx))
+	if err != nil {
+		// url error contains application token
+		if urlError, ok := err.(*url.Error); ok {
+			err = urlError.Err
+		}
+		return fmt.Errorf("Pushover %s failed: %s", path, err.Error())
+	}
+	defer httpResponse.Body.Close()
+	if err := json.NewDecoder(httpResponse.Body).Decode(result); err != nil {
+		return fmt.Errorf("Failed to decode pushover %s response with status %s: %s", path, httpResponse.Status, err.Error())
+	}
+	if common := result.common(); common.Status != 1 {
+		return fmt.Errorf("Pushover %s responded with status %s: %s", path, httpResponse.Status, strings.Join(common.Errors, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package pushover
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gosexy/to"
+	"github.com/moira-alert/notifier"
+)
+
+const (
+	soundSettingPrefix = "sound_"
+	minRetry           = 30 * time.Second
+	maxExpire          = 3 * time.Hour
+)
+
+var devicePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,25}$`)
+
+// options are message settings of pushover contact
+type options struct {
+	devices     []string
+	sounds      map[string]string
+	retry       time.Duration
+	expire      time.Duration
+	minPriority int
+	maxPriority int
+}
+
+// parseOptions reads contact settings: device list, sound_<STATE> sounds, retry and expire
+// of emergency messages and min_priority, max_priority limiting priority mapped from states
+func parseOptions(contact notifier.ContactData) (*options, error) {
+	opts := &options{
+		sounds:      make(map[string]string),
+		retry:       defaultRetry,
+		expire:      defaultExpire,
+		minPriority: PriorityLowest,
+		maxPriority: PriorityEmergency,
+	}
+	for _, device := range strings.FieldsFunc(contact.Settings["device"], func(r rune) bool { return r == ',' || r == ' ' }) {
+		if !devicePattern.MatchString(device) {
+			return nil, fmt.Errorf("Invalid pushover device name %s", device)
+		}
+		opts.devices = append(opts.devices, device)
+	}
+	for key, value := range contact.Settings {
+		if strings.HasPrefix(key, soundSettingPrefix) && value != "" {
+			opts.sounds[strings.TrimPrefix(key, soundSettingPrefix)] = value
+		}
+	}
+	if contact.Settings["retry"] != "" {
+		opts.retry = to.Duration(contact.Settings["retry"])
+		if opts.retry < minRetry {
+			return nil, fmt.Errorf("Pushover retry %s is less than %s", contact.Settings["retry"], minRetry)
+		}
+	}
+	if contact.Settings["expire"] != "" {
+		opts.expire = to.Duration(contact.Settings["expire"])
+		if opts.expire <= 0 || opts.expire > maxExpire {
+			return nil, fmt.Errorf("Pushover expire %s is not in range up to %s", contact.Settings["expire"], maxExpire)
+		}
+	}
+	var err error
+	if opts.minPriority, err = parsePriority(contact.Settings["min_priority"], PriorityLowest); err != nil {
+		return nil, err
+	}
+	if opts.maxPriority, err = parsePriority(contact.Settings["max_priority"], PriorityEmergency); err != nil {
+		return nil, err
+	}
+	if opts.minPriority > opts.maxPriority {
+		return nil, fmt.Errorf("Pushover min_priority %d is greater than max_priority %d", opts.minPriority, opts.maxPriority)
+	}
+	return opts, nil
+}
+
+func parsePriority(value string, defaultPriority int) (int, error) {
+	if value == "" {
+		return defaultPriority, nil
+	}
+	priority, err := strconv.Atoi(value)
+	if err != nil || priority < PriorityLowest || priority > PriorityEmergency {
+		return 0, fmt.Errorf("Invalid pushover priority %s", value)
+	}
+	return priority, nil
+}
+
+// priority limits priority mapped from event states by contact floor and ceiling
+func (opts *options) priority(mapped int) int {
+	if mapped < opts.minPriority {
+		return opts.minPriority
+	}
+	if mapped > opts.maxPriority {
+		return opts.maxPriority
+	}
+	return mapped
+}
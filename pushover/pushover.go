@@ -1,22 +1,51 @@
 package pushover
 
 import (
-	"bytes"
+	"context"
 	"fmt"
+	"net/url"
 	"strconv"
+	"strings"
 	"time"
 
+	"github.com/gosexy/to"
 	"github.com/moira-alert/notifier"
+	"github.com/moira-alert/notifier/render"
+)
 
-	"github.com/gregdel/pushover"
+const (
+	defaultRetry        = 5 * time.Minute
+	defaultExpire       = time.Hour
+	defaultPollInterval = time.Minute
+	receiptTimeout      = 10 * time.Second
 )
 
-var log notifier.Logger
+// Database stores receipts of emergency messages of trigger incidents and receipts polled until they are acknowledged.
+// Incident is over when the whole trigger is OK
+type Database interface {
+	GetTriggerIncident(kind, contactID, triggerID string) (string, error)
+	SetTriggerIncident(kind, contactID, triggerID, value string) error
+	RemoveTriggerIncident(kind, contactID, triggerID string) error
+	GetTriggerState(triggerID string) (string, error)
+	GetDelivery(kind, messageID string) (string, error)
+	SetDelivery(kind, messageID, value string) error
+	AddPendingDelivery(kind, messageID string) error
+	GetPendingDeliveries(kind string) ([]string, error)
+	RemovePendingDelivery(kind, messageID string) error
+}
 
 // Sender implements moira sender interface via pushover
 type Sender struct {
-	APIToken string
-	FrontURI string
+	DB           Database
+	APIToken     string
+	APIURL       string
+	FrontURI     string
+	PollInterval time.Duration
+	renderer     *render.Renderer
+	api          *apiClient
+	log          notifier.Logger
+	stop         chan struct{}
+	done         chan struct{}
 }
 
 //Init read yaml config
@@ -25,63 +54,111 @@ func (sender *Sender) Init(senderSettings map[string]string, logger notifier.Log
 	if sender.APIToken == "" {
 		return fmt.Errorf("Can not read pushover api_token from config")
 	}
-	log = logger
+	sender.log = logger
+	sender.APIURL = senderSettings["api_url"]
 	sender.FrontURI = senderSettings["front_uri"]
+	sender.PollInterval = defaultPollInterval
+	if senderSettings["poll_interval"] != "" {
+		sender.PollInterval = to.Duration(senderSettings["poll_interval"])
+	}
+	var err error
+	sender.renderer, err = render.New(senderSettings["type"], senderSettings["templates_dir"], senderSettings["language"])
+	if err != nil {
+		return err
+	}
+	sender.api = newAPIClient(sender.APIURL, sender.APIToken)
+	if sender.DB != nil {
+		sender.stop = make(chan struct{})
+		sender.done = make(chan struct{})
+		go sender.pollReceipts()
+	}
 	return nil
 }
 
-//SendEvents implements Sender interface Send
-func (sender *Sender) SendEvents(events notifier.EventsData, contact notifier.ContactData, trigger notifier.TriggerData, throttled bool) error {
-	api := pushover.New(sender.APIToken)
-	recipient := pushover.NewRecipient(contact.Value)
-
-	subjectState := events.GetSubjectState()
-	title := fmt.Sprintf("%s %s %s (%d)", subjectState, trigger.Name, trigger.GetTags(), len(events))
-	timestamp := events[len(events)-1].Timestamp
+// Close stops polling receipts of emergency messages
+func (sender *Sender) Close() error {
+	if sender.stop != nil {
+		close(sender.stop)
+		<-sender.done
+	}
+	return nil
+}
 
-	var message bytes.Buffer
-	priority := pushover.PriorityNormal
-	for i, event := range events {
-		if i > 4 {
-			break
-		}
-		if event.State == "ERROR" || event.State == "EXCEPTION" {
-			priority = pushover.PriorityEmergency
-		}
-		if priority != pushover.PriorityEmergency && (event.State == "WARN" || event.State == "NODATA") {
-			priority = pushover.PriorityHigh
-		}
-		value := strconv.FormatFloat(event.Value, 'f', -1, 64)
-		message.WriteString(fmt.Sprintf("%s: %s = %s (%s to %s)", time.Unix(event.Timestamp, 0).Format("15:04"), event.Metric, value, event.OldState, event.State))
-		if len(event.Message) > 0 {
-			message.WriteString(fmt.Sprintf(". %s\n", event.Message))
-		} else {
-			message.WriteString("\n")
-		}
+//SendEvents implements Sender interface Send
+func (sender *Sender) SendEvents(ctx context.Context, events notifier.EventsData, contact notifier.ContactData, trigger notifier.TriggerData, throttled bool) error {
+	renderer := sender.renderer.Contact(contact)
+	view := render.NewView(events, contact, trigger, throttled, sender.FrontURI)
+	title, err := renderer.Render("subject", view)
+	if err != nil {
+		return err
 	}
+	message, err := renderer.Render("message", view)
+	if err != nil {
+		return err
+	}
+	timestamp := events[len(events)-1].Timestamp
 
-	if len(events) > 5 {
-		message.WriteString(fmt.Sprintf("\n...and %d more events.", len(events)-5))
+	opts, err := parseOptions(contact)
+	if err != nil {
+		return err
 	}
+	priority := opts.priority(eventsPriority(events))
 
-	if throttled {
-		message.WriteString("\nPlease, fix your system or tune this trigger to generate less events.")
+	trackReceipts := sender.DB != nil && trigger.ID != ""
+	if trackReceipts && view.State == "OK" && sender.triggerResolved(trigger) {
+		sender.cancelEmergency(ctx, contact, trigger)
 	}
 
-	log.Debugf("Calling pushover with message title %s, body %s", title, message.String())
+	sender.log.Debugf("Calling pushover with message title %s, body %s", title, message)
 
-	pushoverMessage := &pushover.Message{
-		Message:   message.String(),
-		Title:     title,
-		Priority:  priority,
-		Retry:     5 * time.Minute,
-		Expire:    time.Hour,
-		Timestamp: timestamp,
-		URL:       fmt.Sprintf("%s/#/events/%s", sender.FrontURI, events[0].TriggerID),
-	}
-	_, err := api.SendMessage(pushoverMessage, recipient)
+	params := url.Values{
+		"user":      {contact.Value},
+		"message":   {message},
+		"title":     {title},
+		"priority":  {strconv.Itoa(priority)},
+		"timestamp": {strconv.FormatInt(timestamp, 10)},
+		"url":       {view.Link},
+	}
+	if len(opts.devices) > 0 {
+		params.Set("device", strings.Join(opts.devices, ","))
+	}
+	if sound := opts.sounds[view.State]; sound != "" {
+		params.Set("sound", sound)
+	}
+	if priority == PriorityEmergency {
+		params.Set("retry", strconv.Itoa(int(opts.retry.Seconds())))
+		params.Set("expire", strconv.Itoa(int(opts.expire.Seconds())))
+	}
+	receiptID, err := sender.api.sendMessage(ctx, params)
 	if err != nil {
 		return fmt.Errorf("Failed to send message to pushover user %s: %s", contact.Value, err.Error())
 	}
+	if trackReceipts && receiptID != "" {
+		sender.saveEmergency(ctx, receiptID, contact, trigger)
+	}
 	return nil
 }
+
+// ValidateContact checks pushover settings of contact
+func (sender *Sender) ValidateContact(contact notifier.ContactData) error {
+	_, err := parseOptions(contact)
+	return err
+}
+
+// eventsPriority maps states of first events to message priority: emergency for errors,
+// high for warnings and missing data
+func eventsPriority(events notifier.EventsData) int {
+	priority := PriorityNormal
+	for i, event := range events {
+		if i > 4 {
+			break
+		}
+		if event.State == "ERROR" || event.State == "EXCEPTION" {
+			priority = PriorityEmergency
+		}
+		if priority != PriorityEmergency && (event.State == "WARN" || event.State == "NODATA") {
+			priority = PriorityHigh
+		}
+	}
+	return priority
+}
@@ -0,0 +1,200 @@
+package pushover
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/moira-alert/notifier"
+)
+
+const emergencyIncidentKind = "pushover"
+
+// emergency is stored for contact and trigger incident when emergency message is sent
+type emergency struct {
+	Receipt        string `json:"receipt"`
+	AcknowledgedBy string `json:"acknowledged_by,omitempty"`
+	AcknowledgedAt int64  `json:"acknowledged_at,omitempty"`
+}
+
+// watchedReceipt is stored for receipt polled until emergency message is acknowledged or expires,
+// so polling continues after notifier restart
+type watchedReceipt struct {
+	ContactID string `json:"contact_id"`
+	TriggerID string `json:"trigger_id"`
+}
+
+// saveEmergency stores receipt of emergency message replacing receipt of previous one,
+// retries of previous message are cancelled unless it has been acknowledged
+func (sender *Sender) saveEmergency(ctx context.Context, receiptID string, contact notifier.ContactData, trigger notifier.TriggerData) {
+	if previous, err := sender.getEmergency(contact.ID, trigger.ID); err != nil {
+		sender.log.Errorf("Failed to get pushover receipt of trigger %s: %s", trigger.ID, err.Error())
+	} else if previous != nil && previous.AcknowledgedBy == "" {
+		sender.cancelReceipt(ctx, previous.Receipt)
+	}
+	if err := sender.setEmergency(contact.ID, trigger.ID, &emergency{Receipt: receiptID}); err != nil {
+		sender.log.Errorf("Failed to save pushover receipt of trigger %s: %s", trigger.ID, err.Error())
+		return
+	}
+	if err := sender.watchReceipt(receiptID, &watchedReceipt{ContactID: contact.ID, TriggerID: trigger.ID}); err != nil {
+		sender.log.Errorf("Failed to watch pushover receipt %s: %s", receiptID, err.Error())
+	}
+}
+
+// triggerResolved checks that the whole trigger is OK and not only metrics of package,
+// emergency message is not cancelled if trigger state can not be read
+func (sender *Sender) triggerResolved(trigger notifier.TriggerData) bool {
+	state, err := sender.DB.GetTriggerState(trigger.ID)
+	if err != nil {
+		sender.log.Warningf("Failed to get state of trigger %s: %s", trigger.ID, err.Error())
+		return false
+	}
+	return state == "OK"
+}
+
+// cancelEmergency stops retries of emergency message when trigger incident is over
+func (sender *Sender) cancelEmergency(ctx context.Context, contact notifier.ContactData, trigger notifier.TriggerData) {
+	incident, err := sender.getEmergency(contact.ID, trigger.ID)
+	if err != nil {
+		sender.log.Errorf("Failed to get pushover receipt of trigger %s: %s", trigger.ID, err.Error())
+		return
+	}
+	if incident == nil {
+		return
+	}
+	if incident.AcknowledgedBy == "" {
+		sender.cancelReceipt(ctx, incident.Receipt)
+	}
+	if err := sender.DB.RemoveTriggerIncident(emergencyIncidentKind, contact.ID, trigger.ID); err != nil {
+		sender.log.Errorf("Failed to remove pushover receipt of trigger %s: %s", trigger.ID, err.Error())
+	}
+}
+
+func (sender *Sender) cancelReceipt(ctx context.Context, receiptID string) {
+	sender.unwatchReceipt(receiptID)
+	if err := sender.api.cancelReceipt(ctx, receiptID); err != nil {
+		sender.log.Warningf("Failed to cancel pushover emergency message %s: %s", receiptID, err.Error())
+		return
+	}
+	sender.log.Debugf("Pushover emergency message %s is cancelled", receiptID)
+}
+
+// pollReceipts checks watched receipts every poll interval until sender is closed
+func (sender *Sender) pollReceipts() {
+	defer close(sender.done)
+	ticker := time.NewTicker(sender.PollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-sender.stop:
+			return
+		case <-ticker.C:
+			sender.checkReceipts()
+		}
+	}
+}
+
+func (sender *Sender) checkReceipts() {
+	receiptIDs, err := sender.DB.GetPendingDeliveries(emergencyIncidentKind)
+	if err != nil {
+		sender.log.Errorf("Failed to get watched pushover receipts: %s", err.Error())
+		return
+	}
+	for _, receiptID := range receiptIDs {
+		watched, err := sender.getWatchedReceipt(receiptID)
+		if err != nil {
+			sender.log.Errorf("Failed to get watched pushover receipt %s: %s", receiptID, err.Error())
+			continue
+		}
+		if watched == nil {
+			sender.unwatchReceipt(receiptID)
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), receiptTimeout)
+		status, err := sender.api.getReceipt(ctx, receiptID)
+		cancel()
+		if err != nil {
+			sender.log.Warningf("Failed to get pushover receipt %s: %s", receiptID, err.Error())
+			continue
+		}
+		if status.Acknowledged == 1 {
+			sender.recordAck(receiptID, watched, status)
+		}
+		if status.Acknowledged == 1 || status.Expired == 1 {
+			sender.unwatchReceipt(receiptID)
+		}
+	}
+}
+
+// recordAck stores who acknowledged emergency message in pushover receipt of trigger incident
+func (sender *Sender) recordAck(receiptID string, watched *watchedReceipt, status *receipt) {
+	incident, err := sender.getEmergency(watched.ContactID, watched.TriggerID)
+	if err != nil {
+		sender.log.Errorf("Failed to get pushover receipt of trigger %s: %s", watched.TriggerID, err.Error())
+		return
+	}
+	if incident == nil || incident.Receipt != receiptID {
+		return
+	}
+	incident.AcknowledgedBy = status.AcknowledgedBy
+	if status.AcknowledgedByDevice != "" {
+		incident.AcknowledgedBy = fmt.Sprintf("%s (%s)", status.AcknowledgedBy, status.AcknowledgedByDevice)
+	}
+	incident.AcknowledgedAt = status.AcknowledgedAt
+	if err := sender.setEmergency(watched.ContactID, watched.TriggerID, incident); err != nil {
+		sender.log.Errorf("Failed to save pushover receipt of trigger %s: %s", watched.TriggerID, err.Error())
+		return
+	}
+	sender.log.Infof("Pushover emergency message %s of trigger %s is acknowledged by %s", receiptID, watched.TriggerID, incident.AcknowledgedBy)
+}
+
+func (sender *Sender) watchReceipt(receiptID string, watched *watchedReceipt) error {
+	value, err := json.Marshal(watched)
+	if err != nil {
+		return err
+	}
+	if err := sender.DB.SetDelivery(emergencyIncidentKind, receiptID, string(value)); err != nil {
+		return err
+	}
+	return sender.DB.AddPendingDelivery(emergencyIncidentKind, receiptID)
+}
+
+func (sender *Sender) unwatchReceipt(receiptID string) {
+	if err := sender.DB.RemovePendingDelivery(emergencyIncidentKind, receiptID); err != nil {
+		sender.log.Errorf("Failed to stop watching pushover receipt %s: %s", receiptID, err.Error())
+	}
+}
+
+// getWatchedReceipt returns nil if receipt is not stored or has expired
+func (sender *Sender) getWatchedReceipt(receiptID string) (*watchedReceipt, error) {
+	value, err := sender.DB.GetDelivery(emergencyIncidentKind, receiptID)
+	if err != nil || value == "" {
+		return nil, err
+	}
+	watched := &watchedReceipt{}
+	if err := json.Unmarshal([]byte(value), watched); err != nil {
+		return nil, fmt.Errorf("Failed to decode watched pushover receipt: %s", err.Error())
+	}
+	return watched, nil
+}
+
+func (sender *Sender) getEmergency(contactID, triggerID string) (*emergency, error) {
+	value, err := sender.DB.GetTriggerIncident(emergencyIncidentKind, contactID, triggerID)
+	if err != nil || value == "" {
+		return nil, err
+	}
+	incident := &emergency{}
+	if err := json.Unmarshal([]byte(value), incident); err != nil {
+		return nil, fmt.Errorf("Failed to decode pushover receipt: %s", err.Error())
+	}
+	return incident, nil
+}
+
+func (sender *Sender) setEmergency(contactID, triggerID string, incident *emergency) error {
+	value, err := json.Marshal(incident)
+	if err != nil {
+		return err
+	}
+	return sender.DB.SetTriggerIncident(emergencyIncidentKind, contactID, triggerID, string(value))
+}
@@ -0,0 +1,123 @@
+package render
+
+import "fmt"
+
+// DefaultLanguage is used when neither sender nor contact language is set
+const DefaultLanguage = "en"
+
+// catalogs contain notification texts of supported languages
+var catalogs = map[string]map[string]string{
+	"en": {
+		"transition":            "%s to %s",
+		"more":                  "...and %d more events.",
+		"throttled":             "Please, fix your system or tune this trigger to generate less events.",
+		"throttled_markdown":    "Please, *fix your system or tune this trigger* to generate less events.",
+		"throttled_html":        "Please, <b>fix your system or tune this trigger</b> to generate less events.",
+		"voice":                 "Hi! This is a notification for Moira trigger %s. Please, visit Moira web interface for details.",
+		"voice_call":            "Hi! This is Moira. Trigger %s is in state %s.",
+		"voice_metric":          "%s is %s.",
+		"voice_more":            "And %d more metrics.",
+		"voice_ack_prompt":      "Press %s to acknowledge.",
+		"voice_acknowledged":    "Acknowledged. Notifications are paused until trigger returns to OK. Goodbye.",
+		"voice_ack_failed":      "Sorry, acknowledgement failed. Please, use Moira web interface.",
+		"voice_no_input":        "No key was pressed. Goodbye.",
+		"events":                "Events",
+		"chart":                 "Chart of event values",
+		"description":           "Description",
+		"timestamp":             "Timestamp",
+		"target":                "Target",
+		"value":                 "Value",
+		"warn":                  "Warn",
+		"error":                 "Error",
+		"from":                  "From",
+		"to":                    "To",
+		"note":                  "Note",
+		"acknowledge":           "Acknowledge",
+		"snooze":                "Snooze 1h",
+		"open_trigger":          "Open trigger",
+		"acknowledged_by":       "Acknowledged by %s, notifications are paused until trigger returns to OK.",
+		"snoozed_by":            "Snoozed for 1 hour by %s.",
+		"bot_start":             "Okay, %s, your link code is %s. Enter it in Moira as value of Telegram contact within an hour.",
+		"bot_group":             "Hi, all!\nI will send alerts in this group (%s).",
+		"bot_help":              "Commands:\n/status - failing triggers\n/mute <trigger> <duration> - mute trigger, e.g. /mute cpu 1h\n/unmute <trigger> - unmute trigger\n/subs - subscriptions\n/test - send test notification",
+		"bot_error":             "Something went wrong, please try again later.",
+		"bot_no_contacts":       "This chat is not used by Moira contacts.",
+		"bot_all_ok":            "All triggers are OK.",
+		"bot_muted_mark":        "muted",
+		"bot_disabled_mark":     "disabled",
+		"bot_mute_usage":        "Usage: /mute <trigger id or name> <duration>, e.g. /mute cpu 1h",
+		"bot_unmute_usage":      "Usage: /unmute <trigger id or name>",
+		"bot_trigger_not_found": "Trigger %s is not found in subscriptions of this chat.",
+		"bot_muted":             "Trigger %s is muted for %s.",
+		"bot_unmuted":           "Trigger %s is unmuted.",
+		"bot_no_subscriptions":  "No subscriptions deliver to this chat.",
+		"bot_test":              "Test notification is scheduled.",
+	},
+	"ru": {
+		"transition":            "из %s в %s",
+		"more":                  "...и ещё событий: %d.",
+		"throttled":             "Пожалуйста, исправьте систему или настройте триггер, чтобы он генерировал меньше событий.",
+		"throttled_markdown":    "Пожалуйста, *исправьте систему или настройте триггер*, чтобы он генерировал меньше событий.",
+		"throttled_html":        "Пожалуйста, <b>исправьте систему или настройте триггер</b>, чтобы он генерировал меньше событий.",
+		"voice":                 "Здравствуйте! Это уведомление о триггере Moira %s. Подробности смотрите в веб-интерфейсе Moira.",
+		"voice_call":            "Здравствуйте! Это Moira. Триггер %s в состоянии %s.",
+		"voice_metric":          "%s равно %s.",
+		"voice_more":            "И ещё метрик: %d.",
+		"voice_ack_prompt":      "Нажмите %s, чтобы подтвердить.",
+		"voice_acknowledged":    "Подтверждено. Уведомления приостановлены до возвращения триггера в OK. До свидания.",
+		"voice_ack_failed":      "Извините, подтвердить не удалось. Воспользуйтесь веб-интерфейсом Moira.",
+		"voice_no_input":        "Клавиша не нажата. До свидания.",
+		"events":                "События",
+		"chart":                 "График значений событий",
+		"description":           "Описание",
+		"timestamp":             "Время",
+		"target":                "Метрика",
+		"value":                 "Значение",
+		"warn":                  "Warn",
+		"error":                 "Error",
+		"from":                  "Было",
+		"to":                    "Стало",
+		"note":                  "Примечание",
+		"acknowledge":           "Подтвердить",
+		"snooze":                "Отложить на 1 ч",
+		"open_trigger":          "Открыть триггер",
+		"acknowledged_by":       "Подтверждено пользователем %s, уведомления приостановлены до возврата триггера в OK.",
+		"snoozed_by":            "Отложено на 1 час пользователем %s.",
+		"bot_start":             "Хорошо, %s, ваш код привязки %s. Введите его в Moira как значение контакта Telegram в течение часа.",
+		"bot_group":             "Всем привет!\nЯ буду присылать уведомления в эту группу (%s).",
+		"bot_help":              "Команды:\n/status - сработавшие триггеры\n/mute <триггер> <длительность> - отключить уведомления триггера, например /mute cpu 1h\n/unmute <триггер> - включить уведомления триггера\n/subs - подписки\n/test - отправить тестовое уведомление",
+		"bot_error":             "Что-то пошло не так, попробуйте позже.",
+		"bot_no_contacts":       "Этот чат не используется контактами Moira.",
+		"bot_all_ok":            "Все триггеры в состоянии OK.",
+		"bot_muted_mark":        "отключён",
+		"bot_disabled_mark":     "отключена",
+		"bot_mute_usage":        "Использование: /mute <id или имя триггера> <длительность>, например /mute cpu 1h",
+		"bot_unmute_usage":      "Использование: /unmute <id или имя триггера>",
+		"bot_trigger_not_found": "Триггер %s не найден в подписках этого чата.",
+		"bot_muted":             "Уведомления триггера %s отключены на %s.",
+		"bot_unmuted":           "Уведомления триггера %s включены.",
+		"bot_no_subscriptions":  "В этот чат не доставляется ни одна подписка.",
+		"bot_test":              "Тестовое уведомление запланировано.",
+	},
+}
+
+// IsLanguageSupported checks if message catalog of given language exists
+func IsLanguageSupported(language string) bool {
+	_, ok := catalogs[language]
+	return ok
+}
+
+// Translate returns catalog text with given key formatted with args.
+// Texts missing in catalog of given language are taken from default language catalog
+func Translate(language string, key string, args ...interface{}) string {
+	text, ok := catalogs[language][key]
+	if !ok {
+		if text, ok = catalogs[DefaultLanguage][key]; !ok {
+			return key
+		}
+	}
+	if len(args) == 0 {
+		return text
+	}
+	return fmt.Sprintf(text, args...)
+}
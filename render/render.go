@@ -0,0 +1,155 @@
+package render
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/moira-alert/notifier"
+)
+
+// DefaultDateFormat is used when contact has no date format
+const DefaultDateFormat = "02.01.2006"
+
+const timeFormat = "15:04 MST"
+
+var emojiStates = map[string]string{
+	"OK":     "\xe2\x9c\x85",
+	"WARN":   "\xe2\x9a\xa0",
+	"ERROR":  "\xe2\xad\x95",
+	"NODATA": "\xf0\x9f\x92\xa3",
+	"TEST":   "\xf0\x9f\x98\x8a",
+}
+
+var funcs = template.FuncMap{
+	"value": func(value float64) string {
+		return strconv.FormatFloat(value, 'f', -1, 64)
+	},
+	"emoji": func(state string) string {
+		return emojiStates[state]
+	},
+	"sub": func(a, b int) int {
+		return a - b
+	},
+}
+
+// Renderer executes named templates of sender type in selected language, timezone and date format
+type Renderer struct {
+	senderType string
+	language   string
+	location   *time.Location
+	dateFormat string
+	tpl        *template.Template
+}
+
+// Default returns renderer with built-in templates of given sender type
+func Default(senderType string) *Renderer {
+	renderer, err := New(senderType, "", DefaultLanguage)
+	if err != nil {
+		panic(err)
+	}
+	return renderer
+}
+
+// New returns renderer with built-in templates of given sender type redefined by templates from templatesDir.
+// Templates from common.tmpl are applied to all sender types, then templates from <sender type>.tmpl
+// (spaces in sender type replaced by underscores). Missing files are skipped.
+// Language is used unless contact language is supported, empty language means default one
+func New(senderType string, templatesDir string, language string) (*Renderer, error) {
+	if language == "" {
+		language = DefaultLanguage
+	}
+	if !IsLanguageSupported(language) {
+		return nil, fmt.Errorf("Unsupported language: %s", language)
+	}
+	renderer := &Renderer{
+		senderType: senderType,
+		language:   language,
+		location:   time.Local,
+		dateFormat: DefaultDateFormat,
+	}
+	var err error
+	tpl := template.New(senderType).Funcs(funcs).Funcs(renderer.funcs())
+	for _, text := range []string{commonTemplates, senderTemplates[senderType]} {
+		if tpl, err = tpl.Parse(text); err != nil {
+			return nil, fmt.Errorf("Failed to parse built-in %s templates: %s", senderType, err.Error())
+		}
+	}
+	if templatesDir != "" {
+		for _, name := range []string{"common", strings.Replace(senderType, " ", "_", -1)} {
+			fileName := filepath.Join(templatesDir, fmt.Sprintf("%s.tmpl", name))
+			if _, err := os.Stat(fileName); os.IsNotExist(err) {
+				continue
+			}
+			if tpl, err = tpl.ParseFiles(fileName); err != nil {
+				return nil, fmt.Errorf("Failed to parse templates file %s: %s", fileName, err.Error())
+			}
+		}
+	}
+	renderer.tpl = tpl
+	return renderer, nil
+}
+
+// Contact returns renderer for contact language, timezone and date format.
+// Unsupported or empty contact preferences are replaced by renderer ones
+func (renderer *Renderer) Contact(contact notifier.ContactData) *Renderer {
+	contactRenderer := *renderer
+	if contact.Language != "" && IsLanguageSupported(contact.Language) {
+		contactRenderer.language = contact.Language
+	}
+	if contact.Timezone != "" {
+		if location, err := time.LoadLocation(contact.Timezone); err == nil {
+			contactRenderer.location = location
+		}
+	}
+	if contact.DateFormat != "" {
+		contactRenderer.dateFormat = contact.DateFormat
+	}
+	return &contactRenderer
+}
+
+// Language returns renderer language
+func (renderer *Renderer) Language() string {
+	return renderer.language
+}
+
+// Translate returns catalog text of renderer language
+func (renderer *Renderer) Translate(key string, args ...interface{}) string {
+	return Translate(renderer.language, key, args...)
+}
+
+// FormatTime returns event time in renderer timezone
+func (renderer *Renderer) FormatTime(timestamp int64) string {
+	return time.Unix(timestamp, 0).In(renderer.location).Format(timeFormat)
+}
+
+// FormatDateTime returns event time and date in renderer timezone and date format
+func (renderer *Renderer) FormatDateTime(timestamp int64) string {
+	return time.Unix(timestamp, 0).In(renderer.location).Format(fmt.Sprintf("%s %s", timeFormat, renderer.dateFormat))
+}
+
+func (renderer *Renderer) funcs() template.FuncMap {
+	return template.FuncMap{
+		"tr":       renderer.Translate,
+		"time":     renderer.FormatTime,
+		"datetime": renderer.FormatDateTime,
+	}
+}
+
+// Render executes template with given name
+func (renderer *Renderer) Render(name string, data interface{}) (string, error) {
+	tpl, err := renderer.tpl.Clone()
+	if err != nil {
+		return "", err
+	}
+	var buffer bytes.Buffer
+	if err := tpl.Funcs(renderer.funcs()).ExecuteTemplate(&buffer, name, data); err != nil {
+		return "", fmt.Errorf("Failed to render %s template %s: %s", renderer.senderType, name, err.Error())
+	}
+	return buffer.String(), nil
+}
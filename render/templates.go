@@ -0,0 +1,52 @@
+package render
+
+// commonTemplates are defined for every sender type and can be used or redefined by sender templates
+const commonTemplates = `
+{{define "subject"}}{{.State}} {{.Trigger.Name}} {{.Tags}} ({{len .Events}}){{end}}
+{{define "event"}}{{time .Timestamp}}: {{.Metric}} = {{value .Value}} ({{tr "transition" .OldState .State}}){{if .Message}}. {{.Message}}{{end}}{{end}}
+{{define "more"}}{{tr "more" .}}{{end}}
+{{define "throttled"}}{{tr "throttled"}}{{end}}
+{{define "summary"}}{{range $i, $state := .States}}{{if $i}}, {{end}}{{$state.State}}: {{$state.Count}}{{end}}{{end}}
+`
+
+// senderTemplates are default templates of built-in senders
+var senderTemplates = map[string]string{
+	"slack": `
+{{define "throttled"}}{{tr "throttled_markdown"}}{{end}}
+{{define "header"}}*{{.State}}* {{.Tags}} <{{.Link}}|{{.Trigger.Name}}>{{end}}
+{{define "description"}}{{.Trigger.Desc}}{{end}}
+`,
+	"telegram": `
+{{define "header"}}{{emoji .State}}<b>{{.State}}</b> {{if .Link}}<a href="{{html .Link}}">{{html .Trigger.Name}}</a>{{else}}{{html .Trigger.Name}}{{end}} {{html .Tags}} ({{len .Events}}){{end}}
+{{define "event"}}<code>{{time .Timestamp}}: {{html .Metric}} = {{value .Value}} ({{tr "transition" .OldState .State}})</code>{{if .Message}}. {{html .Message}}{{end}}{{end}}
+{{define "throttled"}}{{tr "throttled_html"}}{{end}}
+{{define "footer"}}{{end}}
+`,
+	"pushover": `
+{{define "message"}}{{range $i, $event := .Events}}{{if lt $i 5}}{{template "event" $event}}
+{{end}}{{end}}{{if gt (len .Events) 5}}
+{{template "more" (sub (len .Events) 5)}}{{end}}{{if .Throttled}}
+{{template "throttled" .}}{{end}}{{end}}
+`,
+	"twilio sms": `
+{{define "event"}}{{.Metric}} = {{value .Value}} ({{.State}}){{end}}
+`,
+	"mail": `
+{{define "event"}}{{datetime .Timestamp}}: {{.Metric}} = {{value .Value}} ({{tr "transition" .OldState .State}}){{if .Message}}. {{.Message}}{{end}}{{end}}
+{{define "text"}}{{template "subject" .}}
+{{template "summary" .}}
+{{range .Events}}
+{{template "event" .}}{{end}}
+
+{{tr "warn"}}: {{value .Trigger.WarnValue}}, {{tr "error"}}: {{value .Trigger.ErrorValue}}{{if .Trigger.Desc}}
+{{tr "description"}}: {{.Trigger.Desc}}{{end}}
+{{.Link}}{{if .Throttled}}
+
+{{template "throttled" .}}{{end}}
+{{end}}
+`,
+	"twilio voice": `
+{{define "voice"}}{{tr "voice" .Trigger.Name}}{{end}}
+{{define "speech"}}{{tr "voice_call" .Trigger.Name .State}}{{range .TopEvents}} {{tr "voice_metric" .Metric (value .Value)}}{{end}}{{if gt (len .Events) (len .TopEvents)}} {{tr "voice_more" (sub (len .Events) (len .TopEvents))}}{{end}}{{end}}
+`,
+}
@@ -0,0 +1,53 @@
+package render
+
+import (
+	"fmt"
+
+	"github.com/moira-alert/notifier"
+)
+
+// StateCount represents number of package events with state
+type StateCount struct {
+	State string
+	Count int
+}
+
+// View represents notification package data available in templates
+type View struct {
+	Events    notifier.EventsData
+	Trigger   notifier.TriggerData
+	Contact   notifier.ContactData
+	Throttled bool
+	State     string
+	States    []StateCount
+	Tags      string
+	Link      string
+	FrontURI  string
+}
+
+// NewView collects notification package data for templates
+func NewView(events notifier.EventsData, contact notifier.ContactData, trigger notifier.TriggerData, throttled bool, frontURI string) *View {
+	view := &View{
+		Events:    events,
+		Trigger:   trigger,
+		Contact:   contact,
+		Throttled: throttled,
+		State:     events.GetSubjectState(),
+		Tags:      trigger.GetTags(),
+		FrontURI:  frontURI,
+	}
+	counts := make(map[string]int)
+	for _, event := range events {
+		if counts[event.State] == 0 {
+			view.States = append(view.States, StateCount{State: event.State})
+		}
+		counts[event.State]++
+	}
+	for i := range view.States {
+		view.States[i].Count = counts[view.States[i].State]
+	}
+	if len(events) > 0 {
+		view.Link = fmt.Sprintf("%s/#/events/%s", frontURI, events[0].TriggerID)
+	}
+	return view
+}
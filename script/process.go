@@ -0,0 +1,18 @@
+// +build !windows
+
+package script
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// setProcessGroup starts script in its own process group, so processes started by script can be killed with it
+func setProcessGroup(c *exec.Cmd) {
+	c.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// killProcessGroup kills script and processes started by it
+func killProcessGroup(c *exec.Cmd) {
+	syscall.Kill(-c.Process.Pid, syscall.SIGKILL)
+}
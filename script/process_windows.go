@@ -0,0 +1,13 @@
+package script
+
+import (
+	"os/exec"
+)
+
+func setProcessGroup(c *exec.Cmd) {
+}
+
+// killProcessGroup kills script, processes started by it keep running
+func killProcessGroup(c *exec.Cmd) {
+	c.Process.Kill()
+}
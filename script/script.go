@@ -2,6 +2,7 @@ package script
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"os"
@@ -46,7 +47,7 @@ func (sender *Sender) Init(senderSettings map[string]string, logger notifier.Log
 }
 
 //SendEvents implements Sender interface Send
-func (sender *Sender) SendEvents(events notifier.EventsData, contact notifier.ContactData, trigger notifier.TriggerData, throttled bool) error {
+func (sender *Sender) SendEvents(ctx context.Context, events notifier.EventsData, contact notifier.ContactData, trigger notifier.TriggerData, throttled bool) error {
 
 	execString := strings.Replace(sender.Exec, "${trigger_name}", trigger.Name, -1)
 	execString = strings.Replace(execString, "${contact_value}", contact.Value, -1)
@@ -72,14 +73,30 @@ func (sender *Sender) SendEvents(events notifier.EventsData, contact notifier.Co
 		return fmt.Errorf("Failed marshal json")
 	}
 
-	c := exec.Command(scriptFile, args[1:]...)
+	c := exec.CommandContext(ctx, scriptFile, args[1:]...)
+	setProcessGroup(c)
 	var scriptOutput bytes.Buffer
 	c.Stdin = bytes.NewReader(scriptJSON)
 	c.Stdout = &scriptOutput
 	log.Debugf("Executing script: %s", scriptFile)
-	err = c.Run()
+	if err = c.Start(); err == nil {
+		// processes started by killed script keep its output open, so they are killed too
+		finished := make(chan bool)
+		go func() {
+			select {
+			case <-ctx.Done():
+				killProcessGroup(c)
+			case <-finished:
+			}
+		}()
+		err = c.Wait()
+		close(finished)
+	}
 	log.Debugf("Finished executing: %s", scriptFile)
 
+	if ctx.Err() != nil {
+		return fmt.Errorf("Script [%s] killed: %s. Output: [%s]", sender.Exec, ctx.Err().Error(), scriptOutput.String())
+	}
 	if err != nil {
 		return fmt.Errorf("Failed exec [%s] Error [%s] Output: [%s]", sender.Exec, err.Error(), scriptOutput.String())
 	}
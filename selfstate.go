@@ -11,14 +11,15 @@ var SelfCheckInterval = time.Second * 10
 
 // CheckSelfStateMonitorSettings - validate contact types
 func CheckSelfStateMonitorSettings() error {
-	if !ToBool(config.Notifier.SelfState.Enabled) {
+	selfState := getSettings().Notifier.SelfState
+	if !ToBool(selfState.Enabled) {
 		return nil
 	}
-	if len(config.Notifier.SelfState.Contacts) < 1 {
+	if len(selfState.Contacts) < 1 {
 		return fmt.Errorf("contacts must be specified")
 	}
-	for _, adminContact := range config.Notifier.SelfState.Contacts {
-		if _, ok := sending[adminContact["type"]]; !ok {
+	for _, adminContact := range selfState.Contacts {
+		if _, ok := getSenderChannel(adminContact["type"]); !ok {
 			return fmt.Errorf("Unknown contact type [%s]", adminContact["type"])
 		}
 		if adminContact["value"] == "" {
@@ -28,7 +29,8 @@ func CheckSelfStateMonitorSettings() error {
 	return nil
 }
 
-// SelfStateMonitor - send message when moira don't work
+// SelfStateMonitor - send message when moira don't work.
+// Settings are read on every check, so monitor can be tuned by configuration reload
 func SelfStateMonitor(shutdown chan bool, wg *sync.WaitGroup) {
 	defer wg.Done()
 
@@ -47,6 +49,7 @@ func SelfStateMonitor(shutdown chan bool, wg *sync.WaitGroup) {
 			log.Debugf("Stop Self State Monitor")
 			return
 		case <-checkTicker.C:
+			selfState := getSettings().Notifier.SelfState
 			nowTS := GetNow().Unix()
 			mc, _ := db.GetMetricsCount()
 			cc, err := db.GetChecksCount()
@@ -62,30 +65,35 @@ func SelfStateMonitor(shutdown chan bool, wg *sync.WaitGroup) {
 				}
 			}
 			if nextSendErrorMessage < nowTS {
-				if redisLastCheckTS < nowTS-config.Notifier.SelfState.RedisDisconectDelay {
+				if redisLastCheckTS < nowTS-selfState.RedisDisconectDelay {
 					log.Errorf("Redis disconnected more %ds. Send message.", nowTS-redisLastCheckTS)
-					sendErrorMessages("Redis disconnected", nowTS-redisLastCheckTS, config.Notifier.SelfState.RedisDisconectDelay)
-					nextSendErrorMessage = nowTS + config.Notifier.SelfState.NoticeInterval
+					sendErrorMessages(selfState.Contacts, "Redis disconnected", nowTS-redisLastCheckTS, selfState.RedisDisconectDelay)
+					nextSendErrorMessage = nowTS + selfState.NoticeInterval
 					continue
 				}
-				if lastMetricReceivedTS < nowTS-config.Notifier.SelfState.LastMetricReceivedDelay && err == nil {
+				if lastMetricReceivedTS < nowTS-selfState.LastMetricReceivedDelay && err == nil {
 					log.Errorf("Moira-Cache does not received new metrics more %ds. Send message.", nowTS-lastMetricReceivedTS)
-					sendErrorMessages("Moira-Cache does not received new metrics", nowTS-lastMetricReceivedTS, config.Notifier.SelfState.LastMetricReceivedDelay)
-					nextSendErrorMessage = nowTS + config.Notifier.SelfState.NoticeInterval
+					sendErrorMessages(selfState.Contacts, "Moira-Cache does not received new metrics", nowTS-lastMetricReceivedTS, selfState.LastMetricReceivedDelay)
+					nextSendErrorMessage = nowTS + selfState.NoticeInterval
 					continue
 				}
-				if lastCheckTS < nowTS-config.Notifier.SelfState.LastCheckDelay && err == nil {
+				if lastCheckTS < nowTS-selfState.LastCheckDelay && err == nil {
 					log.Errorf("Moira-Checker does not checks triggers more %ds. Send message.", nowTS-lastCheckTS)
-					sendErrorMessages("Moira-Checker does not checks triggers", nowTS-lastCheckTS, config.Notifier.SelfState.LastCheckDelay)
-					nextSendErrorMessage = nowTS + config.Notifier.SelfState.NoticeInterval
+					sendErrorMessages(selfState.Contacts, "Moira-Checker does not checks triggers", nowTS-lastCheckTS, selfState.LastCheckDelay)
+					nextSendErrorMessage = nowTS + selfState.NoticeInterval
 				}
 			}
 		}
 	}
 }
-func sendErrorMessages(message string, curentValue int64, errValue int64) {
-	for _, adminContact := range config.Notifier.SelfState.Contacts {
-		sending[adminContact["type"]] <- notificationPackage{
+func sendErrorMessages(contacts []map[string]string, message string, curentValue int64, errValue int64) {
+	for _, adminContact := range contacts {
+		ch, found := getSenderChannel(adminContact["type"])
+		if !found {
+			log.Errorf("Can not send self state message to unknown contact type [%s]", adminContact["type"])
+			continue
+		}
+		pkg := notificationPackage{
 			Contact: ContactData{
 				Type:  adminContact["type"],
 				Value: adminContact["value"],
@@ -104,5 +112,10 @@ func sendErrorMessages(message string, curentValue int64, errValue int64) {
 			},
 			DontResend: true,
 		}
+		select {
+		case ch <- pkg:
+		case <-time.After(getSenderTimeout()):
+			log.Errorf("Timeout sending self state message to %s", pkg.Contact.Value)
+		}
 	}
 }
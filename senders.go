@@ -1,56 +1,274 @@
 package notifier
 
 import (
+	"context"
 	"fmt"
+	"io"
+	"reflect"
 	"strings"
+	"time"
 
+	"github.com/gosexy/to"
 	"github.com/rcrowley/go-metrics"
 )
 
-func run(sender Sender, ch chan notificationPackage) {
+// senderWorker represents running sender goroutine
+type senderWorker struct {
+	sender   Sender
+	settings map[string]string
+	quit     chan bool
+	stopped  chan bool
+}
+
+func run(sender Sender, ch chan notificationPackage, worker *senderWorker, timeout time.Duration) {
 	defer wg.Done()
-	for pkg := range ch {
-		err := sender.SendEvents(pkg.Events, pkg.Contact, pkg.Trigger, pkg.Throttled)
-		if err == nil {
-			sendersOkMetrics[pkg.Contact.Type].Mark(1)
-		} else if !pkg.DontResend {
-			pkg.resend(err.Error())
+	defer close(worker.stopped)
+	defer closeSender(sender, worker)
+	for {
+		select {
+		case <-worker.quit:
+			return
+		case pkg := <-ch:
+			send(sender, pkg, timeout)
 		}
 	}
 }
 
-// StopSenders close all sending channels
-func StopSenders() {
-	for _, ch := range sending {
-		close(ch)
+// closeSender releases resources of stopped sender implementing io.Closer
+func closeSender(sender Sender, worker *senderWorker) {
+	closer, ok := sender.(io.Closer)
+	if !ok {
+		return
+	}
+	if err := closer.Close(); err != nil {
+		log.Warningf("Failed to close sender %s: %s", getSenderIdent(worker.settings), err.Error())
+	}
+}
+
+func send(sender Sender, pkg notificationPackage, timeout time.Duration) {
+	if timeout == 0 {
+		timeout = getDeliveryTimeout()
+	}
+	timedOut, err := deliver(sender, pkg, timeout)
+	if err == nil {
+		markSenderMeter(sendersOkMetrics, pkg.Contact.Type)
+		return
+	}
+	if timedOut {
+		sendingTimedOut.Mark(1)
+		markSenderMeter(sendersTimeoutMetrics, pkg.Contact.Type)
+		err = fmt.Errorf("Delivery timeout %s exceeded for %s: %s", timeout, &pkg, err.Error())
+	}
+	if _, unreachable := err.(*UnreachableContactError); unreachable {
+		sendingFailed.Mark(1)
+		markSenderMeter(sendersFailedMetrics, pkg.Contact.Type)
+		log.Warningf("Can't send %s: %s", &pkg, err.Error())
+		return
+	}
+	if !pkg.DontResend {
+		pkg.resend(err.Error())
+	}
+}
+
+// deliver calls sender with given deadline and reports whether deadline was exceeded.
+// Senders stop network calls when deadline is exceeded
+func deliver(sender Sender, pkg notificationPackage, timeout time.Duration) (bool, error) {
+	ctx, cancel := newDeliveryContext(timeout)
+	defer cancel()
+	err := sender.SendEvents(ctx, pkg.Events, pkg.Contact, pkg.Trigger, pkg.Throttled)
+	return err != nil && ctx.Err() == context.DeadlineExceeded, err
+}
+
+// newDeliveryContext returns context with deadline for single SendEvents call, zero timeout means no deadline
+func newDeliveryContext(timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(context.Background())
 	}
+	return context.WithTimeout(context.Background(), timeout)
+}
+
+// StopSenders stops all senders and waits until they finish current sending
+func StopSenders() {
+	sendingLock.Lock()
+	workers := senderWorkers
 	sending = make(map[string]chan notificationPackage)
+	senderWorkers = make(map[string]*senderWorker)
+	sendingLock.Unlock()
+	for _, worker := range workers {
+		close(worker.quit)
+	}
 	log.Debug("Waiting senders finish ...")
 	wg.Wait()
 }
 
-// RegisterSender adds sender for notification type and registers metrics
+// RegisterSender adds sender for notification type and registers metrics.
+// Sender already registered for the same type is stopped after it finishes current sending
+// before the new one is initialized, notifications waiting for the old one are handed over to the new one
 func RegisterSender(senderSettings map[string]string, sender Sender) error {
-	var senderIdent string
-	if senderSettings["type"] == "script" {
-		senderIdent = senderSettings["name"]
-	} else {
-		senderIdent = senderSettings["type"]
+	senderIdent := getSenderIdent(senderSettings)
+	var timeout time.Duration
+	if senderSettings["delivery_timeout"] != "" {
+		timeout = to.Duration(senderSettings["delivery_timeout"])
 	}
+	ch, reloaded := stopSenderWorker(senderIdent)
 	err := sender.Init(senderSettings, log)
 	if err != nil {
+		if reloaded {
+			sendingLock.Lock()
+			delete(sending, senderIdent)
+			sendingLock.Unlock()
+		}
 		return fmt.Errorf("Don't initialize sender [%s], err [%s]", senderIdent, err.Error())
 	}
-	ch := make(chan notificationPackage)
+	if !reloaded {
+		ch = make(chan notificationPackage)
+	}
+	worker := &senderWorker{
+		sender:   sender,
+		settings: make(map[string]string, len(senderSettings)),
+		quit:     make(chan bool),
+		stopped:  make(chan bool),
+	}
+	for key, value := range senderSettings {
+		worker.settings[key] = value
+	}
+
+	sendingLock.Lock()
 	sending[senderIdent] = ch
-	sendersOkMetrics[senderIdent] = metrics.NewRegisteredMeter(fmt.Sprintf("%s.sends_ok", getGraphiteSenderIdent(senderIdent)), metrics.DefaultRegistry)
-	sendersFailedMetrics[senderIdent] = metrics.NewRegisteredMeter(fmt.Sprintf("%s.sends_failed", getGraphiteSenderIdent(senderIdent)), metrics.DefaultRegistry)
+	senderWorkers[senderIdent] = worker
+	sendersOkMetrics[senderIdent] = metrics.GetOrRegisterMeter(fmt.Sprintf("%s.sends_ok", getGraphiteSenderIdent(senderIdent)), metrics.DefaultRegistry)
+	sendersFailedMetrics[senderIdent] = metrics.GetOrRegisterMeter(fmt.Sprintf("%s.sends_failed", getGraphiteSenderIdent(senderIdent)), metrics.DefaultRegistry)
+	sendersTimeoutMetrics[senderIdent] = metrics.GetOrRegisterMeter(fmt.Sprintf("%s.sends_timeout", getGraphiteSenderIdent(senderIdent)), metrics.DefaultRegistry)
+	sendingLock.Unlock()
+
 	wg.Add(1)
-	go run(sender, ch)
+	go run(sender, ch, worker, timeout)
+	if reloaded {
+		log.Infof("Sender %s reloaded", senderIdent)
+		return nil
+	}
 	log.Debugf("Sender %s registered", senderIdent)
 	return nil
 }
 
+// stopSenderWorker stops running sender and returns its channel, which is still registered
+// so notifications keep waiting for sender replacing the stopped one
+func stopSenderWorker(senderIdent string) (chan notificationPackage, bool) {
+	sendingLock.Lock()
+	worker, found := senderWorkers[senderIdent]
+	ch := sending[senderIdent]
+	delete(senderWorkers, senderIdent)
+	sendingLock.Unlock()
+	if !found {
+		return nil, false
+	}
+	log.Debugf("Waiting previous sender %s finish ...", senderIdent)
+	close(worker.quit)
+	<-worker.stopped
+	return ch, true
+}
+
+// ReloadSenders registers senders with changed settings and stops senders missing in given settings.
+// Senders with unchanged settings keep running, sender failed to initialize is registered again with previous settings
+func ReloadSenders(sendersSettings []map[string]string, newSender func(senderSettings map[string]string) (Sender, error)) error {
+	failed := 0
+	actual := make(map[string]bool)
+	for _, senderSettings := range sendersSettings {
+		senderIdent := getSenderIdent(senderSettings)
+		actual[senderIdent] = true
+		sendingLock.RLock()
+		worker, found := senderWorkers[senderIdent]
+		sendingLock.RUnlock()
+		if found && reflect.DeepEqual(worker.settings, senderSettings) {
+			continue
+		}
+		sender, err := newSender(senderSettings)
+		if err != nil {
+			log.Errorf("Can not reload sender %s: %s", senderIdent, err.Error())
+			failed++
+			continue
+		}
+		if err := RegisterSender(senderSettings, sender); err != nil {
+			log.Errorf("Can not reload sender %s: %s", senderIdent, err.Error())
+			failed++
+			if found {
+				restoreSender(worker.settings, newSender)
+			}
+		}
+	}
+
+	sendingLock.Lock()
+	removed := make(map[string]*senderWorker)
+	for senderIdent, worker := range senderWorkers {
+		if !actual[senderIdent] {
+			removed[senderIdent] = worker
+			delete(sending, senderIdent)
+			delete(senderWorkers, senderIdent)
+		}
+	}
+	sendingLock.Unlock()
+	for senderIdent, worker := range removed {
+		close(worker.quit)
+		<-worker.stopped
+		log.Infof("Sender %s stopped", senderIdent)
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d senders failed to reload", failed)
+	}
+	return nil
+}
+
+// restoreSender registers new instance of sender with previous settings after it failed to reload
+func restoreSender(senderSettings map[string]string, newSender func(senderSettings map[string]string) (Sender, error)) {
+	senderIdent := getSenderIdent(senderSettings)
+	sender, err := newSender(senderSettings)
+	if err == nil {
+		err = RegisterSender(senderSettings, sender)
+	}
+	if err != nil {
+		log.Errorf("Can not restore sender %s: %s", senderIdent, err.Error())
+		return
+	}
+	log.Warningf("Sender %s restored with previous settings", senderIdent)
+}
+
+func getSenderChannel(contactType string) (chan notificationPackage, bool) {
+	sendingLock.RLock()
+	defer sendingLock.RUnlock()
+	ch, found := sending[contactType]
+	return ch, found
+}
+
+// validateContact checks contact by sender of contact type if sender implements ContactValidator
+func validateContact(contact ContactData) error {
+	sendingLock.RLock()
+	worker, found := senderWorkers[contact.Type]
+	sendingLock.RUnlock()
+	if !found {
+		return nil
+	}
+	if validator, ok := worker.sender.(ContactValidator); ok {
+		return validator.ValidateContact(contact)
+	}
+	return nil
+}
+
+func markSenderMeter(meters map[string]metrics.Meter, contactType string) {
+	sendingLock.RLock()
+	defer sendingLock.RUnlock()
+	if meter, found := meters[contactType]; found {
+		meter.Mark(1)
+	}
+}
+
+func getSenderIdent(senderSettings map[string]string) string {
+	if senderSettings["type"] == "script" {
+		return senderSettings["name"]
+	}
+	return senderSettings["type"]
+}
+
 func getGraphiteSenderIdent(ident string) string {
 	return strings.Replace(ident, " ", "_", -1)
 }
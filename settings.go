@@ -13,6 +13,10 @@ type NotifierConfig struct {
 	LogColor         string              `yaml:"log_color"`
 	SenderTimeout    string              `yaml:"sender_timeout"`
 	ResendingTimeout string              `yaml:"resending_timeout"`
+	DeliveryTimeout  string              `yaml:"delivery_timeout"`
+	TemplatesDir     string              `yaml:"templates_dir"`
+	Language         string              `yaml:"language"`
+	HTTPListen       string              `yaml:"http_listen"`
 	Senders          []map[string]string `yaml:"senders"`
 	SelfState        SelfStateConfig     `yaml:"moira_selfstate"`
 }
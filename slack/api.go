@@ -0,0 +1,168 @@
+package slack
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// DefaultAPIURL is Slack Web API base url
+const DefaultAPIURL = "https://slack.com/api/"
+
+// message represents chat.postMessage and chat.update request
+type message struct {
+	Channel        string       `json:"channel,omitempty"`
+	TS             string       `json:"ts,omitempty"`
+	Text           string       `json:"text"`
+	Username       string       `json:"username,omitempty"`
+	IconURL        string       `json:"icon_url,omitempty"`
+	ThreadTS       string       `json:"thread_ts,omitempty"`
+	ReplyBroadcast bool         `json:"reply_broadcast,omitempty"`
+	LinkNames      bool         `json:"link_names,omitempty"`
+	Attachments    []attachment `json:"attachments"`
+}
+
+// attachment is shown with colored sidebar
+type attachment struct {
+	Color    string  `json:"color"`
+	Fallback string  `json:"fallback,omitempty"`
+	Blocks   []block `json:"blocks"`
+}
+
+// block represents Block Kit layout block
+type block struct {
+	Type     string        `json:"type"`
+	BlockID  string        `json:"block_id,omitempty"`
+	Text     *text         `json:"text,omitempty"`
+	Elements []interface{} `json:"elements,omitempty"`
+}
+
+type text struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+// button represents Block Kit button element
+type button struct {
+	Type     string `json:"type"`
+	Text     *text  `json:"text"`
+	ActionID string `json:"action_id"`
+	Value    string `json:"value,omitempty"`
+	URL      string `json:"url,omitempty"`
+	Style    string `json:"style,omitempty"`
+}
+
+// apiResponse represents Slack Web API response
+type apiResponse struct {
+	OK      bool   `json:"ok"`
+	Error   string `json:"error"`
+	Channel string `json:"channel"`
+	TS      string `json:"ts"`
+}
+
+// interactionResponse is posted to response_url of interaction payload
+type interactionResponse struct {
+	ResponseType    string `json:"response_type"`
+	ReplaceOriginal bool   `json:"replace_original"`
+	Text            string `json:"text"`
+}
+
+// apiClient calls Slack Web API methods
+type apiClient struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+func newAPIClient(url, token string) *apiClient {
+	if url == "" {
+		url = DefaultAPIURL
+	}
+	if !strings.HasSuffix(url, "/") {
+		url += "/"
+	}
+	return &apiClient{url: url, token: token, client: &http.Client{}}
+}
+
+// call posts JSON request to API method and returns error if Slack responded with ok=false
+func (api *apiClient) call(ctx context.Context, method string, request interface{}) (*apiResponse, error) {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+	httpRequest, err := http.NewRequest("POST", api.url+method, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	httpRequest.Header.Set("Content-Type", "application/json; charset=utf-8")
+	httpRequest.Header.Set("Authorization", "Bearer "+api.token)
+	httpResponse, err := api.client.Do(httpRequest.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer httpResponse.Body.Close()
+	if httpResponse.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s responded with status %s", method, httpResponse.Status)
+	}
+	response := &apiResponse{}
+	if err := json.NewDecoder(httpResponse.Body).Decode(response); err != nil {
+		return nil, fmt.Errorf("Failed to decode %s response: %s", method, err.Error())
+	}
+	if !response.OK {
+		return response, fmt.Errorf("%s failed: %s", method, response.Error)
+	}
+	return response, nil
+}
+
+// postMessage posts message to channel and returns channel id and message timestamp
+func (api *apiClient) postMessage(ctx context.Context, msg *message) (*apiResponse, error) {
+	return api.call(ctx, "chat.postMessage", msg)
+}
+
+// updateMessage replaces message with given channel id and timestamp
+func (api *apiClient) updateMessage(ctx context.Context, msg *message) (*apiResponse, error) {
+	return api.call(ctx, "chat.update", msg)
+}
+
+// respond posts message to response_url of interaction payload, response_url requires no token
+func (api *apiClient) respond(ctx context.Context, responseURL string, response *interactionResponse) error {
+	return api.postJSON(ctx, responseURL, response)
+}
+
+// postWebhook posts message to incoming webhook, webhook responds with plain text and gives no message timestamp
+func (api *apiClient) postWebhook(ctx context.Context, webhookURL string, msg *message) error {
+	return api.postJSON(ctx, webhookURL, msg)
+}
+
+// postJSON posts request to url that requires no token and responds with plain text.
+// Error does not contain url as webhook url is a secret
+func (api *apiClient) postJSON(ctx context.Context, endpoint string, request interface{}) error {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	httpRequest, err := http.NewRequest("POST", endpoint, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("invalid url")
+	}
+	httpRequest.Header.Set("Content-Type", "application/json; charset=utf-8")
+	httpResponse, err := api.client.Do(httpRequest.WithContext(ctx))
+	if err != nil {
+		if urlErr, ok := err.(*url.Error); ok {
+			return urlErr.Err
+		}
+		return err
+	}
+	defer httpResponse.Body.Close()
+	if httpResponse.StatusCode != http.StatusOK {
+		text, _ := ioutil.ReadAll(io.LimitReader(httpResponse.Body, 1024))
+		return fmt.Errorf("responded with status %s: %s", httpResponse.Status, strings.TrimSpace(string(text)))
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+package slack
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/moira-alert/notifier"
+	"github.com/moira-alert/notifier/render"
+)
+
+// DefaultInteractivityPath is served by notifier HTTP server if sender has signing secret,
+// it should be set as interactivity request URL of Slack app
+const DefaultInteractivityPath = "/slack/interactivity"
+
+const (
+	actionAck     = "ack"
+	actionSnooze  = "snooze"
+	actionOpen    = "open_trigger"
+	snoozeTimeout = time.Hour
+	// maxRequestAge protects from replay of intercepted interactivity requests
+	maxRequestAge = 5 * time.Minute
+	// maxRequestSize limits interactivity request body
+	maxRequestSize = 1 << 20
+)
+
+// interactionPayload represents block_actions payload sent by Slack when message button is clicked
+type interactionPayload struct {
+	Type string `json:"type"`
+	User struct {
+		ID       string `json:"id"`
+		Username string `json:"username"`
+	} `json:"user"`
+	ResponseURL string `json:"response_url"`
+	Actions     []struct {
+		ActionID string `json:"action_id"`
+		Value    string `json:"value"`
+	} `json:"actions"`
+}
+
+// makeActions returns buttons to acknowledge or snooze trigger incident and to open trigger in web interface
+func makeActions(renderer *render.Renderer, view *render.View, trigger notifier.TriggerData) block {
+	var buttons []interface{}
+	if view.State != "OK" {
+		buttons = append(buttons,
+			&button{Type: "button", Text: &text{Type: "plain_text", Text: renderer.Translate("acknowledge")}, ActionID: actionAck, Value: trigger.ID, Style: "primary"},
+			&button{Type: "button", Text: &text{Type: "plain_text", Text: renderer.Translate("snooze")}, ActionID: actionSnooze, Value: trigger.ID},
+		)
+	}
+	buttons = append(buttons, &button{
+		Type:     "button",
+		Text:     &text{Type: "plain_text", Text: renderer.Translate("open_trigger")},
+		ActionID: actionOpen,
+		URL:      fmt.Sprintf("%s/#/events/%s", view.FrontURI, trigger.ID),
+	})
+	return block{Type: "actions", Elements: buttons}
+}
+
+// ServeHTTP handles Slack interactivity requests made by message buttons
+func (sender *Sender) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxRequestSize))
+	if err != nil {
+		http.Error(w, "Can not read request", http.StatusBadRequest)
+		return
+	}
+	if err := sender.verifyRequest(r.Header, body, time.Now()); err != nil {
+		log.Warningf("Rejected slack interactivity request: %s", err.Error())
+		http.Error(w, "Invalid signature", http.StatusUnauthorized)
+		return
+	}
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		http.Error(w, "Can not parse request", http.StatusBadRequest)
+		return
+	}
+	var payload interactionPayload
+	if err := json.Unmarshal([]byte(form.Get("payload")), &payload); err != nil {
+		http.Error(w, "Can not parse payload", http.StatusBadRequest)
+		return
+	}
+	if payload.Type != "block_actions" {
+		return
+	}
+	user := payload.User.Username
+	if user == "" {
+		user = payload.User.ID
+	}
+	for _, action := range payload.Actions {
+		var confirmation string
+		switch action.ActionID {
+		case actionAck:
+			if err := sender.DB.AckTrigger(action.Value, user); err != nil {
+				log.Errorf("Failed to acknowledge trigger %s: %s", action.Value, err.Error())
+				http.Error(w, "Can not acknowledge trigger", http.StatusInternalServerError)
+				return
+			}
+			log.Infof("Trigger %s acknowledged by slack user %s", action.Value, user)
+			confirmation = sender.renderer.Translate("acknowledged_by", fmt.Sprintf("<@%s>", payload.User.ID))
+		case actionSnooze:
+			if err := sender.DB.MuteTrigger(action.Value, user, snoozeTimeout); err != nil {
+				log.Errorf("Failed to snooze trigger %s: %s", action.Value, err.Error())
+				http.Error(w, "Can not snooze trigger", http.StatusInternalServerError)
+				return
+			}
+			log.Infof("Trigger %s snoozed by slack user %s", action.Value, user)
+			confirmation = sender.renderer.Translate("snoozed_by", fmt.Sprintf("<@%s>", payload.User.ID))
+		default:
+			continue
+		}
+		if payload.ResponseURL != "" {
+			go sender.respond(payload.ResponseURL, confirmation)
+		}
+	}
+}
+
+// verifyRequest checks request signature made with app signing secret and request age
+func (sender *Sender) verifyRequest(header http.Header, body []byte, now time.Time) error {
+	timestamp := header.Get("X-Slack-Request-Timestamp")
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid timestamp %q", timestamp)
+	}
+	age := now.Sub(time.Unix(seconds, 0))
+	if age > maxRequestAge || age < -maxRequestAge {
+		return fmt.Errorf("request timestamp %s is too old", timestamp)
+	}
+	mac := hmac.New(sha256.New, []byte(sender.SigningSecret))
+	fmt.Fprintf(mac, "v0:%s:", timestamp)
+	mac.Write(body)
+	expected := "v0=" + hex.EncodeToString(mac.Sum(nil))
+	if !hmac.Equal([]byte(expected), []byte(header.Get("X-Slack-Signature"))) {
+		return fmt.Errorf("signature mismatch")
+	}
+	return nil
+}
+
+// respond posts confirmation of button action visible to everyone in channel
+func (sender *Sender) respond(responseURL, confirmation string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	response := &interactionResponse{ResponseType: "in_channel", Text: confirmation}
+	if err := sender.api.respond(ctx, responseURL, response); err != nil {
+		log.Warningf("Failed to post slack interactivity response: %s", err.Error())
+	}
+}
@@ -0,0 +1,46 @@
+package slack
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/moira-alert/notifier"
+)
+
+// mentionSettingPrefix is prefix of contact settings keys with mentions for state, e.g. "mention_ERROR"
+const mentionSettingPrefix = "mention_"
+
+var (
+	userIDPattern      = regexp.MustCompile(`^@[UW][A-Z0-9]{8,}$`)
+	userGroupIDPattern = regexp.MustCompile(`^@S[A-Z0-9]{8,}$`)
+	specialMentions    = map[string]bool{"@here": true, "@channel": true, "@everyone": true}
+)
+
+// mentions returns mentions configured in contact settings for state in Slack message syntax.
+// Mentions are separated by spaces or commas. Mentions by name require Slack to link names
+func mentions(contact notifier.ContactData, state string) (string, bool) {
+	setting := contact.Settings[mentionSettingPrefix+state]
+	if setting == "" {
+		return "", false
+	}
+	var formatted []string
+	linkNames := false
+	for _, mention := range strings.FieldsFunc(setting, func(r rune) bool { return r == ',' || r == ' ' }) {
+		if !strings.HasPrefix(mention, "<") && !strings.HasPrefix(mention, "@") {
+			mention = "@" + mention
+		}
+		switch {
+		case strings.HasPrefix(mention, "<"):
+		case specialMentions[mention]:
+			mention = "<!" + mention[1:] + ">"
+		case userIDPattern.MatchString(mention):
+			mention = "<" + mention + ">"
+		case userGroupIDPattern.MatchString(mention):
+			mention = "<!subteam^" + mention[1:] + ">"
+		default:
+			linkNames = true
+		}
+		formatted = append(formatted, mention)
+	}
+	return strings.Join(formatted, " "), linkNames
+}
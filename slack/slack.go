@@ -2,70 +2,383 @@ package slack
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
+	"net/url"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/moira-alert/notifier"
-
-	"github.com/nlopes/slack"
+	"github.com/moira-alert/notifier/render"
 )
 
+// blockTextLimit is maximum length of Block Kit section text with room left for "more" line
+const blockTextLimit = 2800
+
+// slackWebhookURL is prefix of slack incoming webhooks, contacts can not point notifier to other urls
+// unless they are allowed by webhook_allowed_urls setting
+const slackWebhookURL = "https://hooks.slack.com/"
+
 var log notifier.Logger
 
+var stateColors = map[string]string{
+	"OK":        "#36a64f",
+	"WARN":      "#daa038",
+	"ERROR":     "#d00000",
+	"EXCEPTION": "#d00000",
+	"NODATA":    "#808080",
+	"TEST":      "#439fe0",
+}
+
+// Database stores channel and timestamp of message posted for trigger incident
+// and trigger acknowledgements and mutes made by message buttons.
+// Incident is over when the whole trigger is OK
+type Database interface {
+	GetTriggerIncident(kind, contactID, triggerID string) (string, error)
+	SetTriggerIncident(kind, contactID, triggerID, value string) error
+	RemoveTriggerIncident(kind, contactID, triggerID string) error
+	GetTriggerState(triggerID string) (string, error)
+	AckTrigger(triggerID, user string) error
+	MuteTrigger(triggerID, user string, duration time.Duration) error
+}
+
+// postedMessage identifies message posted for trigger incident and incident state it was posted with.
+// In threads mode it is the thread root message
+type postedMessage struct {
+	Channel string `json:"channel"`
+	TS      string `json:"ts"`
+	State   string `json:"state,omitempty"`
+}
+
 // Sender implements moira sender interface via slack
 type Sender struct {
-	APIToken string
-	FrontURI string
+	DB                Database
+	APIToken          string
+	APIURL            string
+	WebhookURL        string
+	AllowedWebhooks   []*url.URL
+	FrontURI          string
+	Threads           bool
+	BroadcastErrors   bool
+	SigningSecret     string
+	InteractivityPath string
+	renderer          *render.Renderer
+	api               *apiClient
 }
 
 //Init read yaml config
 func (sender *Sender) Init(senderSettings map[string]string, logger notifier.Logger) error {
+	var err error
 	sender.APIToken = senderSettings["api_token"]
-	if sender.APIToken == "" {
-		return fmt.Errorf("Can not read slack api_token from config")
+	sender.WebhookURL = senderSettings["webhook_url"]
+	if sender.APIToken == "" && sender.WebhookURL == "" {
+		return fmt.Errorf("Can not read slack api_token or webhook_url from config")
 	}
 	log = logger
+	sender.AllowedWebhooks, err = parseAllowedWebhooks(senderSettings["webhook_allowed_urls"])
+	if err != nil {
+		return err
+	}
 	sender.FrontURI = senderSettings["front_uri"]
+	sender.APIURL = senderSettings["api_url"]
+	sender.Threads, _ = strconv.ParseBool(senderSettings["threads"])
+	sender.BroadcastErrors, _ = strconv.ParseBool(senderSettings["broadcast_errors"])
+	sender.api = newAPIClient(sender.APIURL, sender.APIToken)
+	sender.renderer, err = render.New(senderSettings["type"], senderSettings["templates_dir"], senderSettings["language"])
+	if err != nil {
+		return err
+	}
+	sender.SigningSecret = senderSettings["signing_secret"]
+	if sender.SigningSecret != "" {
+		if sender.DB == nil {
+			return fmt.Errorf("Slack interactivity requires database")
+		}
+		sender.InteractivityPath = senderSettings["interactivity_path"]
+		if sender.InteractivityPath == "" {
+			sender.InteractivityPath = DefaultInteractivityPath
+		}
+		if err := notifier.RegisterHandler(sender.InteractivityPath, sender); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close stops handling interactivity requests
+func (sender *Sender) Close() error {
+	if sender.SigningSecret != "" {
+		notifier.UnregisterHandler(sender.InteractivityPath, sender)
+	}
 	return nil
 }
 
 //SendEvents implements Sender interface Send
-func (sender *Sender) SendEvents(events notifier.EventsData, contact notifier.ContactData, trigger notifier.TriggerData, throttled bool) error {
-	api := slack.New(sender.APIToken)
+func (sender *Sender) SendEvents(ctx context.Context, events notifier.EventsData, contact notifier.ContactData, trigger notifier.TriggerData, throttled bool) error {
+	msg, err := sender.makeMessage(events, contact, trigger, throttled)
+	if err != nil {
+		return err
+	}
+
+	log.Debugf("Calling slack with message text %s", msg.Text)
+
+	if webhookURL := sender.webhookURL(contact); webhookURL != "" {
+		if webhookURL == contact.Value {
+			if !sender.webhookAllowed(webhookURL) {
+				return fmt.Errorf("Slack webhook of contact %s is not allowed", contact.ID)
+			}
+			msg.Channel = ""
+		}
+		if err := sender.api.postWebhook(ctx, webhookURL, msg); err != nil {
+			return fmt.Errorf("Failed to send message to slack webhook of contact %s: %s", contact.ID, err.Error())
+		}
+		return nil
+	}
 
-	var message bytes.Buffer
 	state := events.GetSubjectState()
-	tags := trigger.GetTags()
-	message.WriteString(fmt.Sprintf("*%s* %s <%s/#/events/%s|%s>\n %s \n```", state, tags, sender.FrontURI, events[0].TriggerID, trigger.Name, trigger.Desc))
+	resolved := state == "OK" && sender.triggerResolved(trigger)
+	posted := sender.getPostedMessage(contact, trigger)
+	if sender.Threads && posted != nil {
+		return sender.replyInThread(ctx, msg, posted, state, resolved, contact, trigger)
+	}
+	if resolved && posted != nil {
+		msg.Channel, msg.TS = posted.Channel, posted.TS
+		_, err := sender.api.updateMessage(ctx, msg)
+		if err == nil {
+			sender.removePostedMessage(contact, trigger)
+			return nil
+		}
+		if ctx.Err() != nil {
+			return fmt.Errorf("Failed to update slack message [%s]: %s", contact.Value, err.Error())
+		}
+		log.Warningf("Failed to update slack message of trigger %s, posting new one: %s", trigger.ID, err.Error())
+		msg.Channel, msg.TS = contact.Value, ""
+	}
+
+	response, err := sender.api.postMessage(ctx, msg)
+	if err != nil {
+		return fmt.Errorf("Failed to send message to slack [%s]: %s", contact.Value, err.Error())
+	}
+	if resolved {
+		sender.removePostedMessage(contact, trigger)
+	} else {
+		sender.savePostedMessage(contact, trigger, &postedMessage{Channel: response.Channel, TS: response.TS, State: state})
+	}
+	return nil
+}
+
+// replyInThread posts message as reply to trigger incident thread, reply is broadcast to channel
+// on escalation to ERROR if BroadcastErrors is set. Thread is over when the whole trigger returns to OK
+func (sender *Sender) replyInThread(ctx context.Context, msg *message, root *postedMessage, state string, resolved bool, contact notifier.ContactData, trigger notifier.TriggerData) error {
+	msg.Channel, msg.ThreadTS = root.Channel, root.TS
+	msg.ReplyBroadcast = sender.BroadcastErrors && isError(state) && !isError(root.State)
+	if _, err := sender.api.postMessage(ctx, msg); err != nil {
+		return fmt.Errorf("Failed to send thread reply to slack [%s]: %s", contact.Value, err.Error())
+	}
+	if resolved {
+		sender.removePostedMessage(contact, trigger)
+	} else if state != root.State {
+		root.State = state
+		sender.savePostedMessage(contact, trigger, root)
+	}
+	return nil
+}
+
+// webhookURL returns incoming webhook url to post message to or empty string if message should be posted with api_token.
+// Contact value may be webhook url, sender webhook_url is used if there is no api_token.
+// Webhooks give no message timestamp so messages posted with them are neither updated nor threaded
+func (sender *Sender) webhookURL(contact notifier.ContactData) string {
+	if isWebhookURL(contact.Value) {
+		return contact.Value
+	}
+	if sender.APIToken == "" {
+		return sender.WebhookURL
+	}
+	return ""
+}
+
+// ValidateContact rejects contacts with webhook urls other than slack incoming webhooks and allowed ones
+func (sender *Sender) ValidateContact(contact notifier.ContactData) error {
+	if isWebhookURL(contact.Value) && !sender.webhookAllowed(contact.Value) {
+		return fmt.Errorf("Slack webhook of contact %s is not allowed", contact.ID)
+	}
+	return nil
+}
+
+// webhookAllowed checks that webhook url has scheme and host of allowed url and its path is within allowed path
+func (sender *Sender) webhookAllowed(webhookURL string) bool {
+	parsed, err := url.Parse(webhookURL)
+	if err != nil || parsed.User != nil {
+		return false
+	}
+	for _, allowed := range sender.AllowedWebhooks {
+		if parsed.Scheme != allowed.Scheme || parsed.Host != allowed.Host {
+			continue
+		}
+		if parsed.Path == allowed.Path || strings.HasPrefix(parsed.Path, strings.TrimSuffix(allowed.Path, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// parseAllowedWebhooks parses comma separated list of allowed webhook url prefixes, slack webhooks are always allowed
+func parseAllowedWebhooks(value string) ([]*url.URL, error) {
+	var allowed []*url.URL
+	for _, prefix := range append([]string{slackWebhookURL}, strings.Split(value, ",")...) {
+		prefix = strings.TrimSpace(prefix)
+		if prefix == "" {
+			continue
+		}
+		parsed, err := url.Parse(prefix)
+		if err != nil || !isWebhookURL(prefix) || parsed.Host == "" {
+			return nil, fmt.Errorf("Can not parse slack webhook_allowed_urls: %s is not http url", prefix)
+		}
+		allowed = append(allowed, parsed)
+	}
+	return allowed, nil
+}
+
+func isWebhookURL(value string) bool {
+	return strings.HasPrefix(value, "https://") || strings.HasPrefix(value, "http://")
+}
+
+func isError(state string) bool {
+	return state == "ERROR" || state == "EXCEPTION"
+}
+
+// makeMessage renders package into message with sidebar colored by package state
+func (sender *Sender) makeMessage(events notifier.EventsData, contact notifier.ContactData, trigger notifier.TriggerData, throttled bool) (*message, error) {
+	renderer := sender.renderer.Contact(contact)
+	view := render.NewView(events, contact, trigger, throttled, sender.FrontURI)
+	subject, err := renderer.Render("subject", view)
+	if err != nil {
+		return nil, err
+	}
+	header, err := renderer.Render("header", view)
+	if err != nil {
+		return nil, err
+	}
+	description, err := renderer.Render("description", view)
+	if err != nil {
+		return nil, err
+	}
+
+	var eventsText bytes.Buffer
+	for i, event := range events {
+		line, err := renderer.Render("event", event)
+		if err != nil {
+			return nil, err
+		}
+		if eventsText.Len()+len(line) > blockTextLimit {
+			more, err := renderer.Render("more", len(events)-i)
+			if err != nil {
+				return nil, err
+			}
+			eventsText.WriteString(more)
+			break
+		}
+		eventsText.WriteString(line)
+		eventsText.WriteString("\n")
+	}
+
+	blocks := []block{{Type: "section", Text: &text{Type: "mrkdwn", Text: header}}}
+	if description != "" {
+		blocks = append(blocks, block{Type: "section", Text: &text{Type: "mrkdwn", Text: description}})
+	}
+	if eventsText.Len() > 0 {
+		blocks = append(blocks, block{Type: "section", Text: &text{Type: "mrkdwn", Text: fmt.Sprintf("```%s```", eventsText.String())}})
+	}
+	if throttled {
+		throttledText, err := renderer.Render("throttled", view)
+		if err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, block{Type: "context", Elements: []interface{}{&text{Type: "mrkdwn", Text: throttledText}}})
+	}
+
+	if sender.SigningSecret != "" && trigger.ID != "" {
+		blocks = append(blocks, makeActions(renderer, view, trigger))
+	}
+
 	icon := fmt.Sprintf("%s/public/fav72_ok.png", sender.FrontURI)
 	for _, event := range events {
 		if event.State != "OK" {
 			icon = fmt.Sprintf("%s/public/fav72_error.png", sender.FrontURI)
 		}
-		value := strconv.FormatFloat(event.Value, 'f', -1, 64)
-		message.WriteString(fmt.Sprintf("\n%s: %s = %s (%s to %s)", time.Unix(event.Timestamp, 0).Format("15:04"), event.Metric, value, event.OldState, event.State))
-		if len(event.Message) > 0 {
-			message.WriteString(fmt.Sprintf(". %s", event.Message))
-		}
 	}
 
-	message.WriteString("```")
-
-	if throttled {
-		message.WriteString("\nPlease, *fix your system or tune this trigger* to generate less events.")
+	messageText := subject
+	mention, linkNames := mentions(contact, view.State)
+	if mention != "" {
+		messageText = fmt.Sprintf("%s %s", mention, subject)
 	}
 
-	log.Debugf("Calling slack with message body %s", message.String())
+	return &message{
+		Channel:   contact.Value,
+		Text:      messageText,
+		Username:  "Moira",
+		IconURL:   icon,
+		LinkNames: linkNames,
+		Attachments: []attachment{{
+			Color:    stateColors[view.State],
+			Fallback: subject,
+			Blocks:   blocks,
+		}},
+	}, nil
+}
 
-	params := slack.PostMessageParameters{
-		Username: "Moira",
-		IconURL:  icon,
+// triggerResolved checks that the whole trigger is OK and not only metrics of package,
+// incident is kept if trigger state can not be read
+func (sender *Sender) triggerResolved(trigger notifier.TriggerData) bool {
+	if sender.DB == nil || trigger.ID == "" {
+		return true
 	}
+	state, err := sender.DB.GetTriggerState(trigger.ID)
+	if err != nil {
+		log.Warningf("Failed to get state of trigger %s: %s", trigger.ID, err.Error())
+		return false
+	}
+	return state == "OK"
+}
 
-	_, _, err := api.PostMessage(contact.Value, message.String(), params)
+// getPostedMessage returns message posted for trigger incident in contact channel or nil if there is none
+func (sender *Sender) getPostedMessage(contact notifier.ContactData, trigger notifier.TriggerData) *postedMessage {
+	if sender.DB == nil || trigger.ID == "" {
+		return nil
+	}
+	value, err := sender.DB.GetTriggerIncident("slack", contact.ID, trigger.ID)
 	if err != nil {
-		return fmt.Errorf("Failed to send message to slack [%s]: %s", contact.Value, err.Error())
+		log.Warningf("Failed to get slack message of trigger %s: %s", trigger.ID, err.Error())
+		return nil
+	}
+	if value == "" {
+		return nil
+	}
+	posted := &postedMessage{}
+	if err := json.Unmarshal([]byte(value), posted); err != nil {
+		log.Warningf("Failed to parse slack message of trigger %s: %s", trigger.ID, err.Error())
+		return nil
+	}
+	return posted
+}
+
+func (sender *Sender) savePostedMessage(contact notifier.ContactData, trigger notifier.TriggerData, posted *postedMessage) {
+	if sender.DB == nil || trigger.ID == "" {
+		return
+	}
+	value, _ := json.Marshal(posted)
+	if err := sender.DB.SetTriggerIncident("slack", contact.ID, trigger.ID, string(value)); err != nil {
+		log.Warningf("Failed to save slack message of trigger %s: %s", trigger.ID, err.Error())
+	}
+}
+
+func (sender *Sender) removePostedMessage(contact notifier.ContactData, trigger notifier.TriggerData) {
+	if sender.DB == nil || trigger.ID == "" {
+		return
+	}
+	if err := sender.DB.RemoveTriggerIncident("slack", contact.ID, trigger.ID); err != nil {
+		log.Warningf("Failed to remove slack message of trigger %s: %s", trigger.ID, err.Error())
 	}
-	return nil
 }
@@ -0,0 +1,63 @@
+package sms
+
+import "strings"
+
+const (
+	// GSM7SegmentLength is number of GSM-7 characters in single segment message
+	GSM7SegmentLength = 160
+	// UCS2SegmentLength is number of UCS-2 characters in single segment message
+	UCS2SegmentLength = 70
+
+	// segments of concatenated messages lose characters to user data header
+	gsm7PartLength = 153
+	ucs2PartLength = 67
+)
+
+// gsm7Basic and gsm7Extension are characters of GSM 03.38 alphabet,
+// extension characters are sent with escape character and take two positions
+const (
+	gsm7Basic     = "@£$¥èéùìòÇ\nØø\rÅåΔ_ΦΓΛΩΠΨΣΘΞÆæßÉ !\"#¤%&'()*+,-./0123456789:;<=>?¡ABCDEFGHIJKLMNOPQRSTUVWXYZÄÖÑÜ§¿abcdefghijklmnopqrstuvwxyzäöñüà"
+	gsm7Extension = "\f^{}\\[~]|€"
+)
+
+// Length returns number of characters text takes in message and whether it can be sent in GSM-7,
+// otherwise UTF-16 code units of UCS-2 message are counted
+func Length(text string) (int, bool) {
+	length := 0
+	for _, r := range text {
+		switch {
+		case strings.ContainsRune(gsm7Basic, r):
+			length++
+		case strings.ContainsRune(gsm7Extension, r):
+			length += 2
+		default:
+			return ucs2Length(text), false
+		}
+	}
+	return length, true
+}
+
+func ucs2Length(text string) int {
+	length := 0
+	for _, r := range text {
+		if r > 0xFFFF {
+			length += 2
+		} else {
+			length++
+		}
+	}
+	return length
+}
+
+// Segments returns number of segments text is billed as
+func Segments(text string) int {
+	length, gsm7 := Length(text)
+	single, part := UCS2SegmentLength, ucs2PartLength
+	if gsm7 {
+		single, part = GSM7SegmentLength, gsm7PartLength
+	}
+	if length <= single {
+		return 1
+	}
+	return (length + part - 1) / part
+}
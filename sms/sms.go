@@ -0,0 +1,99 @@
+package sms
+
+import (
+	"strings"
+
+	"github.com/moira-alert/notifier/render"
+)
+
+// MaxMetricLength is length metric paths are abbreviated to in messages
+const MaxMetricLength = 32
+
+// Compose renders notification package into message of at most given number of segments.
+// Subject goes first, then events from the most critical states while they fit,
+// then number of omitted events and throttling notice if it fits.
+// Templates subject, event, more and throttled of renderer are used
+func Compose(renderer *render.Renderer, view *render.View, segments int) (string, error) {
+	subject, err := renderer.Render("subject", view)
+	if err != nil {
+		return "", err
+	}
+	message := truncate(subject, segments)
+
+	events := view.Events.GetMostCriticalEvents(len(view.Events))
+	for i, event := range events {
+		event.Metric = AbbreviateMetric(event.Metric, MaxMetricLength)
+		line, err := renderer.Render("event", event)
+		if err != nil {
+			return "", err
+		}
+		candidate := message + "\n" + line
+		if omitted := len(events) - i - 1; omitted > 0 {
+			more, err := renderer.Render("more", omitted)
+			if err != nil {
+				return "", err
+			}
+			if Segments(candidate+"\n"+more) > segments {
+				return appendMore(renderer, message, len(events)-i, segments)
+			}
+		} else if Segments(candidate) > segments {
+			return appendMore(renderer, message, len(events)-i, segments)
+		}
+		message = candidate
+	}
+
+	if view.Throttled {
+		throttled, err := renderer.Render("throttled", view)
+		if err != nil {
+			return "", err
+		}
+		if Segments(message+"\n"+throttled) <= segments {
+			message += "\n" + throttled
+		}
+	}
+	return message, nil
+}
+
+// appendMore adds number of omitted events to message if it fits
+func appendMore(renderer *render.Renderer, message string, omitted int, segments int) (string, error) {
+	more, err := renderer.Render("more", omitted)
+	if err != nil {
+		return "", err
+	}
+	if Segments(message+"\n"+more) > segments {
+		return message, nil
+	}
+	return message + "\n" + more, nil
+}
+
+// truncate cuts text to given number of segments
+func truncate(text string, segments int) string {
+	runes := []rune(text)
+	for len(runes) > 0 && Segments(string(runes)) > segments {
+		runes = runes[:len(runes)-1]
+	}
+	return string(runes)
+}
+
+// AbbreviateMetric shortens metric path to maxLength: leading nodes are cut to their first letters
+// one by one, and if it is not enough, the beginning of full path is replaced with two dots
+func AbbreviateMetric(metric string, maxLength int) string {
+	if len(metric) <= maxLength {
+		return metric
+	}
+	nodes := strings.Split(metric, ".")
+	for i := 0; i < len(nodes)-1 && len(strings.Join(nodes, ".")) > maxLength; i++ {
+		if len(nodes[i]) > 1 {
+			nodes[i] = string([]rune(nodes[i])[:1])
+		}
+	}
+	abbreviated := strings.Join(nodes, ".")
+	if len(abbreviated) <= maxLength {
+		return abbreviated
+	}
+	runes := []rune(metric)
+	for len(string(runes)) > maxLength-2 {
+		runes = runes[1:]
+	}
+	return ".." + string(runes)
+}
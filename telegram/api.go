@@ -0,0 +1,153 @@
+package telegram
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// DefaultAPIURL is Telegram Bot API base url
+const DefaultAPIURL = "https://api.telegram.org"
+
+// update represents incoming update received with getUpdates
+type update struct {
+	UpdateID int      `json:"update_id"`
+	Message  *message `json:"message"`
+}
+
+// message represents incoming chat message
+type message struct {
+	MessageID int    `json:"message_id"`
+	From      *user  `json:"from"`
+	Chat      chat   `json:"chat"`
+	Text      string `json:"text"`
+}
+
+type user struct {
+	ID        int64  `json:"id"`
+	Username  string `json:"username"`
+	FirstName string `json:"first_name"`
+	LastName  string `json:"last_name"`
+}
+
+type chat struct {
+	ID       int64  `json:"id"`
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	Username string `json:"username"`
+}
+
+// apiResponse represents Telegram Bot API response
+type apiResponse struct {
+	OK          bool            `json:"ok"`
+	Result      json.RawMessage `json:"result"`
+	ErrorCode   int             `json:"error_code"`
+	Description string          `json:"description"`
+}
+
+// apiError is returned when Telegram responds with ok=false
+type apiError struct {
+	Method      string
+	Code        int
+	Description string
+}
+
+func (err *apiError) Error() string {
+	return fmt.Sprintf("%s failed with code %d: %s", err.Method, err.Code, err.Description)
+}
+
+// apiClient calls Telegram Bot API methods
+type apiClient struct {
+	url    string
+	client *http.Client
+}
+
+func newAPIClient(url, token string) *apiClient {
+	if url == "" {
+		url = DefaultAPIURL
+	}
+	return &apiClient{url: fmt.Sprintf("%s/bot%s/", strings.TrimSuffix(url, "/"), token), client: &http.Client{}}
+}
+
+// call posts JSON request to API method and decodes method result
+func (api *apiClient) call(ctx context.Context, method string, request interface{}, result interface{}) error {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	return api.post(ctx, method, "application/json; charset=utf-8", bytes.NewReader(body), result)
+}
+
+// post sends request body of given content type to API method and decodes method result
+func (api *apiClient) post(ctx context.Context, method string, contentType string, body io.Reader, result interface{}) error {
+	httpRequest, err := http.NewRequest("POST", api.url+method, body)
+	if err != nil {
+		return err
+	}
+	httpRequest.Header.Set("Content-Type", contentType)
+	httpResponse, err := api.client.Do(httpRequest.WithContext(ctx))
+	if err != nil {
+		// url of failed request contains bot token
+		if urlErr, ok := err.(*url.Error); ok {
+			err = urlErr.Err
+		}
+		return fmt.Errorf("%s request failed: %s", method, err.Error())
+	}
+	defer httpResponse.Body.Close()
+	response := &apiResponse{}
+	if err := json.NewDecoder(httpResponse.Body).Decode(response); err != nil {
+		return fmt.Errorf("Failed to decode %s response with status %s: %s", method, httpResponse.Status, err.Error())
+	}
+	if !response.OK {
+		return &apiError{Method: method, Code: response.ErrorCode, Description: response.Description}
+	}
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(response.Result, result)
+}
+
+// getUpdates waits for incoming updates with long polling
+func (api *apiClient) getUpdates(ctx context.Context, offset int, timeout int) ([]update, error) {
+	var updates []update
+	request := map[string]interface{}{"offset": offset, "timeout": timeout, "allowed_updates": []string{"message"}}
+	err := api.call(ctx, "getUpdates", request, &updates)
+	return updates, err
+}
+
+// sendMessage sends text to chat with given id or @channel username, text is formatted according to parseMode if it is not empty
+func (api *apiClient) sendMessage(ctx context.Context, chatID string, text string, parseMode string) error {
+	request := map[string]interface{}{"chat_id": chatID, "text": text, "disable_web_page_preview": true}
+	if parseMode != "" {
+		request["parse_mode"] = parseMode
+	}
+	return api.call(ctx, "sendMessage", request, nil)
+}
+
+// sendPhoto sends PNG image to chat with caption formatted according to parseMode if it is not empty
+func (api *apiClient) sendPhoto(ctx context.Context, chatID string, photo []byte, caption string, parseMode string) error {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	form.WriteField("chat_id", chatID)
+	if caption != "" {
+		form.WriteField("caption", caption)
+		if parseMode != "" {
+			form.WriteField("parse_mode", parseMode)
+		}
+	}
+	file, err := form.CreateFormFile("photo", "chart.png")
+	if err != nil {
+		return err
+	}
+	file.Write(photo)
+	if err := form.Close(); err != nil {
+		return err
+	}
+	return api.post(ctx, "sendPhoto", form.FormDataContentType(), &body, nil)
+}
@@ -0,0 +1,478 @@
+package telegram
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/moira-alert/notifier"
+	"github.com/moira-alert/notifier/render"
+)
+
+const (
+	// pollTimeout is getUpdates long polling timeout in seconds
+	pollTimeout = 30
+	// pollRetryInterval is delay before next getUpdates call after failed one
+	pollRetryInterval = 5 * time.Second
+	// commandTimeout limits time of answering single chat message
+	commandTimeout = 30 * time.Second
+)
+
+// bot receives chat messages with getUpdates long polling, registers chats and answers commands
+type bot struct {
+	api      *apiClient
+	db       Database
+	renderer *render.Renderer
+	frontURI string
+	log      notifier.Logger
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+}
+
+func startBot(api *apiClient, db Database, renderer *render.Renderer, frontURI string, linkInterval time.Duration, logger notifier.Logger) *bot {
+	ctx, cancel := context.WithCancel(context.Background())
+	b := &bot{
+		api:      api,
+		db:       db,
+		renderer: renderer,
+		frontURI: frontURI,
+		log:      logger,
+		cancel:   cancel,
+	}
+	b.wg.Add(2)
+	go b.run(ctx)
+	go b.link(ctx, linkInterval)
+	return b
+}
+
+// stop cancels polling and waits until current message is answered
+func (b *bot) stop() {
+	b.cancel()
+	b.wg.Wait()
+}
+
+// link claims pending link codes entered as contact values every link interval
+func (b *bot) link(ctx context.Context, interval time.Duration) {
+	defer b.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			linkContacts(b.db, b.log)
+		}
+	}
+}
+
+func (b *bot) run(ctx context.Context) {
+	defer b.wg.Done()
+	b.log.Debug("Start receiving telegram bot messages")
+	offset := 0
+	for {
+		updates, err := b.api.getUpdates(ctx, offset, pollTimeout)
+		if ctx.Err() != nil {
+			b.log.Debug("Stop receiving telegram bot messages")
+			return
+		}
+		if err != nil {
+			b.log.Warningf("Failed to get telegram bot messages: %s", err.Error())
+			select {
+			case <-ctx.Done():
+			case <-time.After(pollRetryInterval):
+			}
+			continue
+		}
+		for _, update := range updates {
+			offset = update.UpdateID + 1
+			if update.Message != nil {
+				b.handleMessage(update.Message)
+			}
+		}
+	}
+}
+
+// handleMessage registers private chat on /start and group chat on any message by chat title,
+// then answers command if message is one. Group greeting and command answer are sent in one reply
+func (b *bot) handleMessage(msg *message) {
+	ctx, cancel := context.WithTimeout(context.Background(), commandTimeout)
+	defer cancel()
+
+	chatID := strconv.FormatInt(msg.Chat.ID, 10)
+	command, args := parseCommand(msg.Text)
+	var reply string
+	var err error
+	switch {
+	case msg.Chat.Type == "group" || msg.Chat.Type == "supergroup":
+		reply, err = b.registerGroup(msg.Chat, chatID)
+		if err == nil && command != "" {
+			var answer string
+			if answer, err = b.answer(chatID, msg, command, args); reply != "" && answer != "" {
+				reply += "\n\n"
+			}
+			reply += answer
+		}
+	case msg.Chat.Type == "private" && command == "/start":
+		reply, err = b.registerPrivate(msg, chatID)
+	case msg.Chat.Type == "private":
+		if msg.Chat.Username != "" {
+			b.indexChatUser("@"+msg.Chat.Username, chatID)
+		}
+		reply, err = b.answer(chatID, msg, command, args)
+	default:
+		return
+	}
+	if err != nil {
+		b.log.Errorf("Failed to answer telegram chat %s: %s", chatID, err.Error())
+		reply = b.renderer.Translate("bot_error")
+	}
+	if reply == "" {
+		return
+	}
+	if err := b.api.sendMessage(ctx, chatID, reply, ""); err != nil {
+		b.log.Warningf("Failed to send reply to telegram chat %s: %s", chatID, err.Error())
+	}
+}
+
+// registerPrivate gives one-time link code to private chat, chat is also registered by username
+// for contacts created before link codes
+func (b *bot) registerPrivate(msg *message, chatID string) (string, error) {
+	code, err := newLinkCode()
+	if err != nil {
+		return "", err
+	}
+	if err := b.db.SetLinkCode(messenger, code, chatID); err != nil {
+		return "", err
+	}
+	if msg.Chat.Username != "" {
+		if err := b.db.SetUsernameID(messenger, "@"+msg.Chat.Username, chatID); err != nil {
+			return "", err
+		}
+	}
+	b.markReachable(chatID)
+	var name string
+	if msg.From != nil {
+		name = strings.TrimSpace(fmt.Sprintf("%s %s", msg.From.FirstName, msg.From.LastName))
+	}
+	return b.renderer.Translate("bot_start", name, code), nil
+}
+
+// markReachable removes unreachable marks of chat contacts when user starts bot or adds it to group again
+func (b *bot) markReachable(chatID string) {
+	contacts, err := b.chatContacts(chatID)
+	if err != nil {
+		b.log.Warning(err.Error())
+		return
+	}
+	for _, contact := range contacts {
+		if err := b.db.RemoveContactUnreachable(contact.ID); err != nil {
+			b.log.Warning(err.Error())
+		}
+	}
+}
+
+// registerGroup stores group chat id by its title and greets group when it is registered first time
+func (b *bot) registerGroup(group chat, chatID string) (string, error) {
+	registered, _ := b.db.GetIDByUsername(messenger, group.Title)
+	if registered == chatID {
+		b.indexChatUser(group.Title, chatID)
+		return "", nil
+	}
+	if err := b.db.SetUsernameID(messenger, group.Title, chatID); err != nil {
+		return "", err
+	}
+	b.markReachable(chatID)
+	return b.renderer.Translate("bot_group", group.Title), nil
+}
+
+// indexChatUser adds username or title registered before chat users index was introduced to the index
+func (b *bot) indexChatUser(username, chatID string) {
+	if err := b.db.IndexChatUser(messenger, username, chatID); err != nil {
+		b.log.Warningf("Failed to index telegram chat %s user %s: %s", chatID, username, err.Error())
+	}
+}
+
+// parseCommand splits message into command without bot username and its arguments
+func parseCommand(text string) (string, []string) {
+	fields := strings.Fields(text)
+	if len(fields) == 0 || !strings.HasPrefix(fields[0], "/") {
+		return "", nil
+	}
+	command := fields[0]
+	if i := strings.Index(command, "@"); i > 0 {
+		command = command[:i]
+	}
+	return strings.ToLower(command), fields[1:]
+}
+
+func (b *bot) answer(chatID string, msg *message, command string, args []string) (string, error) {
+	contacts, err := b.chatContacts(chatID)
+	if err != nil {
+		return "", err
+	}
+	if len(contacts) == 0 && command != "" {
+		return b.renderer.Translate("bot_no_contacts"), nil
+	}
+	switch command {
+	case "/status":
+		return b.status(contacts)
+	case "/mute":
+		return b.mute(contacts, msg, args)
+	case "/unmute":
+		return b.unmute(contacts, args)
+	case "/subs":
+		return b.subscriptions(contacts)
+	case "/test":
+		return b.test(contacts)
+	default:
+		return b.renderer.Translate("bot_help"), nil
+	}
+}
+
+// chatContacts returns telegram contacts linked to chat and contacts found by usernames, titles
+// and pending link codes registered with chat id, contacts with pending link codes are linked
+func (b *bot) chatContacts(chatID string) ([]notifier.ContactData, error) {
+	contactIDs, err := b.db.GetChatContactIDs(messenger, chatID)
+	if err != nil {
+		return nil, err
+	}
+	var contacts []notifier.ContactData
+	found := make(map[string]bool, len(contactIDs))
+	for _, contactID := range contactIDs {
+		contact, err := b.db.GetContact(contactID)
+		if err != nil {
+			b.log.Warning(err.Error())
+			continue
+		}
+		if linked, err := b.db.GetContactChatID(messenger, contact.ID, contact.Value); err != nil || linked != chatID {
+			continue
+		}
+		found[contact.ID] = true
+		contacts = append(contacts, contact)
+	}
+
+	usernames, err := b.db.GetUsernamesByID(messenger, chatID)
+	if err != nil {
+		return nil, err
+	}
+	for _, username := range usernames {
+		usernameContacts, err := b.db.GetContactsByValue(messenger, username)
+		if err != nil {
+			return nil, err
+		}
+		for _, contact := range usernameContacts {
+			if found[contact.ID] {
+				continue
+			}
+			found[contact.ID] = true
+			if err := linkContact(b.db, contact, chatID); err != nil {
+				return nil, err
+			}
+			contacts = append(contacts, contact)
+		}
+	}
+	return contacts, nil
+}
+
+// chatSubscriptions returns subscriptions of contacts owners delivering to any of contacts
+func (b *bot) chatSubscriptions(contacts []notifier.ContactData) ([]notifier.SubscriptionData, error) {
+	var subscriptions []notifier.SubscriptionData
+	found := make(map[string]bool)
+	for _, contact := range contacts {
+		userSubscriptions, err := b.db.GetUserSubscriptions(contact.User)
+		if err != nil {
+			return nil, err
+		}
+		for _, subscription := range userSubscriptions {
+			if found[subscription.ID] || !containsString(subscription.Contacts, contact.ID) {
+				continue
+			}
+			found[subscription.ID] = true
+			subscriptions = append(subscriptions, subscription)
+		}
+	}
+	return subscriptions, nil
+}
+
+// chatTriggers returns triggers matching enabled subscriptions delivering to contacts
+func (b *bot) chatTriggers(contacts []notifier.ContactData) ([]notifier.TriggerData, error) {
+	subscriptions, err := b.chatSubscriptions(contacts)
+	if err != nil {
+		return nil, err
+	}
+	var triggers []notifier.TriggerData
+	found := make(map[string]bool)
+	for _, subscription := range subscriptions {
+		if !subscription.Enabled || len(subscription.Tags) == 0 {
+			continue
+		}
+		ids, err := b.db.GetTagsTriggers(subscription.Tags)
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range ids {
+			if found[id] {
+				continue
+			}
+			found[id] = true
+			trigger, err := b.db.GetTrigger(id)
+			if err != nil {
+				b.log.Warning(err.Error())
+				continue
+			}
+			trigger.ID = id
+			triggers = append(triggers, trigger)
+		}
+	}
+	sort.Sort(triggersByName(triggers))
+	return triggers, nil
+}
+
+func (b *bot) findTrigger(contacts []notifier.ContactData, idOrName string) (*notifier.TriggerData, error) {
+	triggers, err := b.chatTriggers(contacts)
+	if err != nil {
+		return nil, err
+	}
+	for i := range triggers {
+		if triggers[i].ID == idOrName || strings.EqualFold(triggers[i].Name, idOrName) {
+			return &triggers[i], nil
+		}
+	}
+	return nil, nil
+}
+
+func (b *bot) status(contacts []notifier.ContactData) (string, error) {
+	triggers, err := b.chatTriggers(contacts)
+	if err != nil {
+		return "", err
+	}
+	var reply bytes.Buffer
+	for _, trigger := range triggers {
+		state, err := b.db.GetTriggerState(trigger.ID)
+		if err != nil {
+			return "", err
+		}
+		if state == "" || state == "OK" {
+			continue
+		}
+		reply.WriteString(fmt.Sprintf("%s %s", state, trigger.Name))
+		if muted, _ := b.db.IsTriggerMuted(trigger.ID); muted {
+			reply.WriteString(fmt.Sprintf(" (%s)", b.renderer.Translate("bot_muted_mark")))
+		}
+		reply.WriteString(fmt.Sprintf("\n%s/#/events/%s\n", b.frontURI, trigger.ID))
+	}
+	if reply.Len() == 0 {
+		return b.renderer.Translate("bot_all_ok"), nil
+	}
+	return reply.String(), nil
+}
+
+func (b *bot) mute(contacts []notifier.ContactData, msg *message, args []string) (string, error) {
+	if len(args) < 2 {
+		return b.renderer.Translate("bot_mute_usage"), nil
+	}
+	duration, err := time.ParseDuration(args[len(args)-1])
+	if err != nil || duration <= 0 {
+		return b.renderer.Translate("bot_mute_usage"), nil
+	}
+	idOrName := strings.Join(args[:len(args)-1], " ")
+	trigger, err := b.findTrigger(contacts, idOrName)
+	if err != nil {
+		return "", err
+	}
+	if trigger == nil {
+		return b.renderer.Translate("bot_trigger_not_found", idOrName), nil
+	}
+	if err := b.db.MuteTrigger(trigger.ID, senderName(msg), duration); err != nil {
+		return "", err
+	}
+	b.log.Infof("Trigger %s muted for %s by telegram user %s", trigger.ID, duration, senderName(msg))
+	return b.renderer.Translate("bot_muted", trigger.Name, duration.String()), nil
+}
+
+func (b *bot) unmute(contacts []notifier.ContactData, args []string) (string, error) {
+	if len(args) == 0 {
+		return b.renderer.Translate("bot_unmute_usage"), nil
+	}
+	idOrName := strings.Join(args, " ")
+	trigger, err := b.findTrigger(contacts, idOrName)
+	if err != nil {
+		return "", err
+	}
+	if trigger == nil {
+		return b.renderer.Translate("bot_trigger_not_found", idOrName), nil
+	}
+	if err := b.db.UnmuteTrigger(trigger.ID); err != nil {
+		return "", err
+	}
+	return b.renderer.Translate("bot_unmuted", trigger.Name), nil
+}
+
+func (b *bot) subscriptions(contacts []notifier.ContactData) (string, error) {
+	subscriptions, err := b.chatSubscriptions(contacts)
+	if err != nil {
+		return "", err
+	}
+	if len(subscriptions) == 0 {
+		return b.renderer.Translate("bot_no_subscriptions"), nil
+	}
+	var reply bytes.Buffer
+	for _, subscription := range subscriptions {
+		for _, tag := range subscription.Tags {
+			reply.WriteString(fmt.Sprintf("[%s]", tag))
+		}
+		if !subscription.Enabled {
+			reply.WriteString(fmt.Sprintf(" (%s)", b.renderer.Translate("bot_disabled_mark")))
+		}
+		reply.WriteString("\n")
+	}
+	return reply.String(), nil
+}
+
+// test schedules test notification to every contact of chat
+func (b *bot) test(contacts []notifier.ContactData) (string, error) {
+	now := notifier.GetNow().Unix()
+	for _, contact := range contacts {
+		notification := &notifier.ScheduledNotification{
+			Event:     notifier.EventData{State: "TEST", OldState: "TEST", Timestamp: now},
+			Contact:   contact,
+			Timestamp: now,
+		}
+		if err := b.db.AddNotification(notification); err != nil {
+			return "", err
+		}
+	}
+	return b.renderer.Translate("bot_test"), nil
+}
+
+// senderName returns telegram username of message sender stored with trigger mute
+func senderName(msg *message) string {
+	if msg.From == nil {
+		return ""
+	}
+	if msg.From.Username != "" {
+		return "@" + msg.From.Username
+	}
+	return strconv.FormatInt(msg.From.ID, 10)
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+type triggersByName []notifier.TriggerData
+
+func (triggers triggersByName) Len() int           { return len(triggers) }
+func (triggers triggersByName) Swap(i, j int)      { triggers[i], triggers[j] = triggers[j], triggers[i] }
+func (triggers triggersByName) Less(i, j int) bool { return triggers[i].Name < triggers[j].Name }
@@ -0,0 +1,74 @@
+package telegram
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/moira-alert/notifier"
+)
+
+const (
+	defaultChartPeriod = 3 * time.Hour
+	chartWidth         = 800
+	chartHeight        = 400
+	// maxChartSize is Telegram photo size limit
+	maxChartSize = 10 << 20
+)
+
+// fetchChart renders chart of trigger targets with Graphite render API.
+// Notification is sent without chart if it can not be rendered, so nil is returned on failure
+func (sender *Sender) fetchChart(ctx context.Context, events notifier.EventsData, trigger notifier.TriggerData) []byte {
+	if sender.RenderURL == "" || len(trigger.Targets) == 0 || events.GetSubjectState() == "TEST" {
+		return nil
+	}
+	chart, err := sender.renderChart(ctx, trigger)
+	if err != nil {
+		log.Warningf("Failed to render chart of trigger %s: %s", trigger.ID, err.Error())
+		return nil
+	}
+	return chart
+}
+
+func (sender *Sender) renderChart(ctx context.Context, trigger notifier.TriggerData) ([]byte, error) {
+	query := url.Values{
+		"target": trigger.Targets,
+		"from":   {fmt.Sprintf("-%dminutes", int(sender.ChartPeriod.Minutes()))},
+		"format": {"png"},
+		"width":  {fmt.Sprint(chartWidth)},
+		"height": {fmt.Sprint(chartHeight)},
+		"title":  {trigger.Name},
+	}
+	separator := "?"
+	if strings.Contains(sender.RenderURL, "?") {
+		separator = "&"
+	}
+	request, err := http.NewRequest("GET", sender.RenderURL+separator+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	response, err := sender.api.client.Do(request.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("render responded with status %s", response.Status)
+	}
+	if contentType := response.Header.Get("Content-Type"); !strings.HasPrefix(contentType, "image/") {
+		return nil, fmt.Errorf("render responded with %s instead of image", contentType)
+	}
+	chart, err := ioutil.ReadAll(&io.LimitedReader{R: response.Body, N: maxChartSize + 1})
+	if err != nil {
+		return nil, err
+	}
+	if len(chart) > maxChartSize {
+		return nil, fmt.Errorf("chart exceeds %d bytes", maxChartSize)
+	}
+	return chart, nil
+}
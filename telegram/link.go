@@ -0,0 +1,62 @@
+package telegram
+
+import (
+	"crypto/rand"
+	"fmt"
+	"regexp"
+
+	"github.com/moira-alert/notifier"
+)
+
+// linkCodeAlphabet has no characters that are easy to confuse when code is typed
+const linkCodeAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+var linkCodePattern = regexp.MustCompile(`^[A-HJ-NP-Z2-9]{8}$`)
+
+// newLinkCode returns one-time code user enters in Moira as telegram contact value to link contact to chat
+func newLinkCode() (string, error) {
+	random := make([]byte, 8)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	code := make([]byte, len(random))
+	for i, b := range random {
+		code[i] = linkCodeAlphabet[int(b)%len(linkCodeAlphabet)]
+	}
+	return string(code), nil
+}
+
+// linkContact permanently links contact which value is link code to chat requested the code
+func linkContact(db Database, contact notifier.ContactData, chatID string) error {
+	if !linkCodePattern.MatchString(contact.Value) {
+		return nil
+	}
+	if err := db.LinkContact(messenger, contact.ID, contact.Value, chatID); err != nil {
+		return fmt.Errorf("Failed to link telegram contact %s: %s", contact.ID, err.Error())
+	}
+	return nil
+}
+
+// linkContacts links contacts which values are pending link codes, so that code is claimed as soon as
+// contact with it is indexed by value and not when contact receives first notification
+func linkContacts(db Database, logger notifier.Logger) {
+	codes, err := db.GetLinkCodes(messenger)
+	if err != nil {
+		logger.Warningf("Failed to get telegram link codes: %s", err.Error())
+		return
+	}
+	for code, chatID := range codes {
+		contacts, err := db.GetContactsByValue(messenger, code)
+		if err != nil {
+			logger.Warningf("Failed to get contacts to link telegram chat %s: %s", chatID, err.Error())
+			continue
+		}
+		for _, contact := range contacts {
+			if err := linkContact(db, contact, chatID); err != nil {
+				logger.Warning(err.Error())
+				continue
+			}
+			logger.Infof("Telegram contact %s is linked to chat %s", contact.ID, chatID)
+		}
+	}
+}
@@ -2,33 +2,85 @@ package telegram
 
 import (
 	"bytes"
+	"context"
 	"fmt"
+	"net/http"
 	"strconv"
+	"text/template"
 	"time"
+	"unicode/utf8"
 
-	"github.com/skbkontur/bot"
+	"github.com/gosexy/to"
 
 	"github.com/moira-alert/notifier"
+	"github.com/moira-alert/notifier/render"
+)
+
+const (
+	messenger           = "telegram"
+	defaultMaxParts     = 5
+	defaultPartInterval = time.Second
+	defaultLinkInterval = time.Minute
+	// partReserve is room left in message part for part number and "more" line
+	partReserve = 100
+	// maxFieldLength limits HTML escaped event metric and message length, so that single event
+	// always fits into message with markup of event template
+	maxFieldLength = 512
 )
 
 var (
-	api                  bot.Bot
 	log                  notifier.Logger
 	telegramMessageLimit = 4096
-	emojiStates          = map[string]string{
-		"OK":     "\xe2\x9c\x85",
-		"WARN":   "\xe2\x9a\xa0",
-		"ERROR":  "\xe2\xad\x95",
-		"NODATA": "\xf0\x9f\x92\xa3",
-		"TEST":   "\xf0\x9f\x98\x8a",
-	}
+	telegramCaptionLimit = 1024
 )
 
+// Database resolves chats to Moira contacts and serves bot commands
+type Database interface {
+	GetIDByUsername(messenger, username string) (string, error)
+	SetUsernameID(messenger, username, id string) error
+	SetLinkCode(messenger, code, id string) error
+	GetLinkCodes(messenger string) (map[string]string, error)
+	LinkContact(messenger, contactID, code, id string) error
+	GetContactChatID(messenger, contactID, value string) (string, error)
+	GetChatContactIDs(messenger, id string) ([]string, error)
+	GetUsernamesByID(messenger, id string) ([]string, error)
+	IndexChatUser(messenger, username, id string) error
+	RegisterBotIfAlreadyNot(messenger string) bool
+	GetContact(id string) (notifier.ContactData, error)
+	IndexContactValue(contact notifier.ContactData) error
+	GetContactsByValue(contactType, value string) ([]notifier.ContactData, error)
+	GetUserSubscriptions(login string) ([]notifier.SubscriptionData, error)
+	GetTagsTriggers(tags []string) ([]string, error)
+	GetTrigger(id string) (notifier.TriggerData, error)
+	GetTriggerState(id string) (string, error)
+	IsTriggerMuted(id string) (bool, error)
+	MuteTrigger(triggerID, user string, duration time.Duration) error
+	UnmuteTrigger(triggerID string) error
+	AddNotification(notification *notifier.ScheduledNotification) error
+	SetContactUnreachable(contactID, value string) error
+	IsContactUnreachable(contact notifier.ContactData) (bool, error)
+	RemoveContactUnreachable(contactID string) error
+}
+
 // Sender implements moira sender interface via telegram
 type Sender struct {
-	DB       bot.Database
+	DB       Database
 	APIToken string
+	APIURL   string
 	FrontURI string
+	// MaxParts limits number of messages package is split into, events not fitting into them are counted in last message
+	MaxParts int
+	// PartInterval is delay between messages of package, Telegram limits messages rate per chat
+	PartInterval time.Duration
+	// RenderURL is Graphite-compatible render API url, chart of trigger targets is attached to messages if it is set
+	RenderURL string
+	// ChartPeriod is time range of attached chart
+	ChartPeriod time.Duration
+	// LinkInterval is how often bot looks for contacts with pending link codes
+	LinkInterval time.Duration
+	renderer     *render.Renderer
+	api          *apiClient
+	bot          *bot
 }
 
 //Init read yaml config
@@ -39,58 +91,237 @@ func (sender *Sender) Init(senderSettings map[string]string, logger notifier.Log
 	}
 	log = logger
 	sender.FrontURI = senderSettings["front_uri"]
+	sender.APIURL = senderSettings["api_url"]
+	sender.MaxParts = defaultMaxParts
+	if senderSettings["max_parts"] != "" {
+		maxParts, err := strconv.Atoi(senderSettings["max_parts"])
+		if err != nil || maxParts < 1 {
+			return fmt.Errorf("Can not read telegram max_parts from config: %s", senderSettings["max_parts"])
+		}
+		sender.MaxParts = maxParts
+	}
+	sender.PartInterval = defaultPartInterval
+	if senderSettings["part_interval"] != "" {
+		sender.PartInterval = to.Duration(senderSettings["part_interval"])
+	}
+	sender.LinkInterval = defaultLinkInterval
+	if senderSettings["link_interval"] != "" {
+		sender.LinkInterval = to.Duration(senderSettings["link_interval"])
+	}
+	sender.RenderURL = senderSettings["graphite_render_url"]
+	sender.ChartPeriod = defaultChartPeriod
+	if senderSettings["chart_hours"] != "" {
+		hours, err := strconv.Atoi(senderSettings["chart_hours"])
+		if err != nil || hours < 1 {
+			return fmt.Errorf("Can not read telegram chart_hours from config: %s", senderSettings["chart_hours"])
+		}
+		sender.ChartPeriod = time.Duration(hours) * time.Hour
+	}
 
 	var err error
-	api, err = bot.StartTelebot(sender.APIToken, sender.DB)
+	sender.renderer, err = render.New(senderSettings["type"], senderSettings["templates_dir"], senderSettings["language"])
 	if err != nil {
-		log.Errorf("Error starting bot: %s", err)
+		return err
+	}
+	sender.api = newAPIClient(sender.APIURL, sender.APIToken)
+	if sender.DB.RegisterBotIfAlreadyNot(messenger) {
+		sender.bot = startBot(sender.api, sender.DB, sender.renderer, sender.FrontURI, sender.LinkInterval, logger)
+	} else {
+		log.Infof("Telegram bot is running on another notifier instance")
 	}
 	return nil
 }
 
-//SendEvents implements Sender interface Send
-func (sender *Sender) SendEvents(events notifier.EventsData, contact notifier.ContactData, trigger notifier.TriggerData, throttled bool) error {
-
-	var message bytes.Buffer
+// Close stops receiving bot commands
+func (sender *Sender) Close() error {
+	if sender.bot != nil {
+		sender.bot.stop()
+	}
+	return nil
+}
 
-	state := events.GetSubjectState()
-	tags := trigger.GetTags()
+//SendEvents implements Sender interface Send
+func (sender *Sender) SendEvents(ctx context.Context, events notifier.EventsData, contact notifier.ContactData, trigger notifier.TriggerData, throttled bool) error {
+	parts, err := sender.makeMessages(events, contact, trigger, throttled)
+	if err != nil {
+		return err
+	}
 
-	emoji := emojiStates[state]
-	message.WriteString(fmt.Sprintf("%s%s %s %s (%d)\n", string(emoji), state, trigger.Name, tags, len(events)))
+	chatID, err := sender.resolveChatID(contact)
+	if err != nil {
+		return err
+	}
 
-	messageLimitReached := false
-	lineCount := 0
+	if chart := sender.fetchChart(ctx, events, trigger); chart != nil {
+		caption := ""
+		if len(parts) == 1 && utf8.RuneCountInString(parts[0]) <= telegramCaptionLimit {
+			caption, parts = parts[0], nil
+		}
+		log.Debugf("Calling telegram api with chat_id %s and chart of trigger %s", chatID, trigger.ID)
+		if err := sender.api.sendPhoto(ctx, chatID, chart, caption, "HTML"); err != nil {
+			return sender.sendingError(contact, fmt.Errorf("Failed to send chart to telegram contact %s: %s. ", contact.Value, err), err)
+		}
+		if len(parts) > 0 {
+			if err := sender.wait(ctx); err != nil {
+				return fmt.Errorf("Failed to send message to telegram contact %s: %s. ", contact.Value, err)
+			}
+		}
+	}
 
-	for _, event := range events {
-		value := strconv.FormatFloat(event.Value, 'f', -1, 64)
-		line := fmt.Sprintf("\n%s: %s = %s (%s to %s)", time.Unix(event.Timestamp, 0).Format("15:04"), event.Metric, value, event.OldState, event.State)
-		if len(event.Message) > 0 {
-			line += fmt.Sprintf(". %s", event.Message)
+	for i, part := range parts {
+		if i > 0 {
+			if err := sender.wait(ctx); err != nil {
+				return fmt.Errorf("Failed to send message %d of %d to telegram contact %s: %s. ", i+1, len(parts), contact.Value, err)
+			}
 		}
-		if message.Len()+len(line) > telegramMessageLimit-400 {
-			messageLimitReached = true
-			break
+		log.Debugf("Calling telegram api with chat_id %s and message body %s", chatID, part)
+		if err := sender.api.sendMessage(ctx, chatID, part, "HTML"); err != nil {
+			return sender.sendingError(contact, fmt.Errorf("Failed to send message %d of %d to telegram contact %s: %s. ", i+1, len(parts), contact.Value, err), err)
 		}
-		message.WriteString(line)
-		lineCount++
 	}
+	return nil
+}
 
-	if messageLimitReached {
-		message.WriteString(fmt.Sprintf("\n\n...and %d more events.", len(events)-lineCount))
+// resolveChatID returns id of chat contact is linked to or chat registered by bot with contact username,
+// group title or link code
+func (sender *Sender) resolveChatID(contact notifier.ContactData) (string, error) {
+	chatID, err := sender.DB.GetContactChatID(messenger, contact.ID, contact.Value)
+	if err != nil {
+		return "", fmt.Errorf("Failed to get linked chat of telegram contact %s: %s", contact.ID, err.Error())
+	}
+	if chatID != "" {
+		return chatID, nil
+	}
+	chatID, err = sender.DB.GetIDByUsername(messenger, contact.Value)
+	if err != nil || chatID == "" {
+		return "", fmt.Errorf("Failed to get chat id of telegram contact %s, chat is not registered by bot or link code has expired", contact.Value)
+	}
+	if err := linkContact(sender.DB, contact, chatID); err != nil {
+		return "", err
 	}
+	return chatID, nil
+}
+
+// sendingError marks contact unreachable if Telegram forbids sending to chat, e.g. user blocked bot
+// or bot was removed from group. Notifications to such contact are not resent until chat is registered again
+func (sender *Sender) sendingError(contact notifier.ContactData, err error, apiErr error) error {
+	forbidden, ok := apiErr.(*apiError)
+	if !ok || forbidden.Code != http.StatusForbidden {
+		return err
+	}
+	if err := sender.DB.SetContactUnreachable(contact.ID, contact.Value); err != nil {
+		log.Warningf("Failed to mark telegram contact %s unreachable: %s", contact.ID, err.Error())
+	}
+	return &notifier.UnreachableContactError{Reason: err.Error()}
+}
+
+// ValidateContact rejects contacts marked unreachable. Contact is also indexed by value,
+// so that bot finds it by username or link code of chat
+func (sender *Sender) ValidateContact(contact notifier.ContactData) error {
+	if err := sender.DB.IndexContactValue(contact); err != nil {
+		log.Warningf("Failed to index telegram contact %s: %s", contact.ID, err.Error())
+	}
+	unreachable, err := sender.DB.IsContactUnreachable(contact)
+	if err != nil {
+		log.Warningf("Failed to check telegram contact %s: %s", contact.ID, err.Error())
+		return nil
+	}
+	if unreachable {
+		return fmt.Errorf("Telegram chat of contact %s is unreachable, bot should be started in chat again", contact.Value)
+	}
+	return nil
+}
 
-	message.WriteString(fmt.Sprintf("\n\n%s/#/events/%s\n", sender.FrontURI, events[0].TriggerID))
+// wait delays next message to chat for PartInterval
+func (sender *Sender) wait(ctx context.Context) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(sender.PartInterval):
+		return nil
+	}
+}
 
+// makeMessages renders package into HTML formatted messages fitting Telegram message length limit.
+// Every message starts with header, the last one ends with package summary and footer
+func (sender *Sender) makeMessages(events notifier.EventsData, contact notifier.ContactData, trigger notifier.TriggerData, throttled bool) ([]string, error) {
+	renderer := sender.renderer.Contact(contact)
+	view := render.NewView(events, contact, trigger, throttled, sender.FrontURI)
+	header, err := renderer.Render("header", view)
+	if err != nil {
+		return nil, err
+	}
+	summary, err := renderer.Render("summary", view)
+	if err != nil {
+		return nil, err
+	}
+	footer, err := renderer.Render("footer", view)
+	if err != nil {
+		return nil, err
+	}
+	tail := fmt.Sprintf("\n\n%s\n", summary)
+	if footer != "" {
+		tail += fmt.Sprintf("%s\n", footer)
+	}
 	if throttled {
-		message.WriteString("\nPlease, fix your system or tune this trigger to generate less events.")
+		throttledText, err := renderer.Render("throttled", view)
+		if err != nil {
+			return nil, err
+		}
+		tail += fmt.Sprintf("\n%s", throttledText)
 	}
 
-	log.Debugf("Calling telegram api with chat_id %s and message body %s", contact.Value, message.String())
+	linesLimit := telegramMessageLimit - len(header) - len(tail) - partReserve
+	var bodies []*bytes.Buffer
+	body := &bytes.Buffer{}
+	for i, event := range events {
+		event.Metric = truncateEscaped(event.Metric, maxFieldLength)
+		event.Message = truncateEscaped(event.Message, maxFieldLength)
+		line, err := renderer.Render("event", event)
+		if err != nil {
+			return nil, err
+		}
+		line = "\n" + line
+		if body.Len()+len(line) > linesLimit {
+			if len(bodies)+1 >= sender.MaxParts {
+				more, err := renderer.Render("more", len(events)-i)
+				if err != nil {
+					return nil, err
+				}
+				body.WriteString(fmt.Sprintf("\n\n%s", more))
+				break
+			}
+			bodies = append(bodies, body)
+			body = &bytes.Buffer{}
+		}
+		body.WriteString(line)
+	}
+	bodies = append(bodies, body)
 
-	if err := api.Talk(contact.Value, message.String()); err != nil {
-		return fmt.Errorf("Failed to send message to telegram contact %s: %s. ", contact.Value, err)
+	parts := make([]string, 0, len(bodies))
+	for i, body := range bodies {
+		part := header
+		if len(bodies) > 1 {
+			part = fmt.Sprintf("%s (%d/%d)", header, i+1, len(bodies))
+		}
+		part += "\n" + body.String()
+		if i == len(bodies)-1 {
+			part += tail
+		}
+		parts = append(parts, part)
 	}
-	return nil
+	return parts, nil
+}
 
+// truncateEscaped cuts text by runes so that it takes no more than limit bytes when escaped by html template function.
+// Escaping makes text up to five times longer, so text is measured after escaping
+func truncateEscaped(text string, limit int) string {
+	length := 0
+	for i, r := range text {
+		length += len(template.HTMLEscapeString(string(r)))
+		if length > limit {
+			return text[:i]
+		}
+	}
+	return text
 }
@@ -1,6 +1,7 @@
 package tests
 
 import (
+	"context"
 	"sync"
 
 	"github.com/moira-alert/notifier"
@@ -15,7 +16,7 @@ func (sender *adminSender) Init(senderSettings map[string]string, logger notifie
 	return nil
 }
 
-func (sender *adminSender) SendEvents(events notifier.EventsData, contact notifier.ContactData, trigger notifier.TriggerData, throttled bool) error {
+func (sender *adminSender) SendEvents(ctx context.Context, events notifier.EventsData, contact notifier.ContactData, trigger notifier.TriggerData, throttled bool) error {
 	sender.mutex.Lock()
 	sender.lastEvents = events
 	sender.mutex.Unlock()
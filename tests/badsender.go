@@ -1,6 +1,7 @@
 package tests
 
 import (
+	"context"
 	"fmt"
 	"time"
 
@@ -15,7 +16,7 @@ func (sender *badSender) Init(senderSettings map[string]string, logger notifier.
 }
 
 //SendEvents implements Sender interface to test notifications failure
-func (sender *badSender) SendEvents(events notifier.EventsData, contact notifier.ContactData, trigger notifier.TriggerData, throttled bool) error {
+func (sender *badSender) SendEvents(ctx context.Context, events notifier.EventsData, contact notifier.ContactData, trigger notifier.TriggerData, throttled bool) error {
 	if contact.Value == "failed@example.com" {
 		return fmt.Errorf("I can't send notifications by design")
 	}
@@ -30,7 +31,24 @@ func (sender *timeoutSender) Init(senderSettings map[string]string, logger notif
 }
 
 //SendEvents implements Sender interface to test notifications timeout
-func (sender *timeoutSender) SendEvents(events notifier.EventsData, contact notifier.ContactData, trigger notifier.TriggerData, throttled bool) error {
-	time.Sleep(20 * time.Millisecond)
+func (sender *timeoutSender) SendEvents(ctx context.Context, events notifier.EventsData, contact notifier.ContactData, trigger notifier.TriggerData, throttled bool) error {
+	select {
+	case <-time.After(20 * time.Millisecond):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+type hungSender struct {
+}
+
+func (sender *hungSender) Init(senderSettings map[string]string, logger notifier.Logger) error {
 	return nil
 }
+
+//SendEvents implements Sender interface to test sender waiting for answer until delivery deadline
+func (sender *hungSender) SendEvents(ctx context.Context, events notifier.EventsData, contact notifier.ContactData, trigger notifier.TriggerData, throttled bool) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
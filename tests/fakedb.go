@@ -47,6 +47,11 @@ var contacts = []notifier.ContactData{
 		Type:  "slack",
 		Value: "#devops",
 	},
+	{
+		ID:    "ContactID-000000000000009",
+		Type:  "pager",
+		Value: "hung pager",
+	},
 }
 
 var triggers = []notifier.TriggerData{
@@ -272,6 +277,13 @@ var subscriptions = []notifier.SubscriptionData{
 		Contacts:          []string{contacts[0].ID},
 		ThrottlingEnabled: false,
 	},
+	{
+		ID:                "subscriptionID-00000000000014",
+		Enabled:           false,
+		Tags:              []string{"test-tag-pager"},
+		Contacts:          []string{contacts[8].ID},
+		ThrottlingEnabled: true,
+	},
 }
 
 type testDatabase struct {
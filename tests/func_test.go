@@ -3,6 +3,8 @@
 package tests
 
 import (
+	"context"
+
 	"github.com/moira-alert/notifier"
 	"github.com/moira-alert/notifier/mail"
 
@@ -49,7 +51,7 @@ var _ = Describe("NotifierFunctions", func() {
 			for event := range generateTestEvents(10, triggerData.ID) {
 				events = append(events, *event)
 			}
-			err = sender.SendEvents(events, contactData, triggerData, true)
+			err = sender.SendEvents(context.Background(), events, contactData, triggerData, true)
 		})
 
 		It("Should succeed", func() {
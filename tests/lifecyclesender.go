@@ -0,0 +1,52 @@
+package tests
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/moira-alert/notifier"
+)
+
+// senderJournal records calls of senders in order they were made
+type senderJournal struct {
+	mutex   sync.Mutex
+	entries []string
+}
+
+func (journal *senderJournal) add(entry string) {
+	journal.mutex.Lock()
+	defer journal.mutex.Unlock()
+	journal.entries = append(journal.entries, entry)
+}
+
+func (journal *senderJournal) get() []string {
+	journal.mutex.Lock()
+	defer journal.mutex.Unlock()
+	return append([]string(nil), journal.entries...)
+}
+
+// lifecycleSender records initialization and closing with value of its settings,
+// it fails to initialize with value "broken"
+type lifecycleSender struct {
+	journal *senderJournal
+	value   string
+}
+
+func (sender *lifecycleSender) Init(senderSettings map[string]string, logger notifier.Logger) error {
+	sender.value = senderSettings["value"]
+	sender.journal.add(fmt.Sprintf("init %s", sender.value))
+	if sender.value == "broken" {
+		return fmt.Errorf("broken settings")
+	}
+	return nil
+}
+
+func (sender *lifecycleSender) SendEvents(ctx context.Context, events notifier.EventsData, contact notifier.ContactData, trigger notifier.TriggerData, throttled bool) error {
+	return nil
+}
+
+func (sender *lifecycleSender) Close() error {
+	sender.journal.add(fmt.Sprintf("close %s", sender.value))
+	return nil
+}
@@ -1,9 +1,31 @@
 package tests
 
 import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
 	"flag"
 	"fmt"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -13,6 +35,13 @@ import (
 
 	"github.com/moira-alert/notifier"
 	"github.com/moira-alert/notifier/mail"
+	"github.com/moira-alert/notifier/pushover"
+	"github.com/moira-alert/notifier/render"
+	"github.com/moira-alert/notifier/script"
+	"github.com/moira-alert/notifier/slack"
+	"github.com/moira-alert/notifier/sms"
+	"github.com/moira-alert/notifier/telegram"
+	"github.com/moira-alert/notifier/twilio"
 
 	"github.com/garyburd/redigo/redis"
 	"github.com/gmlexx/redigomock"
@@ -20,6 +49,7 @@ import (
 	"github.com/onsi/ginkgo/reporters"
 	. "github.com/onsi/gomega"
 	"github.com/op/go-logging"
+	"github.com/rcrowley/go-metrics"
 )
 
 var (
@@ -53,6 +83,7 @@ var _ = Describe("Notifier", func() {
 			Notifier: notifier.NotifierConfig{
 				SenderTimeout:    "0s10ms",
 				ResendingTimeout: "24:00",
+				HTTPListen:       "127.0.0.1:0",
 				SelfState: notifier.SelfStateConfig{
 					Enabled: "true",
 					Contacts: []map[string]string{
@@ -240,6 +271,70 @@ var _ = Describe("Notifier", func() {
 		})
 	})
 
+	Context("Senders reload", func() {
+		var created []string
+		BeforeEach(func() {
+			created = make([]string, 0)
+			err = notifier.ReloadSenders([]map[string]string{
+				{"type": "email"},
+				{"type": "admin-mail"},
+			}, func(senderSettings map[string]string) (notifier.Sender, error) {
+				created = append(created, senderSettings["type"])
+				return &adminSender{}, nil
+			})
+		})
+
+		It("should register only new senders", func() {
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(created).To(Equal([]string{"admin-mail"}))
+			Expect(notifier.CheckSelfStateMonitorSettings()).ShouldNot(HaveOccurred())
+		})
+
+		It("should stop senders missing in settings", func() {
+			assertProcessEvent(notifier.EventData{
+				State:          "TEST",
+				SubscriptionID: subscriptions[5].ID,
+			}, false)
+			err = notifier.ProcessScheduledNotifications()
+			Expect(err).ShouldNot(HaveOccurred())
+			notifications, err := testDb.getNotifications(0, -1)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(len(notifications)).To(Equal(1))
+			Expect(notifications[0].SendFail).To(Equal(1))
+		})
+
+		Context("When sender settings are changed", func() {
+			var journal *senderJournal
+			var newSender func(senderSettings map[string]string) (notifier.Sender, error)
+			reload := func(value string) error {
+				return notifier.ReloadSenders([]map[string]string{
+					{"type": "email"},
+					{"type": "admin-mail"},
+					{"type": "lifecycle", "value": value},
+				}, newSender)
+			}
+			BeforeEach(func() {
+				journal = &senderJournal{}
+				newSender = func(senderSettings map[string]string) (notifier.Sender, error) {
+					return &lifecycleSender{journal: journal}, nil
+				}
+				Expect(reload("first")).Should(Succeed())
+			})
+
+			It("should close previous sender before new one is initialized", func() {
+				Expect(reload("second")).Should(Succeed())
+				Expect(journal.get()).To(Equal([]string{"init first", "close first", "init second"}))
+			})
+
+			It("should restore previous sender when new one fails to initialize", func() {
+				Expect(reload("broken")).ShouldNot(Succeed())
+				Expect(journal.get()).To(Equal([]string{"init first", "close first", "init broken", "init first"}))
+				Expect(reload("first")).Should(Succeed())
+				Expect(journal.get()).To(HaveLen(4))
+			})
+		})
+	})
+
 	Context("When one invalid event arrives", func() {
 		BeforeEach(func() {
 			event = notifier.EventData{
@@ -272,6 +367,97 @@ var _ = Describe("Notifier", func() {
 			})
 		})
 
+		Context("When contact has no timezone", func() {
+			BeforeEach(func() {
+				contact := contacts[2]
+				contact.DateFormat = "2006-01-02"
+				err = testDb.conn.SetContact(&contact)
+				Expect(err).ShouldNot(HaveOccurred())
+				err = notifier.ProcessEvent(notifier.EventData{
+					State:          "TEST",
+					SubscriptionID: subscriptions[2].ID,
+				})
+				Expect(err).ShouldNot(HaveOccurred())
+			})
+
+			It("should apply timezone offset of subscription schedule", func() {
+				notification, err := testDb.getSingleNotification()
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(notification.Contact.Timezone).To(Equal("Etc/GMT-5"))
+				Expect(notification.Contact.DateFormat).To(Equal("2006-01-02"))
+				location, err := time.LoadLocation(notification.Contact.Timezone)
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(time.Unix(1441188915, 0).In(location).Format("15:04")).To(Equal("15:15"))
+			})
+		})
+
+		Context("When contact has unknown timezone", func() {
+			BeforeEach(func() {
+				contact := contacts[2]
+				contact.Timezone = "Europe/Nowhere"
+				err = testDb.conn.SetContact(&contact)
+				Expect(err).ShouldNot(HaveOccurred())
+				err = notifier.ProcessEvent(notifier.EventData{
+					State:          "TEST",
+					SubscriptionID: subscriptions[2].ID,
+				})
+				Expect(err).ShouldNot(HaveOccurred())
+			})
+
+			It("should replace it with timezone offset of subscription schedule", func() {
+				notification, err := testDb.getSingleNotification()
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(notification.Contact.Timezone).To(Equal("Etc/GMT-5"))
+			})
+		})
+
+		Context("When contact has timezone", func() {
+			BeforeEach(func() {
+				contact := contacts[2]
+				contact.Timezone = "Europe/Berlin"
+				err = testDb.conn.SetContact(&contact)
+				Expect(err).ShouldNot(HaveOccurred())
+				err = notifier.ProcessEvent(notifier.EventData{
+					State:          "TEST",
+					SubscriptionID: subscriptions[2].ID,
+				})
+				Expect(err).ShouldNot(HaveOccurred())
+			})
+
+			It("should keep contact timezone", func() {
+				notification, err := testDb.getSingleNotification()
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(notification.Contact.Timezone).To(Equal("Europe/Berlin"))
+			})
+		})
+
+		Context("When contact is invalid for its sender", func() {
+			BeforeEach(func() {
+				err = notifier.RegisterSender(map[string]string{
+					"type":      "email",
+					"mail_from": "test@notifier",
+					"smtp_host": "127.0.0.1",
+					"smtp_port": "1",
+				}, &mail.Sender{})
+				Expect(err).ShouldNot(HaveOccurred())
+				contact := contacts[0]
+				contact.Value = "not an address"
+				err = testDb.conn.SetContact(&contact)
+				Expect(err).ShouldNot(HaveOccurred())
+				err = notifier.ProcessEvent(notifier.EventData{
+					State:          "TEST",
+					SubscriptionID: subscriptions[4].ID,
+				})
+				Expect(err).ShouldNot(HaveOccurred())
+			})
+
+			It("should not schedule notification", func() {
+				notifications, err := testDb.getNotifications(0, -1)
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(notifications).To(BeEmpty())
+			})
+		})
+
 		Context("When events is TEST and one of them has unknown contact type", func() {
 			BeforeEach(func() {
 				assertProcessEvent(notifier.EventData{
@@ -348,6 +534,74 @@ var _ = Describe("Notifier", func() {
 			})
 		})
 
+		Context("When sender does not finish before delivery deadline", func() {
+			BeforeEach(func() {
+				notifier.RegisterSender(map[string]string{
+					"type":             "pager",
+					"delivery_timeout": "0s10ms",
+				}, &hungSender{})
+				assertProcessEvent(notifier.EventData{
+					State:          "TEST",
+					SubscriptionID: subscriptions[13].ID,
+				}, false)
+				err = notifier.ProcessScheduledNotifications()
+				Expect(err).ShouldNot(HaveOccurred())
+				stopSenders()
+			})
+
+			It("notification should be rescheduled after 1 min", func() {
+				notifications, err := testDb.getNotifications(0, -1)
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(len(notifications)).To(Equal(1))
+				Expect(notifications[0].SendFail).To(Equal(1))
+				Expect(notifications[0].Contact.ID).To(Equal(contacts[8].ID))
+				Expect(notifications[0].Timestamp).To(Equal(notifier.GetNow().Add(time.Minute).Unix()))
+			})
+		})
+
+		Context("When script does not finish before delivery deadline", func() {
+			var scriptFile string
+			var timeouts int64
+			var elapsed time.Duration
+			BeforeEach(func() {
+				file, err := ioutil.TempFile("", "script")
+				Expect(err).ShouldNot(HaveOccurred())
+				file.WriteString("#!/bin/sh\nsleep 5\n")
+				file.Close()
+				scriptFile = file.Name()
+				Expect(os.Chmod(scriptFile, 0755)).Should(Succeed())
+				err = notifier.RegisterSender(map[string]string{
+					"type":             "script",
+					"name":             "pager",
+					"exec":             scriptFile,
+					"delivery_timeout": "0s50ms",
+				}, &script.Sender{})
+				Expect(err).ShouldNot(HaveOccurred())
+				timeouts = metrics.GetOrRegisterMeter("pager.sends_timeout", metrics.DefaultRegistry).Count()
+				assertProcessEvent(notifier.EventData{
+					State:          "TEST",
+					SubscriptionID: subscriptions[13].ID,
+				}, false)
+				started := time.Now()
+				err = notifier.ProcessScheduledNotifications()
+				Expect(err).ShouldNot(HaveOccurred())
+				stopSenders()
+				elapsed = time.Since(started)
+			})
+			AfterEach(func() {
+				os.Remove(scriptFile)
+			})
+
+			It("should kill script and report sending timeout", func() {
+				Expect(elapsed).To(BeNumerically("<", 2*time.Second))
+				Expect(metrics.GetOrRegisterMeter("pager.sends_timeout", metrics.DefaultRegistry).Count()).To(Equal(timeouts + 1))
+				notifications, err := testDb.getNotifications(0, -1)
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(len(notifications)).To(Equal(1))
+				Expect(notifications[0].SendFail).To(Equal(1))
+			})
+		})
+
 		Context("When nobody is subscribed", func() {
 			BeforeEach(func() {
 				event = notifier.EventData{
@@ -592,24 +846,1439 @@ var _ = Describe("Notifier", func() {
 			var m *gomail.Message
 			BeforeEach(func() {
 				sender = mail.Sender{
-					FrontURI: "http://localhost",
-					From:     "test@notifier",
-					SMTPhost: "localhost",
-					SMTPport: 25,
+					FrontURI:  "http://localhost",
+					From:      "test@notifier",
+					SMTPhost:  "localhost",
+					SMTPport:  25,
+					MaxEvents: 5,
 				}
 				sender.SetLogger(log)
 				events := make([]notifier.EventData, 0, 10)
 				for event := range generateTestEvents(10, triggers[0].ID) {
 					events = append(events, *event)
 				}
-				m = sender.MakeMessage(events, contacts[0], triggers[0], true)
+				m, err = sender.MakeMessage(events, contacts[0], triggers[0], true)
 			})
 
 			It("make message with right headers", func() {
+				Expect(err).ShouldNot(HaveOccurred())
 				Expect(m.GetHeader("From")[0]).To(Equal(sender.From))
 				Expect(m.GetHeader("To")[0]).To(Equal(contacts[0].Value))
 				m.WriteTo(os.Stdout)
 			})
+
+			It("make message for several recipients with cc and bcc", func() {
+				contact := contacts[0]
+				contact.Value = "mail1@example.com; Team <team@example.com>"
+				contact.Settings = map[string]string{"cc": "lead@example.com", "bcc": "audit@example.com"}
+				Expect(sender.ValidateContact(contact)).Should(Succeed())
+				m, err = sender.MakeMessage(nil, contact, triggers[0], false)
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(m.GetHeader("To")).To(Equal([]string{"mail1@example.com", `"Team" <team@example.com>`}))
+				Expect(m.GetHeader("Cc")).To(Equal([]string{"lead@example.com"}))
+				Expect(m.GetHeader("Bcc")).To(Equal([]string{"audit@example.com"}))
+
+				contact.Settings["cc"] = "lead@"
+				Expect(sender.ValidateContact(contact)).ShouldNot(Succeed())
+			})
+
+			It("make message with plain text and compact html parts", func() {
+				Expect(err).ShouldNot(HaveOccurred())
+				var buffer bytes.Buffer
+				_, err = m.WriteTo(&buffer)
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(buffer.String()).To(ContainSubstring("Content-Type: text/plain"))
+				Expect(buffer.String()).To(ContainSubstring("Content-Type: text/html"))
+				Expect(buffer.String()).To(ContainSubstring("...and 5 more events."))
+			})
+
+			It("sign message with DKIM private key", func() {
+				Expect(err).ShouldNot(HaveOccurred())
+				key, err := rsa.GenerateKey(rand.Reader, 1024)
+				Expect(err).ShouldNot(HaveOccurred())
+				keyFile, err := ioutil.TempFile("", "dkim")
+				Expect(err).ShouldNot(HaveOccurred())
+				defer os.Remove(keyFile.Name())
+				err = pem.Encode(keyFile, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+				Expect(err).ShouldNot(HaveOccurred())
+				keyFile.Close()
+
+				_, err = mail.NewDKIMSigner("notifier", "", keyFile.Name())
+				Expect(err).Should(HaveOccurred())
+				signer, err := mail.NewDKIMSigner("notifier", "moira", keyFile.Name())
+				Expect(err).ShouldNot(HaveOccurred())
+				signed, err := signer.Sign(m)
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(string(signed)).To(HavePrefix("DKIM-Signature: v=1;"))
+				Expect(string(signed)).To(ContainSubstring("d=notifier;\r\n\ts=moira;"))
+			})
+
+			It("make message with inline chart", func() {
+				Expect(err).ShouldNot(HaveOccurred())
+				var buffer bytes.Buffer
+				_, err = m.WriteTo(&buffer)
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(buffer.String()).To(ContainSubstring("Content-ID: <chart.png>"))
+				Expect(buffer.String()).To(ContainSubstring("Content-Type: image/png"))
+			})
+		})
+	})
+
+	Context("DKIM signature", func() {
+		var keyFile string
+		var publicKey *rsa.PublicKey
+		BeforeEach(func() {
+			keyFile, publicKey, err = writeRFC6376Key()
+			Expect(err).ShouldNot(HaveOccurred())
+		})
+		AfterEach(func() {
+			os.Remove(keyFile)
+		})
+
+		It("should sign example message of RFC 6376", func() {
+			signer, err := mail.NewDKIMSigner("example.com", "brisbane", keyFile)
+			Expect(err).ShouldNot(HaveOccurred())
+			signed, err := signer.Sign(bytes.NewBufferString(rfc6376Message))
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(string(signed)).To(HaveSuffix("\r\n" + rfc6376Message))
+
+			tags := dkimTags(signed)
+			Expect(tags["bh"]).To(Equal(rfc6376BodyHash))
+			Expect(tags["h"]).To(Equal("from:to:subject:date:message-id"))
+			err = verifyDKIM(signed, "from:Joe SixPack <joe@football.example.com>\r\n"+
+				"to:Suzie Q <suzie@shopping.example.net>\r\n"+
+				"subject:Is dinner ready?\r\n"+
+				"date:Fri, 11 Jul 2003 21:00:37 -0700 (PDT)\r\n"+
+				"message-id:<20030712040037.46341.5F8J@football.example.com>\r\n", publicKey)
+			Expect(err).ShouldNot(HaveOccurred())
+		})
+
+		It("should canonicalize message as in relaxed examples of RFC 6376", func() {
+			signer, err := mail.NewDKIMSigner("example.com", "brisbane", keyFile)
+			Expect(err).ShouldNot(HaveOccurred())
+			// RFC 6376 section 3.4.5 with signed names of header fields, the bottom Subject is signed
+			message := "Subject: replaced\r\nFrom: X\r\nSubject : Y\t\r\n\tZ  \r\n\r\n C \r\nD \t E\r\n\r\n\r\n"
+			signed, err := signer.Sign(bytes.NewBufferString(message))
+			Expect(err).ShouldNot(HaveOccurred())
+
+			tags := dkimTags(signed)
+			bodyHash := sha256.Sum256([]byte(" C\r\nD E\r\n"))
+			Expect(tags["bh"]).To(Equal(base64.StdEncoding.EncodeToString(bodyHash[:])))
+			Expect(tags["h"]).To(Equal("from:subject"))
+			Expect(verifyDKIM(signed, "from:X\r\nsubject:Y Z\r\n", publicKey)).Should(Succeed())
+		})
+	})
+
+	Context("Mail sender SMTP connections", func() {
+		var server *fakeSMTPServer
+		var sender *mail.Sender
+		var events notifier.EventsData
+		BeforeEach(func() {
+			server, err = startFakeSMTPServer()
+			Expect(err).ShouldNot(HaveOccurred())
+			sender = &mail.Sender{}
+			for event := range generateTestEvents(2, triggers[0].ID) {
+				events = append(events, *event)
+			}
+		})
+		AfterEach(func() {
+			sender.Close()
+			server.stop()
+		})
+
+		It("should not fail init when SMTP server is unavailable", func() {
+			server.stop()
+			err = sender.Init(map[string]string{
+				"type":      "mail",
+				"mail_from": "test@notifier",
+				"smtp_host": "127.0.0.1",
+				"smtp_port": fmt.Sprintf("%d", server.port()),
+			}, log)
+			Expect(err).ShouldNot(HaveOccurred())
+		})
+
+		It("should reuse SMTP connection", func() {
+			err = sender.Init(map[string]string{
+				"type":      "mail",
+				"mail_from": "test@notifier",
+				"smtp_host": "127.0.0.1",
+				"smtp_port": fmt.Sprintf("%d", server.port()),
+			}, log)
+			Expect(err).ShouldNot(HaveOccurred())
+			Eventually(func() int {
+				connections, _ := server.stats()
+				return connections
+			}).Should(Equal(1))
+			for i := 0; i < 2; i++ {
+				err = sender.SendEvents(context.Background(), events, contacts[0], triggers[0], false)
+				Expect(err).ShouldNot(HaveOccurred())
+			}
+			connections, messages := server.stats()
+			Expect(connections).To(Equal(1))
+			Expect(len(messages)).To(Equal(2))
+		})
+
+		It("should reconnect when pooled SMTP connection is closed by server", func() {
+			err = sender.Init(map[string]string{
+				"type":      "mail",
+				"mail_from": "test@notifier",
+				"smtp_host": "127.0.0.1",
+				"smtp_port": fmt.Sprintf("%d", server.port()),
+			}, log)
+			Expect(err).ShouldNot(HaveOccurred())
+			Eventually(func() int {
+				connections, _ := server.stats()
+				return connections
+			}).Should(Equal(1))
+			err = sender.SendEvents(context.Background(), events, contacts[0], triggers[0], false)
+			Expect(err).ShouldNot(HaveOccurred())
+			server.disconnect()
+			err = sender.SendEvents(context.Background(), events, contacts[0], triggers[0], false)
+			Expect(err).ShouldNot(HaveOccurred())
+			connections, messages := server.stats()
+			Expect(connections).To(Equal(2))
+			Expect(len(messages)).To(Equal(2))
+		})
+
+		It("should not send message twice when connection fails after DATA", func() {
+			err = sender.Init(map[string]string{
+				"type":      "mail",
+				"mail_from": "test@notifier",
+				"smtp_host": "127.0.0.1",
+				"smtp_port": fmt.Sprintf("%d", server.port()),
+			}, log)
+			Expect(err).ShouldNot(HaveOccurred())
+			Eventually(func() int {
+				connections, _ := server.stats()
+				return connections
+			}).Should(Equal(1))
+			err = sender.SendEvents(context.Background(), events, contacts[0], triggers[0], false)
+			Expect(err).ShouldNot(HaveOccurred())
+			server.setDropAfterData(true)
+			err = sender.SendEvents(context.Background(), events, contacts[0], triggers[0], false)
+			Expect(err).Should(HaveOccurred())
+			connections, messages := server.stats()
+			Expect(connections).To(Equal(1))
+			Expect(len(messages)).To(Equal(2))
+		})
+
+		It("should send mails of trigger incident in one thread until the whole trigger is OK", func() {
+			sender = &mail.Sender{DB: testDb.conn}
+			err = sender.Init(map[string]string{
+				"type":      "mail",
+				"mail_from": "test@notifier",
+				"smtp_host": "127.0.0.1",
+				"smtp_port": fmt.Sprintf("%d", server.port()),
+			}, log)
+			Expect(err).ShouldNot(HaveOccurred())
+			header := func(message, name string) string {
+				match := regexp.MustCompile(`(?m)^` + name + `: (.*?)\r?$`).FindStringSubmatch(message)
+				if match == nil {
+					return ""
+				}
+				return match[1]
+			}
+			send := func(state string) {
+				events := notifier.EventsData{{Metric: "test.metric", State: state, TriggerID: triggers[0].ID}}
+				Expect(sender.SendEvents(context.Background(), events, contacts[0], triggers[0], false)).Should(Succeed())
+			}
+
+			setTriggerState(triggers[0].ID, "ERROR")
+			send("ERROR")
+			send("ERROR")
+			send("OK")
+			setTriggerState(triggers[0].ID, "OK")
+			send("OK")
+			send("ERROR")
+
+			_, messages := server.stats()
+			Expect(messages).To(HaveLen(5))
+			first := header(messages[0], "Message-ID")
+			Expect(first).NotTo(BeEmpty())
+			Expect(header(messages[0], "In-Reply-To")).To(BeEmpty())
+			for _, message := range messages[1:4] {
+				Expect(header(message, "In-Reply-To")).To(Equal(first))
+				Expect(header(message, "References")).To(Equal(first))
+			}
+			Expect(header(messages[4], "In-Reply-To")).To(BeEmpty())
+		})
+
+		It("should stop waiting for SMTP server when delivery deadline is exceeded", func() {
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			Expect(err).ShouldNot(HaveOccurred())
+			defer listener.Close()
+			sender = &mail.Sender{
+				From:     "test@notifier",
+				SMTPhost: "127.0.0.1",
+				SMTPport: int64(listener.Addr().(*net.TCPAddr).Port),
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+			started := time.Now()
+			err = sender.SendEvents(ctx, events, contacts[0], triggers[0], false)
+			Expect(err).Should(HaveOccurred())
+			Expect(time.Since(started)).To(BeNumerically("<", time.Second))
+		})
+	})
+
+	Context("Slack sender", func() {
+		var server *fakeSlackServer
+		var sender *slack.Sender
+		BeforeEach(func() {
+			server = startFakeSlackServer()
+			sender = &slack.Sender{DB: testDb.conn}
+			err = sender.Init(map[string]string{
+				"type":                 "slack",
+				"api_token":            "xoxb-test",
+				"api_url":              server.URL,
+				"webhook_allowed_urls": server.URL + "/webhook",
+			}, log)
+			Expect(err).ShouldNot(HaveOccurred())
+		})
+		AfterEach(func() {
+			server.Close()
+		})
+
+		It("should update posted message when trigger returns to OK", func() {
+			events := notifier.EventsData{{Metric: "test.metric", State: "ERROR", OldState: "OK", TriggerID: triggers[0].ID}}
+			err = sender.SendEvents(context.Background(), events, contacts[7], triggers[0], false)
+			Expect(err).ShouldNot(HaveOccurred())
+			setTriggerState(triggers[0].ID, "OK")
+			events = notifier.EventsData{{Metric: "test.metric", State: "OK", OldState: "ERROR", TriggerID: triggers[0].ID}}
+			err = sender.SendEvents(context.Background(), events, contacts[7], triggers[0], false)
+			Expect(err).ShouldNot(HaveOccurred())
+
+			calls := server.calls()
+			Expect(len(calls)).To(Equal(2))
+			Expect(calls[0].Method).To(Equal("chat.postMessage"))
+			Expect(calls[0].Body["attachments"].([]interface{})[0].(map[string]interface{})["color"]).To(Equal("#d00000"))
+			Expect(calls[1].Method).To(Equal("chat.update"))
+			Expect(calls[1].Body["channel"]).To(Equal("C0000000001"))
+			Expect(calls[1].Body["ts"]).To(Equal("1500000000.000001"))
+			Expect(calls[1].Body["attachments"].([]interface{})[0].(map[string]interface{})["color"]).To(Equal("#36a64f"))
+		})
+
+		It("should reply in trigger thread until trigger returns to OK", func() {
+			sender.Threads = true
+			sender.BroadcastErrors = true
+			for _, state := range []string{"WARN", "ERROR", "OK", "WARN"} {
+				setTriggerState(triggers[0].ID, state)
+				events := notifier.EventsData{{Metric: "test.metric", State: state, TriggerID: triggers[0].ID}}
+				err = sender.SendEvents(context.Background(), events, contacts[7], triggers[0], false)
+				Expect(err).ShouldNot(HaveOccurred())
+			}
+
+			calls := server.calls()
+			Expect(len(calls)).To(Equal(4))
+			Expect(calls[0].Body["thread_ts"]).To(BeNil())
+			Expect(calls[1].Body["thread_ts"]).To(Equal("1500000000.000001"))
+			Expect(calls[1].Body["reply_broadcast"]).To(Equal(true))
+			Expect(calls[2].Body["thread_ts"]).To(Equal("1500000000.000001"))
+			Expect(calls[2].Body["reply_broadcast"]).To(BeNil())
+			Expect(calls[3].Body["thread_ts"]).To(BeNil())
+		})
+
+		It("should keep trigger thread when some metrics of trigger are not OK", func() {
+			sender.Threads = true
+			setTriggerState(triggers[0].ID, "ERROR")
+			for _, state := range []string{"ERROR", "OK", "ERROR"} {
+				events := notifier.EventsData{{Metric: "test.metric", State: state, TriggerID: triggers[0].ID}}
+				err = sender.SendEvents(context.Background(), events, contacts[7], triggers[0], false)
+				Expect(err).ShouldNot(HaveOccurred())
+			}
+
+			calls := server.calls()
+			Expect(len(calls)).To(Equal(3))
+			Expect(calls[0].Body["thread_ts"]).To(BeNil())
+			Expect(calls[1].Body["thread_ts"]).To(Equal("1500000000.000001"))
+			Expect(calls[2].Body["thread_ts"]).To(Equal("1500000000.000001"))
+		})
+
+		It("should keep separate trigger threads of contacts with the same channel", func() {
+			sender.Threads = true
+			other := contacts[7]
+			other.ID = "SlackContactWithTheSameChannel"
+			events := notifier.EventsData{{Metric: "test.metric", State: "ERROR", TriggerID: triggers[0].ID}}
+			for _, contact := range []notifier.ContactData{contacts[7], other, other} {
+				err = sender.SendEvents(context.Background(), events, contact, triggers[0], false)
+				Expect(err).ShouldNot(HaveOccurred())
+			}
+
+			calls := server.calls()
+			Expect(len(calls)).To(Equal(3))
+			Expect(calls[0].Body["thread_ts"]).To(BeNil())
+			Expect(calls[1].Body["thread_ts"]).To(BeNil())
+			Expect(calls[2].Body["thread_ts"]).To(Equal("1500000000.000002"))
+		})
+
+		It("should accept only slack and allowed incoming webhooks", func() {
+			for _, value := range []string{
+				"#general",
+				"https://hooks.slack.com/services/T00000000/B00000000/XXXXXXXX",
+				server.URL + "/webhook",
+			} {
+				contact := contacts[7]
+				contact.Value = value
+				Expect(sender.ValidateContact(contact)).Should(Succeed(), value)
+			}
+			for _, value := range []string{
+				"http://hooks.slack.com/services/T00000000/B00000000/XXXXXXXX",
+				"https://hooks.slack.com.example.com/services/T00000000/B00000000/XXXXXXXX",
+				"https://user@hooks.slack.com/services/T00000000/B00000000/XXXXXXXX",
+				"http://169.254.169.254/latest/meta-data/",
+				server.URL + "/webhooks",
+				server.URL + "/chat.postMessage",
+			} {
+				contact := contacts[7]
+				contact.Value = value
+				Expect(sender.ValidateContact(contact)).ShouldNot(Succeed(), value)
+			}
+
+			contact := contacts[7]
+			contact.Value = server.URL + "/api/chat.postMessage"
+			events := notifier.EventsData{{Metric: "test.metric", State: "ERROR", TriggerID: triggers[0].ID}}
+			err = sender.SendEvents(context.Background(), events, contact, triggers[0], false)
+			Expect(err).Should(HaveOccurred())
+			Expect(server.calls()).To(BeEmpty())
+		})
+
+		It("should mention users configured for package state", func() {
+			contact := contacts[7]
+			contact.Settings = map[string]string{"mention_ERROR": "@oncall, @here @S0123456789", "mention_NODATA": "@here"}
+			for _, state := range []string{"ERROR", "OK"} {
+				events := notifier.EventsData{{Metric: "test.metric", State: state, TriggerID: triggers[1].ID}}
+				err = sender.SendEvents(context.Background(), events, contact, triggers[1], false)
+				Expect(err).ShouldNot(HaveOccurred())
+			}
+
+			calls := server.calls()
+			Expect(calls[0].Body["text"]).To(HavePrefix("@oncall <!here> <!subteam^S0123456789> "))
+			Expect(calls[0].Body["link_names"]).To(Equal(true))
+			Expect(calls[1].Body["text"]).NotTo(ContainSubstring("here"))
+		})
+
+		It("should post to incoming webhook of contact", func() {
+			contact := contacts[7]
+			contact.Value = server.URL + "/webhook"
+			events := notifier.EventsData{{Metric: "test.metric", State: "ERROR", TriggerID: triggers[0].ID}}
+			for i := 0; i < 2; i++ {
+				err = sender.SendEvents(context.Background(), events, contact, triggers[0], false)
+				Expect(err).ShouldNot(HaveOccurred())
+			}
+
+			calls := server.calls()
+			Expect(len(calls)).To(Equal(2))
+			Expect(calls[1].Method).To(Equal("webhook"))
+			Expect(calls[1].Body["channel"]).To(BeNil())
+			Expect(calls[1].Body["thread_ts"]).To(BeNil())
+		})
+
+		It("should not serve interactivity without http_listen", func() {
+			settings := *testConfig
+			settings.Notifier.HTTPListen = ""
+			notifier.SetSettings(&settings)
+			defer notifier.SetSettings(testConfig)
+			err = (&slack.Sender{DB: testDb.conn}).Init(map[string]string{
+				"type":           "slack",
+				"api_token":      "xoxb-test",
+				"signing_secret": "secret",
+			}, log)
+			Expect(err).Should(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("http_listen"))
+		})
+
+		It("should not reveal incoming webhook url in error", func() {
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			Expect(err).ShouldNot(HaveOccurred())
+			listener.Close()
+			webhooks := fmt.Sprintf("http://%s/services/", listener.Addr().String())
+			err = sender.Init(map[string]string{
+				"type":                 "slack",
+				"api_token":            "xoxb-test",
+				"webhook_allowed_urls": webhooks,
+			}, log)
+			Expect(err).ShouldNot(HaveOccurred())
+			contact := contacts[7]
+			contact.Value = webhooks + "T00000000/B00000000/webhooksecret"
+			events := notifier.EventsData{{Metric: "test.metric", State: "ERROR", TriggerID: triggers[0].ID}}
+			err = sender.SendEvents(context.Background(), events, contact, triggers[0], false)
+			Expect(err).Should(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("connection refused"))
+			Expect(err.Error()).NotTo(ContainSubstring("webhooksecret"))
+		})
+	})
+
+	Context("Slack interactivity", func() {
+		var server *fakeSlackServer
+		var sender *slack.Sender
+		var listener net.Listener
+		BeforeEach(func() {
+			server = startFakeSlackServer()
+			sender = &slack.Sender{DB: testDb.conn}
+			err = sender.Init(map[string]string{
+				"type":           "slack",
+				"api_token":      "xoxb-test",
+				"api_url":        server.URL,
+				"signing_secret": "secret",
+			}, log)
+			Expect(err).ShouldNot(HaveOccurred())
+			listener, err = notifier.StartHTTPServer("127.0.0.1:0")
+			Expect(err).ShouldNot(HaveOccurred())
+		})
+		AfterEach(func() {
+			sender.Close()
+			listener.Close()
+			server.Close()
+		})
+
+		click := func(actionID, secret string) *http.Response {
+			payload := fmt.Sprintf(`{"type": "block_actions", "user": {"id": "U01", "username": "oncall"}, "response_url": "%s/response", "actions": [{"action_id": "%s", "value": "%s"}]}`, server.URL, actionID, triggers[0].ID)
+			body := url.Values{"payload": {payload}}.Encode()
+			timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+			mac := hmac.New(sha256.New, []byte(secret))
+			mac.Write([]byte("v0:" + timestamp + ":" + body))
+			request, _ := http.NewRequest("POST", fmt.Sprintf("http://%s%s", listener.Addr(), slack.DefaultInteractivityPath), strings.NewReader(body))
+			request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			request.Header.Set("X-Slack-Request-Timestamp", timestamp)
+			request.Header.Set("X-Slack-Signature", "v0="+hex.EncodeToString(mac.Sum(nil)))
+			response, err := http.DefaultClient.Do(request)
+			Expect(err).ShouldNot(HaveOccurred())
+			response.Body.Close()
+			return response
+		}
+
+		It("should add buttons to messages", func() {
+			events := notifier.EventsData{{Metric: "test.metric", State: "ERROR", OldState: "OK", TriggerID: triggers[0].ID}}
+			err = sender.SendEvents(context.Background(), events, contacts[7], triggers[0], false)
+			Expect(err).ShouldNot(HaveOccurred())
+			blocks := server.calls()[0].Body["attachments"].([]interface{})[0].(map[string]interface{})["blocks"].([]interface{})
+			actions := blocks[len(blocks)-1].(map[string]interface{})
+			Expect(actions["type"]).To(Equal("actions"))
+			Expect(len(actions["elements"].([]interface{}))).To(Equal(3))
+		})
+
+		It("should reject requests with invalid signature", func() {
+			response := click("ack", "wrong")
+			Expect(response.StatusCode).To(Equal(http.StatusUnauthorized))
+			muted, err := testDb.conn.IsTriggerMuted(triggers[0].ID)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(muted).To(BeFalse())
+		})
+
+		It("should skip notifications of acknowledged trigger until it returns to OK", func() {
+			response := click("ack", "secret")
+			Expect(response.StatusCode).To(Equal(http.StatusOK))
+			Eventually(server.calls).Should(HaveLen(1))
+			Expect(server.calls()[0].Method).To(Equal("response"))
+			Expect(server.calls()[0].Body["text"]).To(ContainSubstring("<@U01>"))
+
+			event = notifier.EventData{Metric: "generate.event.1", State: "ERROR", OldState: "OK", TriggerID: triggers[0].ID}
+			Expect(notifier.ProcessEvent(event)).ShouldNot(HaveOccurred())
+			notifications, err := testDb.getNotifications(0, -1)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(notifications).To(BeEmpty())
+
+			c := testDb.conn.Pool.Get()
+			c.Do("SET", "moira-metric-last-check:"+triggers[0].ID, `{"state": "OK"}`)
+			c.Close()
+			event = notifier.EventData{Metric: "generate.event.1", State: "OK", OldState: "ERROR", TriggerID: triggers[0].ID}
+			Expect(notifier.ProcessEvent(event)).ShouldNot(HaveOccurred())
+			assertNotificationSent(event, notifier.GetNow(), contacts[0])
+			muted, err := testDb.conn.IsTriggerMuted(triggers[0].ID)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(muted).To(BeFalse())
+		})
+
+		It("should keep acknowledgement when one of trigger metrics recovers", func() {
+			response := click("ack", "secret")
+			Expect(response.StatusCode).To(Equal(http.StatusOK))
+			c := testDb.conn.Pool.Get()
+			c.Do("SET", "moira-metric-last-check:"+triggers[0].ID, `{"state": "ERROR"}`)
+			c.Close()
+
+			event = notifier.EventData{Metric: "generate.event.1", State: "OK", OldState: "ERROR", TriggerID: triggers[0].ID}
+			Expect(notifier.ProcessEvent(event)).ShouldNot(HaveOccurred())
+			muted, err := testDb.conn.IsTriggerMuted(triggers[0].ID)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(muted).To(BeTrue())
+
+			event = notifier.EventData{Metric: "generate.event.2", State: "ERROR", OldState: "WARN", TriggerID: triggers[0].ID}
+			Expect(notifier.ProcessEvent(event)).ShouldNot(HaveOccurred())
+			notifications, err := testDb.getNotifications(0, -1)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(notifications).To(HaveLen(1))
+			Expect(notifications[0].Event.Metric).To(Equal("generate.event.1"))
+		})
+
+		It("should mute trigger on snooze", func() {
+			response := click("snooze", "secret")
+			Expect(response.StatusCode).To(Equal(http.StatusOK))
+			muted, err := testDb.conn.IsTriggerMuted(triggers[0].ID)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(muted).To(BeTrue())
+		})
+	})
+
+	Context("Telegram sender", func() {
+		var server *fakeTelegramServer
+		var sender *telegram.Sender
+		chat := map[string]interface{}{"id": 100, "type": "private", "username": "oncall"}
+		contact := notifier.ContactData{ID: "ContactID-telegram", Type: "telegram", Value: "@oncall", User: "oncall"}
+		BeforeEach(func() {
+			c := testDb.conn.Pool.Get()
+			defer c.Close()
+			subscription := notifier.SubscriptionData{ID: "subscriptionID-telegram", Enabled: true, Tags: triggers[0].Tags, Contacts: []string{contact.ID}}
+			subscriptionString, _ := json.Marshal(subscription)
+			c.Do("SET", "moira-subscription:"+subscription.ID, subscriptionString)
+			c.Do("SADD", "moira-user-subscriptions:oncall", subscription.ID)
+			c.Do("SADD", "moira-tag-triggers:"+triggers[0].Tags[0], triggers[0].ID)
+			c.Do("SET", "moira-metric-last-check:"+triggers[0].ID, `{"state": "ERROR"}`)
+			Expect(testDb.conn.SetContact(&contact)).ShouldNot(HaveOccurred())
+			Expect(testDb.conn.SetUsernameID("telegram", "@oncall", "100")).ShouldNot(HaveOccurred())
+
+			server = startFakeTelegramServer()
+			sender = &telegram.Sender{DB: testDb.conn}
+			err = sender.Init(map[string]string{
+				"type":          "telegram",
+				"api_token":     "123:token",
+				"api_url":       server.URL,
+				"part_interval": "0s1ms",
+				"link_interval": "0s10ms",
+			}, log)
+			Expect(err).ShouldNot(HaveOccurred())
+		})
+		AfterEach(func() {
+			sender.Close()
+			server.Close()
+		})
+
+		It("should split long packages into several messages", func() {
+			events := make(notifier.EventsData, 0, 100)
+			for i := 0; i < 100; i++ {
+				events = append(events, notifier.EventData{
+					Metric:    fmt.Sprintf("%s.%d", strings.Repeat("very.long.metric.name.", 5), i),
+					State:     "ERROR",
+					TriggerID: triggers[0].ID,
+				})
+			}
+			err = sender.SendEvents(context.Background(), events, contact, triggers[0], false)
+			Expect(err).ShouldNot(HaveOccurred())
+
+			messages := server.sent()
+			Expect(len(messages)).To(BeNumerically(">", 1))
+			for _, message := range messages {
+				Expect(message.ChatID).To(Equal("100"))
+				Expect(len(message.Text)).To(BeNumerically("<=", 4096))
+			}
+			Expect(messages[0].Text).To(ContainSubstring(fmt.Sprintf("(1/%d)", len(messages))))
+			Expect(messages[len(messages)-1].Text).To(ContainSubstring("ERROR: 100"))
+			delivered := 0
+			for _, message := range messages {
+				delivered += strings.Count(message.Text, strings.Repeat("very.long.metric.name.", 5))
+			}
+			Expect(delivered).To(Equal(100))
+		})
+
+		It("should truncate escaped metric to fit event into message", func() {
+			events := notifier.EventsData{{
+				Metric:    strings.Repeat("&", 4096),
+				Message:   strings.Repeat("<", 4096),
+				State:     "ERROR",
+				TriggerID: triggers[0].ID,
+			}}
+			err = sender.SendEvents(context.Background(), events, contact, triggers[0], false)
+			Expect(err).ShouldNot(HaveOccurred())
+
+			messages := server.sent()
+			Expect(len(messages)).To(Equal(1))
+			Expect(len(messages[0].Text)).To(BeNumerically("<=", 4096))
+			Expect(strings.Count(messages[0].Text, "&amp;")).To(Equal(102))
+			Expect(strings.Count(messages[0].Text, "&lt;")).To(Equal(128))
+			Expect(messages[0].Text).To(ContainSubstring("ERROR: 1"))
+		})
+
+		It("should count events not fitting into max parts in the last message", func() {
+			sender.Close()
+			sender = &telegram.Sender{DB: testDb.conn}
+			err = sender.Init(map[string]string{
+				"type":          "telegram",
+				"api_token":     "123:token",
+				"api_url":       server.URL,
+				"part_interval": "0s1ms",
+				"max_parts":     "2",
+			}, log)
+			Expect(err).ShouldNot(HaveOccurred())
+			events := make(notifier.EventsData, 0, 100)
+			for i := 0; i < 100; i++ {
+				events = append(events, notifier.EventData{
+					Metric:    fmt.Sprintf("%s.%d", strings.Repeat("very.long.metric.name.", 5), i),
+					State:     "ERROR",
+					TriggerID: triggers[0].ID,
+				})
+			}
+			err = sender.SendEvents(context.Background(), events, contact, triggers[0], false)
+			Expect(err).ShouldNot(HaveOccurred())
+
+			messages := server.sent()
+			Expect(len(messages)).To(Equal(2))
+			Expect(messages[0].Text).To(ContainSubstring("(1/2)"))
+			delivered := 0
+			for _, message := range messages {
+				Expect(len(message.Text)).To(BeNumerically("<=", 4096))
+				delivered += strings.Count(message.Text, strings.Repeat("very.long.metric.name.", 5))
+			}
+			Expect(delivered).To(BeNumerically("<", 100))
+			Expect(messages[1].Text).To(ContainSubstring(fmt.Sprintf("...and %d more events.", 100-delivered)))
+			Expect(messages[1].Text).To(ContainSubstring("ERROR: 100"))
+		})
+
+		It("should not init with invalid max parts", func() {
+			err = (&telegram.Sender{}).Init(map[string]string{
+				"type":      "telegram",
+				"api_token": "123:token",
+				"api_url":   server.URL,
+				"max_parts": "0",
+			}, log)
+			Expect(err).Should(HaveOccurred())
+		})
+
+		It("should format messages with escaped HTML", func() {
+			events := notifier.EventsData{{Metric: "disk_usage.<sda>&1", Message: "a < b", State: "ERROR", TriggerID: triggers[0].ID}}
+			err = sender.SendEvents(context.Background(), events, contact, triggers[0], true)
+			Expect(err).ShouldNot(HaveOccurred())
+
+			messages := server.sent()
+			Expect(messages).To(HaveLen(1))
+			Expect(messages[0].ParseMode).To(Equal("HTML"))
+			Expect(messages[0].Text).To(ContainSubstring(fmt.Sprintf(`<b>ERROR</b> <a href="/#/events/%s">test trigger 1</a>`, triggers[0].ID)))
+			Expect(messages[0].Text).To(ContainSubstring("<code>"))
+			Expect(messages[0].Text).To(ContainSubstring("disk_usage.&lt;sda&gt;&amp;1"))
+			Expect(messages[0].Text).To(ContainSubstring(". a &lt; b"))
+			Expect(messages[0].Text).To(ContainSubstring("<b>fix your system or tune this trigger</b>"))
+		})
+
+		It("should attach chart rendered by graphite", func() {
+			var renderQuery url.Values
+			chart := &bytes.Buffer{}
+			png.Encode(chart, image.NewRGBA(image.Rect(0, 0, 4, 4)))
+			graphite := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				renderQuery = r.URL.Query()
+				w.Header().Set("Content-Type", "image/png")
+				w.Write(chart.Bytes())
+			}))
+			defer graphite.Close()
+			sender.RenderURL = graphite.URL + "/render"
+
+			events := notifier.EventsData{{Metric: "test.target.1", State: "ERROR", TriggerID: triggers[0].ID}}
+			err = sender.SendEvents(context.Background(), events, contact, triggers[0], false)
+			Expect(err).ShouldNot(HaveOccurred())
+
+			Expect(renderQuery["target"]).To(Equal(triggers[0].Targets))
+			Expect(renderQuery.Get("from")).To(Equal("-180minutes"))
+			messages := server.sent()
+			Expect(messages).To(HaveLen(1))
+			Expect(messages[0].Photo).To(Equal(chart.Bytes()))
+			Expect(messages[0].Text).To(ContainSubstring("test.target.1"))
+			Expect(messages[0].ParseMode).To(Equal("HTML"))
+		})
+
+		It("should send notification without chart if graphite fails", func() {
+			graphite := httptest.NewServer(http.NotFoundHandler())
+			defer graphite.Close()
+			sender.RenderURL = graphite.URL + "/render"
+
+			events := notifier.EventsData{{Metric: "test.target.1", State: "ERROR", TriggerID: triggers[0].ID}}
+			err = sender.SendEvents(context.Background(), events, contact, triggers[0], false)
+			Expect(err).ShouldNot(HaveOccurred())
+			messages := server.sent()
+			Expect(messages).To(HaveLen(1))
+			Expect(messages[0].Photo).To(BeNil())
+		})
+
+		It("should link contact to chat with one-time code", func() {
+			server.receive(map[string]interface{}{"id": 200, "type": "private", "username": "newcomer"}, "/start")
+			Eventually(server.sent).Should(HaveLen(1))
+			code := regexp.MustCompile(`link code is ([A-Z0-9]{8})`).FindStringSubmatch(server.sent()[0].Text)
+			Expect(code).To(HaveLen(2))
+			id, err := testDb.conn.GetIDByUsername("telegram", "@newcomer")
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(id).To(Equal("200"))
+
+			linked := notifier.ContactData{ID: "ContactID-linked", Type: "telegram", Value: code[1], User: "newcomer"}
+			Expect(testDb.conn.SetContact(&linked)).ShouldNot(HaveOccurred())
+			Eventually(func() (string, error) {
+				return testDb.conn.GetContactChatID("telegram", linked.ID, linked.Value)
+			}).Should(Equal("200"))
+
+			c := testDb.conn.Pool.Get()
+			defer c.Close()
+			c.Do("DEL", "moira-telegram-users:"+code[1])
+			events := notifier.EventsData{{Metric: "test.metric", State: "ERROR", TriggerID: triggers[0].ID}}
+			err = sender.SendEvents(context.Background(), events, linked, triggers[0], false)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(server.sent()[1].ChatID).To(Equal("200"))
+			codes, err := testDb.conn.GetLinkCodes("telegram")
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(codes).To(BeEmpty())
+
+			linked.Value = "@newcomer"
+			chatID, err := testDb.conn.GetContactChatID("telegram", linked.ID, linked.Value)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(chatID).To(BeEmpty())
+		})
+
+		It("should greet group and answer command in one reply", func() {
+			group := map[string]interface{}{"id": -300, "type": "group", "title": "Oncall group"}
+			server.receive(group, "/help")
+			Eventually(server.sent).Should(HaveLen(1))
+			reply := server.sent()[0]
+			Expect(reply.ChatID).To(Equal("-300"))
+			Expect(reply.Text).To(HavePrefix("Hi, all!\nI will send alerts in this group (Oncall group)."))
+			Expect(reply.Text).To(HaveSuffix("This chat is not used by Moira contacts."))
+			id, err := testDb.conn.GetIDByUsername("telegram", "Oncall group")
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(id).To(Equal("-300"))
+
+			server.receive(group, "/help")
+			Eventually(server.sent).Should(HaveLen(2))
+			Expect(server.sent()[1].Text).To(Equal("This chat is not used by Moira contacts."))
+		})
+
+		It("should find group contacts registered before chat users index", func() {
+			group := notifier.ContactData{ID: "ContactID-group", Type: "telegram", Value: "Legacy group", User: "oncall"}
+			Expect(testDb.conn.SetContact(&group)).ShouldNot(HaveOccurred())
+			c := testDb.conn.Pool.Get()
+			c.Do("SET", "moira-telegram-users:Legacy group", "-300")
+			c.Close()
+
+			server.receive(map[string]interface{}{"id": -300, "type": "group", "title": "Legacy group"}, "/subs")
+			Eventually(server.sent).Should(HaveLen(1))
+			Expect(server.sent()[0].Text).NotTo(ContainSubstring("This chat is not used by Moira contacts."))
+		})
+
+		It("should find contacts saved by API once they are loaded by notifier", func() {
+			server.receive(map[string]interface{}{"id": 200, "type": "private", "username": "newcomer"}, "/start")
+			Eventually(server.sent).Should(HaveLen(1))
+			code := regexp.MustCompile(`link code is ([A-Z0-9]{8})`).FindStringSubmatch(server.sent()[0].Text)
+			Expect(code).To(HaveLen(2))
+
+			linked := notifier.ContactData{ID: "ContactID-api", Type: "telegram", Value: code[1], User: "newcomer"}
+			contactString, _ := json.Marshal(&linked)
+			c := testDb.conn.Pool.Get()
+			c.Do("SET", "moira-contact:"+linked.ID, contactString)
+			c.Close()
+			Consistently(func() (string, error) {
+				return testDb.conn.GetContactChatID("telegram", linked.ID, linked.Value)
+			}, "50ms").Should(BeEmpty())
+
+			Expect(sender.ValidateContact(linked)).Should(Succeed())
+			Eventually(func() (string, error) {
+				return testDb.conn.GetContactChatID("telegram", linked.ID, linked.Value)
+			}).Should(Equal("200"))
+		})
+
+		It("should drop contacts changed since they were indexed by value", func() {
+			changed := notifier.ContactData{ID: "ContactID-changed", Type: "telegram", Value: "@former", User: "oncall"}
+			Expect(testDb.conn.SetContact(&changed)).ShouldNot(HaveOccurred())
+			contacts, err := testDb.conn.GetContactsByValue("telegram", "@former")
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(contacts).To(HaveLen(1))
+			Expect(contacts[0].ID).To(Equal(changed.ID))
+
+			changed.Value = "@current"
+			Expect(testDb.conn.SetContact(&changed)).ShouldNot(HaveOccurred())
+			contacts, err = testDb.conn.GetContactsByValue("telegram", "@former")
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(contacts).To(BeEmpty())
+			contacts, err = testDb.conn.GetContactsByValue("telegram", "@current")
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(contacts).To(HaveLen(1))
+		})
+
+		It("should mark contact unreachable when bot is blocked", func() {
+			server.block("100")
+			events := notifier.EventsData{{Metric: "test.metric", State: "ERROR", TriggerID: triggers[0].ID}}
+			err = sender.SendEvents(context.Background(), events, contact, triggers[0], false)
+			Expect(err).To(BeAssignableToTypeOf(&notifier.UnreachableContactError{}))
+			Expect(sender.ValidateContact(contact)).Should(HaveOccurred())
+
+			server.receive(chat, "/start")
+			Eventually(func() error {
+				return sender.ValidateContact(contact)
+			}).ShouldNot(HaveOccurred())
+		})
+
+		It("should index chat users by chat id", func() {
+			c := testDb.conn.Pool.Get()
+			c.Do("SET", "moira-telegram-users:Legacy group", "300")
+			c.Close()
+			Expect(testDb.conn.IndexChatUser("telegram", "Legacy group", "400")).ShouldNot(HaveOccurred())
+			usernames, err := testDb.conn.GetUsernamesByID("telegram", "400")
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(usernames).To(BeEmpty())
+			Expect(testDb.conn.IndexChatUser("telegram", "Legacy group", "300")).ShouldNot(HaveOccurred())
+			usernames, err = testDb.conn.GetUsernamesByID("telegram", "300")
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(usernames).To(Equal([]string{"Legacy group"}))
+
+			Expect(testDb.conn.SetUsernameID("telegram", "@oncall", "200")).ShouldNot(HaveOccurred())
+			usernames, err = testDb.conn.GetUsernamesByID("telegram", "100")
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(usernames).To(BeEmpty())
+			usernames, err = testDb.conn.GetUsernamesByID("telegram", "200")
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(usernames).To(Equal([]string{"@oncall"}))
+		})
+
+		It("should answer commands with chat subscriptions and triggers", func() {
+			server.receive(chat, "/status")
+			Eventually(server.sent).Should(HaveLen(1))
+			Expect(server.sent()[0].Text).To(ContainSubstring("ERROR test trigger 1"))
+
+			server.receive(chat, "/subs")
+			Eventually(server.sent).Should(HaveLen(2))
+			Expect(server.sent()[1].Text).To(ContainSubstring("[test-tag-1]"))
+
+			server.receive(chat, "/mute test trigger 1 1h")
+			Eventually(server.sent).Should(HaveLen(3))
+			muted, err := testDb.conn.IsTriggerMuted(triggers[0].ID)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(muted).To(BeTrue())
+
+			server.receive(chat, "/unmute "+triggers[0].ID)
+			Eventually(server.sent).Should(HaveLen(4))
+			muted, err = testDb.conn.IsTriggerMuted(triggers[0].ID)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(muted).To(BeFalse())
+
+			server.receive(chat, "/test")
+			Eventually(server.sent).Should(HaveLen(5))
+			notification, err := testDb.getSingleNotification()
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(notification.Contact.ID).To(Equal(contact.ID))
+		})
+	})
+
+	Context("Twilio voice calls", func() {
+		var server *fakeTwilioServer
+		var sender *twilio.Sender
+		var listener net.Listener
+		contact := notifier.ContactData{
+			ID:       "ContactID-voice",
+			Type:     "twilio voice",
+			Value:    "+200",
+			Settings: map[string]string{"escalate_to": "+300"},
+		}
+		events := notifier.EventsData{
+			{Metric: "cpu.user", Value: 95, State: "WARN", OldState: "OK", TriggerID: triggers[0].ID},
+			{Metric: "cpu.system", Value: 99, State: "ERROR", OldState: "OK", TriggerID: triggers[0].ID},
+		}
+		BeforeEach(func() {
+			server = startFakeTwilioServer()
+			listener, err = notifier.StartHTTPServer("127.0.0.1:0")
+			Expect(err).ShouldNot(HaveOccurred())
+			sender = &twilio.Sender{DB: testDb.conn}
+			err = sender.Init(map[string]string{
+				"type":          "twilio voice",
+				"api_asid":      "AC01",
+				"api_authtoken": "token",
+				"api_fromphone": "+100",
+				"api_url":       server.URL,
+				"callback_url":  fmt.Sprintf("http://%s/", listener.Addr()),
+				"call_retries":  "1",
+			}, log)
+			Expect(err).ShouldNot(HaveOccurred())
+		})
+		AfterEach(func() {
+			sender.Close()
+			listener.Close()
+			server.Close()
+		})
+
+		callback := func(requestURL string, form url.Values, authToken string) (*http.Response, string) {
+			request, _ := http.NewRequest("POST", requestURL, strings.NewReader(form.Encode()))
+			request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			request.Header.Set("X-Twilio-Signature", signTwilioRequest(authToken, requestURL, form))
+			response, err := http.DefaultClient.Do(request)
+			Expect(err).ShouldNot(HaveOccurred())
+			defer response.Body.Close()
+			body, _ := ioutil.ReadAll(response.Body)
+			return response, string(body)
+		}
+
+		It("should read out trigger and acknowledge it by keypress", func() {
+			err = sender.SendEvents(context.Background(), events, contact, triggers[0], false)
+			Expect(err).ShouldNot(HaveOccurred())
+			calls := server.created()
+			Expect(calls).To(HaveLen(1))
+			Expect(calls[0].Resource).To(Equal("Calls"))
+			Expect(calls[0].Form.Get("To")).To(Equal("+200"))
+			voiceURL := calls[0].Form.Get("Url")
+
+			response, _ := callback(voiceURL, url.Values{"CallSid": {"CA1"}}, "wrong")
+			Expect(response.StatusCode).To(Equal(http.StatusUnauthorized))
+
+			response, body := callback(voiceURL, url.Values{"CallSid": {"CA1"}}, "token")
+			Expect(response.StatusCode).To(Equal(http.StatusOK))
+			Expect(body).To(ContainSubstring("<Gather numDigits=\"1\""))
+			Expect(body).To(ContainSubstring(fmt.Sprintf("Trigger %s is in state ERROR. cpu.system is 99. cpu.user is 95. Press 1 to acknowledge.", triggers[0].Name)))
+
+			gatherURL := strings.Replace(voiceURL, twilio.VoicePath, twilio.GatherPath, 1)
+			_, body = callback(gatherURL, url.Values{"CallSid": {"CA1"}, "Digits": {"1"}}, "token")
+			Expect(body).To(ContainSubstring("Acknowledged."))
+			muted, err := testDb.conn.IsTriggerMuted(triggers[0].ID)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(muted).To(BeTrue())
+
+			statusURL := calls[0].Form.Get("StatusCallback")
+			response, _ = callback(statusURL, url.Values{"CallSid": {"CA1"}, "CallStatus": {"completed"}}, "token")
+			Expect(response.StatusCode).To(Equal(http.StatusNoContent))
+			notifications, err := testDb.getNotifications(0, -1)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(notifications).To(BeEmpty())
+		})
+
+		It("should retry and escalate unacknowledged calls", func() {
+			for i, number := range []string{"+200", "+200", "+300"} {
+				err = sender.SendEvents(context.Background(), events, contact, triggers[0], false)
+				Expect(err).ShouldNot(HaveOccurred())
+				call := server.created()[i]
+				Expect(call.Form.Get("To")).To(Equal(number))
+				callback(call.Form.Get("StatusCallback"), url.Values{"CallSid": {fmt.Sprintf("CA%d", i+1)}, "CallStatus": {"no-answer"}}, "token")
+			}
+			notifications, err := testDb.getNotifications(0, -1)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(notifications).To(HaveLen(len(events)))
+			Expect(notifications[0].Contact.ID).To(Equal(contact.ID))
+			Expect(notifications[0].Timestamp).To(Equal(notifier.GetNow().Add(5 * time.Minute).Unix()))
+			incident, err := testDb.conn.GetTriggerIncident("twilio-voice", contact.ID, triggers[0].ID)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(incident).To(BeEmpty())
+		})
+
+		It("should escalate only when call has finished without acknowledgement", func() {
+			for i := 0; i < 2; i++ {
+				err = sender.SendEvents(context.Background(), events, contact, triggers[0], false)
+				Expect(err).ShouldNot(HaveOccurred())
+			}
+			calls := server.created()
+			Expect(calls).To(HaveLen(2))
+			Expect(calls[1].Form.Get("To")).To(Equal("+200"))
+
+			callback(calls[0].Form.Get("StatusCallback"), url.Values{"CallSid": {"CA1"}, "CallStatus": {"no-answer"}}, "token")
+			notifications, err := testDb.getNotifications(0, -1)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(notifications).To(BeEmpty())
+
+			for i := 0; i < 2; i++ {
+				callback(calls[1].Form.Get("StatusCallback"), url.Values{"CallSid": {"CA2"}, "CallStatus": {"no-answer"}}, "token")
+			}
+			incident, err := testDb.conn.GetTriggerIncident("twilio-voice", contact.ID, triggers[0].ID)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(incident).To(ContainSubstring(`"attempt":2`))
+
+			for _, number := range []string{"+200", "+200"} {
+				err = sender.SendEvents(context.Background(), events, contact, triggers[0], false)
+				Expect(err).ShouldNot(HaveOccurred())
+				calls = server.created()
+				Expect(calls[len(calls)-1].Form.Get("To")).To(Equal(number))
+			}
+			callback(calls[len(calls)-1].Form.Get("StatusCallback"), url.Values{"CallSid": {"CA4"}, "CallStatus": {"busy"}}, "token")
+			err = sender.SendEvents(context.Background(), events, contact, triggers[0], false)
+			Expect(err).ShouldNot(HaveOccurred())
+			calls = server.created()
+			Expect(calls[len(calls)-1].Form.Get("To")).To(Equal("+300"))
+		})
+	})
+
+	Context("Twilio delivery statuses", func() {
+		var server *fakeTwilioServer
+		var sender *twilio.Sender
+		var listener net.Listener
+		contact := notifier.ContactData{ID: "ContactID-sms", Type: "twilio sms", Value: "+200"}
+		events := notifier.EventsData{{Metric: "cpu.user", Value: 95, State: "ERROR", OldState: "OK", TriggerID: triggers[0].ID}}
+		BeforeEach(func() {
+			server = startFakeTwilioServer()
+			listener, err = notifier.StartHTTPServer("127.0.0.1:0")
+			Expect(err).ShouldNot(HaveOccurred())
+			sender = &twilio.Sender{DB: testDb.conn}
+			err = sender.Init(map[string]string{
+				"type":             "twilio sms",
+				"api_asid":         "AC01",
+				"api_authtoken":    "token",
+				"api_fromphone":    "+100",
+				"api_url":          server.URL,
+				"callback_url":     fmt.Sprintf("http://%s", listener.Addr()),
+				"delivery_retries": "1",
+				"fallback_type":    "twilio voice",
+			}, log)
+			Expect(err).ShouldNot(HaveOccurred())
+		})
+		AfterEach(func() {
+			sender.Close()
+			listener.Close()
+			server.Close()
+		})
+
+		report := func(sid, status string) {
+			statusURL := server.created()[0].Form.Get("StatusCallback")
+			form := url.Values{"MessageSid": {sid}, "MessageStatus": {status}, "ErrorCode": {"30003"}}
+			request, _ := http.NewRequest("POST", statusURL, strings.NewReader(form.Encode()))
+			request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			request.Header.Set("X-Twilio-Signature", signTwilioRequest("token", statusURL, form))
+			response, err := http.DefaultClient.Do(request)
+			Expect(err).ShouldNot(HaveOccurred())
+			response.Body.Close()
+			Expect(response.StatusCode).To(Equal(http.StatusNoContent))
+		}
+
+		It("should retry undelivered message and then fall back to call", func() {
+			err = sender.SendEvents(context.Background(), events, contact, triggers[0], false)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(server.created()[0].Form.Get("StatusCallback")).To(HaveSuffix(twilio.MessageStatusPath))
+			report("ME1", "undelivered")
+			delivery, err := testDb.conn.GetDelivery("twilio", "ME1")
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(delivery).To(ContainSubstring(`"status":"undelivered","error_code":"30003"`))
+			notification, err := testDb.getSingleNotification()
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(notification.Contact).To(Equal(contact))
+			Expect(notification.Timestamp).To(Equal(notifier.GetNow().Add(5 * time.Minute).Unix()))
+
+			err = sender.SendEvents(context.Background(), events, contact, triggers[0], false)
+			Expect(err).ShouldNot(HaveOccurred())
+			report("ME2", "undelivered")
+			notifications, err := testDb.getNotifications(0, -1)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(notifications).To(HaveLen(2))
+			types := []string{notifications[0].Contact.Type, notifications[1].Contact.Type}
+			Expect(types).To(ConsistOf("twilio sms", "twilio voice"))
+		})
+
+		It("should reset failures when message is delivered", func() {
+			err = sender.SendEvents(context.Background(), events, contact, triggers[0], false)
+			Expect(err).ShouldNot(HaveOccurred())
+			report("ME1", "undelivered")
+			err = sender.SendEvents(context.Background(), events, contact, triggers[0], false)
+			Expect(err).ShouldNot(HaveOccurred())
+			report("ME2", "delivered")
+			failures, err := testDb.conn.GetTriggerIncident("twilio-delivery", contact.ID, triggers[0].ID)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(failures).To(BeEmpty())
+		})
+	})
+
+	Context("SMS composition", func() {
+		events := make(notifier.EventsData, 0, 20)
+		for i := 0; i < 20; i++ {
+			state := "WARN"
+			if i == 15 {
+				state = "ERROR"
+			}
+			events = append(events, notifier.EventData{
+				Metric:    fmt.Sprintf("servers.production.web%02d.cpu.user", i),
+				Value:     float64(i),
+				State:     state,
+				OldState:  "OK",
+				TriggerID: triggers[0].ID,
+			})
+		}
+
+		It("should count segments of GSM-7 and UCS-2 messages", func() {
+			Expect(sms.Segments(strings.Repeat("a", 160))).To(Equal(1))
+			Expect(sms.Segments(strings.Repeat("a", 161))).To(Equal(2))
+			Expect(sms.Segments(strings.Repeat("{", 80))).To(Equal(1))
+			Expect(sms.Segments(strings.Repeat("{", 81))).To(Equal(2))
+			Expect(sms.Segments(strings.Repeat("ж", 70))).To(Equal(1))
+			Expect(sms.Segments(strings.Repeat("ж", 71))).To(Equal(2))
+			Expect(sms.Segments(strings.Repeat("a", 159) + "ж")).To(Equal(3))
+		})
+
+		It("should abbreviate metric paths", func() {
+			Expect(sms.AbbreviateMetric("cpu.user", 32)).To(Equal("cpu.user"))
+			Expect(sms.AbbreviateMetric("servers.production.web01.cpu.user", 20)).To(Equal("s.p.web01.cpu.user"))
+			Expect(sms.AbbreviateMetric("servers.production.web01.cpu.user", 10)).To(Equal("..cpu.user"))
+		})
+
+		It("should compose message within segments starting from the most critical events", func() {
+			renderer := render.Default("twilio sms")
+			for _, segments := range []int{1, 2} {
+				message, err := sms.Compose(renderer, render.NewView(events, contacts[0], triggers[0], true, ""), segments)
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(sms.Segments(message)).To(Equal(segments))
+				lines := strings.Split(message, "\n")
+				Expect(lines[0]).To(HavePrefix("ERROR " + triggers[0].Name))
+				Expect(lines[1]).To(Equal("s.production.web15.cpu.user = 15 (ERROR)"))
+				Expect(lines[len(lines)-1]).To(MatchRegexp(`^\.\.\.and \d+ more events\.$`))
+			}
+
+			renderer = renderer.Contact(notifier.ContactData{Language: "ru"})
+			message, err := sms.Compose(renderer, render.NewView(events, contacts[0], triggers[0], false, ""), 2)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(sms.Segments(message)).To(Equal(2))
+			Expect(strings.Split(message, "\n")[1]).To(HavePrefix("s.production.web15.cpu.user"))
+			Expect(message).To(MatchRegexp(`ещё событий: \d+\.$`))
+		})
+
+		It("should send twilio messages within configured segments", func() {
+			server := startFakeTwilioServer()
+			defer server.Close()
+			sender := &twilio.Sender{}
+			err = sender.Init(map[string]string{
+				"type":          "twilio sms",
+				"api_asid":      "AC01",
+				"api_authtoken": "token",
+				"api_fromphone": "+100",
+				"api_url":       server.URL,
+				"sms_segments":  "2",
+			}, log)
+			Expect(err).ShouldNot(HaveOccurred())
+			err = sender.SendEvents(context.Background(), events, contacts[0], triggers[0], false)
+			Expect(err).ShouldNot(HaveOccurred())
+			body := server.created()[0].Form.Get("Body")
+			Expect(sms.Segments(body)).To(Equal(2))
+		})
+	})
+
+	Context("Pushover emergency receipts", func() {
+		var server *fakePushoverServer
+		var sender *pushover.Sender
+		contact := notifier.ContactData{ID: "ContactID-pushover", Type: "pushover", Value: "uOncall"}
+		failing := notifier.EventsData{{Metric: "cpu.user", Value: 95, State: "ERROR", OldState: "OK", TriggerID: triggers[0].ID}}
+		recovered := notifier.EventsData{{Metric: "cpu.user", Value: 5, State: "OK", OldState: "ERROR", TriggerID: triggers[0].ID}}
+		BeforeEach(func() {
+			server = startFakePushoverServer()
+			sender = &pushover.Sender{DB: testDb.conn}
+			err = sender.Init(map[string]string{
+				"type":          "pushover",
+				"api_token":     "token",
+				"api_url":       server.URL,
+				"poll_interval": "0s10ms",
+			}, log)
+			Expect(err).ShouldNot(HaveOccurred())
+		})
+		AfterEach(func() {
+			sender.Close()
+			server.Close()
+		})
+
+		It("should cancel emergency retries when trigger returns to OK", func() {
+			err = sender.SendEvents(context.Background(), failing, contact, triggers[0], false)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(server.sent()[0].Get("priority")).To(Equal("2"))
+			Expect(server.sent()[0].Get("retry")).To(Equal("300"))
+			incident, err := testDb.conn.GetTriggerIncident("pushover", contact.ID, triggers[0].ID)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(incident).To(Equal(`{"receipt":"R1"}`))
+
+			setTriggerState(triggers[0].ID, "OK")
+			err = sender.SendEvents(context.Background(), recovered, contact, triggers[0], false)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(server.cancels()).To(Equal([]string{"R1"}))
+			incident, err = testDb.conn.GetTriggerIncident("pushover", contact.ID, triggers[0].ID)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(incident).To(BeEmpty())
+			receipts, err := testDb.conn.GetPendingDeliveries("pushover")
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(receipts).To(BeEmpty())
+		})
+
+		It("should keep emergency retries while other metrics of trigger are not OK", func() {
+			setTriggerState(triggers[0].ID, "ERROR")
+			err = sender.SendEvents(context.Background(), failing, contact, triggers[0], false)
+			Expect(err).ShouldNot(HaveOccurred())
+			err = sender.SendEvents(context.Background(), recovered, contact, triggers[0], false)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(server.cancels()).To(BeEmpty())
+			incident, err := testDb.conn.GetTriggerIncident("pushover", contact.ID, triggers[0].ID)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(incident).To(Equal(`{"receipt":"R1"}`))
+		})
+
+		It("should record who acknowledged emergency message", func() {
+			err = sender.SendEvents(context.Background(), failing, contact, triggers[0], false)
+			Expect(err).ShouldNot(HaveOccurred())
+			server.acknowledge("R1")
+			Eventually(func() (string, error) {
+				return testDb.conn.GetTriggerIncident("pushover", contact.ID, triggers[0].ID)
+			}).Should(Equal(`{"receipt":"R1","acknowledged_by":"uOncall (phone)","acknowledged_at":1441188915}`))
+			Eventually(func() ([]string, error) {
+				return testDb.conn.GetPendingDeliveries("pushover")
+			}).Should(BeEmpty())
+			muted, err := testDb.conn.IsTriggerMuted(triggers[0].ID)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(muted).To(BeFalse())
+
+			err = sender.SendEvents(context.Background(), recovered, contact, triggers[0], false)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(server.cancels()).To(BeEmpty())
+		})
+
+		It("should keep polling receipts after sender restart", func() {
+			err = sender.SendEvents(context.Background(), failing, contact, triggers[0], false)
+			Expect(err).ShouldNot(HaveOccurred())
+			sender.Close()
+			receipts, err := testDb.conn.GetPendingDeliveries("pushover")
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(receipts).To(Equal([]string{"R1"}))
+
+			sender = &pushover.Sender{DB: testDb.conn}
+			err = sender.Init(map[string]string{
+				"type":          "pushover",
+				"api_token":     "token",
+				"api_url":       server.URL,
+				"poll_interval": "0s10ms",
+			}, log)
+			Expect(err).ShouldNot(HaveOccurred())
+			server.acknowledge("R1")
+			Eventually(func() (string, error) {
+				return testDb.conn.GetTriggerIncident("pushover", contact.ID, triggers[0].ID)
+			}).Should(ContainSubstring(`"acknowledged_by":"uOncall (phone)"`))
+		})
+	})
+
+	Context("Pushover contact options", func() {
+		var server *fakePushoverServer
+		var sender *pushover.Sender
+		warning := notifier.EventsData{{Metric: "cpu.user", Value: 75, State: "WARN", OldState: "OK", TriggerID: triggers[0].ID}}
+		failing := notifier.EventsData{{Metric: "cpu.user", Value: 95, State: "ERROR", OldState: "WARN", TriggerID: triggers[0].ID}}
+		BeforeEach(func() {
+			server = startFakePushoverServer()
+			sender = &pushover.Sender{}
+			err = sender.Init(map[string]string{"type": "pushover", "api_token": "token", "api_url": server.URL}, log)
+			Expect(err).ShouldNot(HaveOccurred())
+		})
+		AfterEach(func() {
+			sender.Close()
+			server.Close()
+		})
+
+		It("should apply device, sounds and priority limits of contact", func() {
+			contact := notifier.ContactData{ID: "ContactID-pushover", Type: "pushover", Value: "uOncall", Settings: map[string]string{
+				"device":       "work-phone",
+				"sound_WARN":   "none",
+				"sound_ERROR":  "siren",
+				"max_priority": "1",
+			}}
+			err = sender.SendEvents(context.Background(), warning, contact, triggers[0], false)
+			Expect(err).ShouldNot(HaveOccurred())
+			err = sender.SendEvents(context.Background(), failing, contact, triggers[0], false)
+			Expect(err).ShouldNot(HaveOccurred())
+			sent := server.sent()
+			Expect(sent[0].Get("device")).To(Equal("work-phone"))
+			Expect(sent[0].Get("sound")).To(Equal("none"))
+			Expect(sent[0].Get("priority")).To(Equal("1"))
+			Expect(sent[1].Get("sound")).To(Equal("siren"))
+			Expect(sent[1].Get("priority")).To(Equal("1"))
+			Expect(sent[1].Get("retry")).To(BeEmpty())
+		})
+
+		It("should use retry and expire of contact for emergency messages", func() {
+			contact := notifier.ContactData{ID: "ContactID-pushover", Type: "pushover", Value: "uOncall", Settings: map[string]string{
+				"retry":        "2m",
+				"expire":       "30m",
+				"min_priority": "-1",
+			}}
+			err = sender.SendEvents(context.Background(), failing, contact, triggers[0], false)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(server.sent()[0].Get("retry")).To(Equal("120"))
+			Expect(server.sent()[0].Get("expire")).To(Equal("1800"))
+			Expect(server.sent()[0].Get("device")).To(BeEmpty())
+		})
+
+		It("should reject contacts with invalid options", func() {
+			for _, settings := range []map[string]string{
+				{"device": "phone, bad!"},
+				{"retry": "10s"},
+				{"expire": "5h"},
+				{"max_priority": "3"},
+				{"min_priority": "1", "max_priority": "0"},
+			} {
+				contact := notifier.ContactData{ID: "ContactID-pushover", Type: "pushover", Value: "uOncall", Settings: settings}
+				Expect(sender.ValidateContact(contact)).Should(HaveOccurred())
+			}
+			contact := notifier.ContactData{ID: "ContactID-pushover", Type: "pushover", Value: "uOncall", Settings: map[string]string{"device": "phone,tablet"}}
+			Expect(sender.ValidateContact(contact)).Should(Succeed())
+		})
+	})
+
+	Context("Trigger incidents", func() {
+		It("should keep sender value until incident is over", func() {
+			value, err := testDb.conn.GetTriggerIncident("mail", contacts[0].ID, triggers[0].ID)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(value).To(BeEmpty())
+			err = testDb.conn.SetTriggerIncident("mail", contacts[0].ID, triggers[0].ID, "<1@notifier>")
+			Expect(err).ShouldNot(HaveOccurred())
+			value, err = testDb.conn.GetTriggerIncident("mail", contacts[0].ID, triggers[0].ID)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(value).To(Equal("<1@notifier>"))
+			err = testDb.conn.RemoveTriggerIncident("mail", contacts[0].ID, triggers[0].ID)
+			Expect(err).ShouldNot(HaveOccurred())
+			value, err = testDb.conn.GetTriggerIncident("mail", contacts[0].ID, triggers[0].ID)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(value).To(BeEmpty())
+		})
+	})
+
+	Context("Templates rendering", func() {
+		var view *render.View
+		BeforeEach(func() {
+			events := make([]notifier.EventData, 0, 10)
+			for event := range generateTestEvents(10, triggers[0].ID) {
+				events = append(events, *event)
+			}
+			view = render.NewView(events, contacts[0], triggers[0], true, "http://localhost")
+		})
+
+		It("should render built-in templates", func() {
+			message, err := render.Default("pushover").Render("message", view)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(message).To(ContainSubstring("...and 5 more events."))
+			Expect(message).To(ContainSubstring("Please, fix your system or tune this trigger to generate less events."))
+		})
+
+		It("should render templates in contact language", func() {
+			renderer, err := render.New("twilio voice", "", "en")
+			Expect(err).ShouldNot(HaveOccurred())
+			message, err := renderer.Contact(notifier.ContactData{Language: "ru"}).Render("voice", view)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(message).To(HavePrefix("Здравствуйте!"))
+			message, err = renderer.Contact(notifier.ContactData{Language: "unknown"}).Render("voice", view)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(message).To(HavePrefix("Hi!"))
+		})
+
+		It("should format time in contact timezone and date format", func() {
+			renderer := render.Default("mail").Contact(notifier.ContactData{
+				Timezone:   "Europe/Berlin",
+				DateFormat: "2006-01-02",
+			})
+			Expect(renderer.FormatTime(1500000000)).To(Equal("04:40 CEST"))
+			Expect(renderer.FormatDateTime(1500000000)).To(Equal("04:40 CEST 2017-07-14"))
+		})
+
+		It("should not create renderer with unsupported language", func() {
+			_, err := render.New("slack", "", "unknown")
+			Expect(err).Should(HaveOccurred())
+		})
+
+		It("should redefine built-in templates from templates dir", func() {
+			templatesDir, err := ioutil.TempDir("", "templates")
+			Expect(err).ShouldNot(HaveOccurred())
+			defer os.RemoveAll(templatesDir)
+			err = ioutil.WriteFile(filepath.Join(templatesDir, "common.tmpl"), []byte(`{{define "more"}}+{{.}}{{end}}`), 0644)
+			Expect(err).ShouldNot(HaveOccurred())
+			err = ioutil.WriteFile(filepath.Join(templatesDir, "twilio_sms.tmpl"), []byte(`{{define "throttled"}}throttled{{end}}`), 0644)
+			Expect(err).ShouldNot(HaveOccurred())
+
+			renderer, err := render.New("twilio sms", templatesDir, "")
+			Expect(err).ShouldNot(HaveOccurred())
+			message, err := sms.Compose(renderer, view, 1)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(message).To(HaveSuffix("\n+6"))
+			message, err = sms.Compose(renderer, view, 3)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(message).To(HaveSuffix("\nthrottled"))
 		})
 	})
 
@@ -738,6 +2407,13 @@ func generateTestEvents(n int, subscriptionID string) chan *notifier.EventData {
 	return ch
 }
 
+// setTriggerState saves state of last trigger check
+func setTriggerState(triggerID, state string) {
+	c := testDb.conn.Pool.Get()
+	defer c.Close()
+	c.Do("SET", "moira-metric-last-check:"+triggerID, fmt.Sprintf(`{"state": "%s"}`, state))
+}
+
 func stopSenders() {
 	if sendersRunning {
 		notifier.StopSenders()
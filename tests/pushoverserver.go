@@ -0,0 +1,72 @@
+package tests
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// fakePushoverServer records sent messages and cancelled receipts and reports receipt statuses
+type fakePushoverServer struct {
+	*httptest.Server
+	mutex        sync.Mutex
+	messages     []url.Values
+	acknowledged map[string]bool
+	cancelled    []string
+}
+
+func startFakePushoverServer() *fakePushoverServer {
+	server := &fakePushoverServer{acknowledged: make(map[string]bool)}
+	server.Server = httptest.NewServer(http.HandlerFunc(server.handle))
+	return server
+}
+
+// acknowledge makes server report receipt as acknowledged on user phone
+func (server *fakePushoverServer) acknowledge(receipt string) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	server.acknowledged[receipt] = true
+}
+
+func (server *fakePushoverServer) sent() []url.Values {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	return append([]url.Values{}, server.messages...)
+}
+
+func (server *fakePushoverServer) cancels() []string {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	return append([]string{}, server.cancelled...)
+}
+
+func (server *fakePushoverServer) handle(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	switch {
+	case r.URL.Path == "/messages.json":
+		server.messages = append(server.messages, r.PostForm)
+		receipt := ""
+		if r.PostForm.Get("priority") == "2" {
+			receipt = fmt.Sprintf("R%d", len(server.messages))
+		}
+		fmt.Fprintf(w, `{"status": 1, "request": "request", "receipt": "%s"}`, receipt)
+	case strings.HasSuffix(r.URL.Path, "/cancel.json"):
+		server.cancelled = append(server.cancelled, strings.Split(r.URL.Path, "/")[2])
+		fmt.Fprint(w, `{"status": 1, "request": "request"}`)
+	case strings.HasPrefix(r.URL.Path, "/receipts/"):
+		receipt := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/receipts/"), ".json")
+		if server.acknowledged[receipt] {
+			fmt.Fprint(w, `{"status": 1, "request": "request", "acknowledged": 1, "acknowledged_at": 1441188915, "acknowledged_by": "uOncall", "acknowledged_by_device": "phone", "expired": 0}`)
+			return
+		}
+		fmt.Fprint(w, `{"status": 1, "request": "request", "acknowledged": 0, "expired": 0}`)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `{"status": 0, "request": "request", "errors": ["not found"]}`)
+	}
+}
@@ -0,0 +1,45 @@
+package tests
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+)
+
+// slackRequest is Slack Web API call received by fake server
+type slackRequest struct {
+	Method string
+	Body   map[string]interface{}
+}
+
+// fakeSlackServer records Slack Web API calls and responds with new message timestamps
+type fakeSlackServer struct {
+	*httptest.Server
+	mutex    sync.Mutex
+	requests []slackRequest
+}
+
+func startFakeSlackServer() *fakeSlackServer {
+	server := &fakeSlackServer{}
+	server.Server = httptest.NewServer(http.HandlerFunc(server.handle))
+	return server
+}
+
+func (server *fakeSlackServer) handle(w http.ResponseWriter, r *http.Request) {
+	request := slackRequest{Method: strings.TrimPrefix(r.URL.Path, "/")}
+	json.NewDecoder(r.Body).Decode(&request.Body)
+	server.mutex.Lock()
+	server.requests = append(server.requests, request)
+	ts := fmt.Sprintf("1500000000.%06d", len(server.requests))
+	server.mutex.Unlock()
+	fmt.Fprintf(w, `{"ok": true, "channel": "C0000000001", "ts": "%s"}`, ts)
+}
+
+func (server *fakeSlackServer) calls() []slackRequest {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	return append([]slackRequest{}, server.requests...)
+}
@@ -0,0 +1,119 @@
+package tests
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"sync"
+)
+
+// fakeSMTPServer accepts messages without delivering them and counts connections and messages.
+// With dropAfterData set it keeps message but drops connection instead of replying to it
+type fakeSMTPServer struct {
+	listener      net.Listener
+	mutex         sync.Mutex
+	connections   int
+	messages      []string
+	open          []net.Conn
+	dropAfterData bool
+}
+
+func startFakeSMTPServer() (*fakeSMTPServer, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	server := &fakeSMTPServer{listener: listener}
+	go server.serve()
+	return server, nil
+}
+
+func (server *fakeSMTPServer) port() int64 {
+	return int64(server.listener.Addr().(*net.TCPAddr).Port)
+}
+
+func (server *fakeSMTPServer) stats() (int, []string) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	return server.connections, server.messages
+}
+
+func (server *fakeSMTPServer) setDropAfterData(drop bool) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	server.dropAfterData = drop
+}
+
+// disconnect closes accepted connections as server does with idle ones
+func (server *fakeSMTPServer) disconnect() {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	for _, conn := range server.open {
+		conn.Close()
+	}
+	server.open = nil
+}
+
+func (server *fakeSMTPServer) stop() {
+	server.listener.Close()
+}
+
+func (server *fakeSMTPServer) serve() {
+	for {
+		conn, err := server.listener.Accept()
+		if err != nil {
+			return
+		}
+		server.mutex.Lock()
+		server.connections++
+		server.open = append(server.open, conn)
+		server.mutex.Unlock()
+		go server.handle(conn)
+	}
+}
+
+func (server *fakeSMTPServer) handle(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	reply := func(line string) {
+		conn.Write([]byte(line + "\r\n"))
+	}
+	reply("220 localhost ESMTP")
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		command := strings.ToUpper(strings.TrimSpace(line))
+		switch {
+		case strings.HasPrefix(command, "EHLO"), strings.HasPrefix(command, "HELO"):
+			reply("250 localhost")
+		case command == "DATA":
+			reply("354 End data with <CR><LF>.<CR><LF>")
+			var message []string
+			for {
+				dataLine, err := reader.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if dataLine == ".\r\n" {
+					break
+				}
+				message = append(message, dataLine)
+			}
+			server.mutex.Lock()
+			server.messages = append(server.messages, strings.Join(message, ""))
+			drop := server.dropAfterData
+			server.mutex.Unlock()
+			if drop {
+				return
+			}
+			reply("250 OK")
+		case command == "QUIT":
+			reply("221 Bye")
+			return
+		default:
+			reply("250 OK")
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package tests
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+)
+
+// telegramMessage is message sent by bot to fake Telegram Bot API server
+type telegramMessage struct {
+	ChatID    string `json:"chat_id"`
+	Text      string `json:"text"`
+	ParseMode string `json:"parse_mode"`
+	Photo     []byte `json:"-"`
+}
+
+// fakeTelegramServer serves queued updates to bot and records sent messages
+type fakeTelegramServer struct {
+	*httptest.Server
+	mutex    sync.Mutex
+	updateID int
+	updates  []map[string]interface{}
+	messages []telegramMessage
+	blocked  map[string]bool
+}
+
+func startFakeTelegramServer() *fakeTelegramServer {
+	server := &fakeTelegramServer{}
+	server.Server = httptest.NewServer(http.HandlerFunc(server.handle))
+	return server
+}
+
+// receive queues message of chat to be received by bot
+func (server *fakeTelegramServer) receive(chat map[string]interface{}, text string) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	server.updateID++
+	server.updates = append(server.updates, map[string]interface{}{
+		"update_id": server.updateID,
+		"message": map[string]interface{}{
+			"message_id": server.updateID,
+			"from":       map[string]interface{}{"id": 1, "username": "oncall", "first_name": "On", "last_name": "Call"},
+			"chat":       chat,
+			"text":       text,
+		},
+	})
+}
+
+// block makes server respond to messages to chat as if user blocked bot
+func (server *fakeTelegramServer) block(chatID string) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	if server.blocked == nil {
+		server.blocked = make(map[string]bool)
+	}
+	server.blocked[chatID] = true
+}
+
+func (server *fakeTelegramServer) sent() []telegramMessage {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	return append([]telegramMessage{}, server.messages...)
+}
+
+func (server *fakeTelegramServer) handle(w http.ResponseWriter, r *http.Request) {
+	method := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+	switch method {
+	case "getUpdates":
+		var request struct {
+			Offset int `json:"offset"`
+		}
+		json.NewDecoder(r.Body).Decode(&request)
+		server.mutex.Lock()
+		var updates []map[string]interface{}
+		for _, update := range server.updates {
+			if update["update_id"].(int) >= request.Offset {
+				updates = append(updates, update)
+			}
+		}
+		server.mutex.Unlock()
+		if len(updates) == 0 {
+			// emulate long polling without holding test server on close
+			time.Sleep(10 * time.Millisecond)
+		}
+		result, _ := json.Marshal(updates)
+		fmt.Fprintf(w, `{"ok": true, "result": %s}`, orEmptyArray(result))
+	case "sendMessage":
+		var message telegramMessage
+		json.NewDecoder(r.Body).Decode(&message)
+		server.mutex.Lock()
+		blocked := server.blocked[message.ChatID]
+		delete(server.blocked, message.ChatID)
+		if !blocked {
+			server.messages = append(server.messages, message)
+		}
+		server.mutex.Unlock()
+		if blocked {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, `{"ok": false, "error_code": 403, "description": "Forbidden: bot was blocked by the user"}`)
+			return
+		}
+		fmt.Fprint(w, `{"ok": true, "result": {}}`)
+	case "sendPhoto":
+		message := telegramMessage{ChatID: r.FormValue("chat_id"), Text: r.FormValue("caption"), ParseMode: r.FormValue("parse_mode")}
+		if file, _, err := r.FormFile("photo"); err == nil {
+			message.Photo, _ = ioutil.ReadAll(file)
+			file.Close()
+		}
+		server.mutex.Lock()
+		server.messages = append(server.messages, message)
+		server.mutex.Unlock()
+		fmt.Fprint(w, `{"ok": true, "result": {}}`)
+	default:
+		fmt.Fprint(w, `{"ok": false, "error_code": 404, "description": "Not Found"}`)
+	}
+}
+
+func orEmptyArray(result []byte) []byte {
+	if string(result) == "null" {
+		return []byte("[]")
+	}
+	return result
+}
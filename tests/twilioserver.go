@@ -0,0 +1,65 @@
+package tests
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// twilioRequest is call or message created in fake Twilio REST API server
+type twilioRequest struct {
+	Resource string
+	Form     url.Values
+}
+
+// fakeTwilioServer records created calls and messages
+type fakeTwilioServer struct {
+	*httptest.Server
+	mutex    sync.Mutex
+	requests []twilioRequest
+}
+
+func startFakeTwilioServer() *fakeTwilioServer {
+	server := &fakeTwilioServer{}
+	server.Server = httptest.NewServer(http.HandlerFunc(server.handle))
+	return server
+}
+
+func (server *fakeTwilioServer) created() []twilioRequest {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	return append([]twilioRequest{}, server.requests...)
+}
+
+func (server *fakeTwilioServer) handle(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	resource := strings.TrimSuffix(r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:], ".json")
+	server.mutex.Lock()
+	server.requests = append(server.requests, twilioRequest{Resource: resource, Form: r.PostForm})
+	sid := fmt.Sprintf("%s%d", strings.ToUpper(resource[:2]), len(server.requests))
+	server.mutex.Unlock()
+	w.WriteHeader(http.StatusCreated)
+	fmt.Fprintf(w, `{"sid": "%s", "status": "queued"}`, sid)
+}
+
+// signTwilioRequest computes X-Twilio-Signature of callback request to url with form
+func signTwilioRequest(authToken, requestURL string, form url.Values) string {
+	keys := make([]string, 0, len(form))
+	for key := range form {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	mac := hmac.New(sha1.New, []byte(authToken))
+	mac.Write([]byte(requestURL))
+	for _, key := range keys {
+		mac.Write([]byte(key + form.Get(key)))
+	}
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
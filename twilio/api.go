@@ -0,0 +1,81 @@
+package twilio
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// DefaultAPIURL is Twilio REST API base url
+const DefaultAPIURL = "https://api.twilio.com"
+
+// resource represents call or message created with Twilio REST API
+type resource struct {
+	SID     string `json:"sid"`
+	Status  string `json:"status"`
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// apiClient creates calls and messages with Twilio REST API
+type apiClient struct {
+	url        string
+	accountSID string
+	authToken  string
+	client     *http.Client
+}
+
+func newAPIClient(apiURL, accountSID, authToken string) *apiClient {
+	if apiURL == "" {
+		apiURL = DefaultAPIURL
+	}
+	return &apiClient{url: strings.TrimSuffix(apiURL, "/"), accountSID: accountSID, authToken: authToken, client: &http.Client{}}
+}
+
+// create posts form to account resource list, e.g. Calls or Messages
+func (api *apiClient) create(ctx context.Context, resourceType string, form url.Values) (*resource, error) {
+	request, err := http.NewRequest("POST", fmt.Sprintf("%s/2010-04-01/Accounts/%s/%s.json", api.url, api.accountSID, resourceType), strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.SetBasicAuth(api.accountSID, api.authToken)
+	response, err := api.client.Do(request.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	created := &resource{}
+	if err := json.NewDecoder(response.Body).Decode(created); err != nil {
+		return nil, fmt.Errorf("Failed to decode %s response with status %s: %s", resourceType, response.Status, err.Error())
+	}
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return nil, fmt.Errorf("%s responded with status %s: %d %s", resourceType, response.Status, created.Code, created.Message)
+	}
+	return created, nil
+}
+
+// validateSignature checks X-Twilio-Signature of callback request made to public url with form parameters
+func (api *apiClient) validateSignature(publicURL string, form url.Values, signature string) bool {
+	keys := make([]string, 0, len(form))
+	for key := range form {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	mac := hmac.New(sha1.New, []byte(api.authToken))
+	mac.Write([]byte(publicURL))
+	for _, key := range keys {
+		for _, value := range form[key] {
+			mac.Write([]byte(key + value))
+		}
+	}
+	expected := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	return hmac.Equal([]byte(expected), []byte(signature))
+}
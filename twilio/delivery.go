@@ -0,0 +1,165 @@
+package twilio
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/moira-alert/notifier"
+)
+
+const (
+	// MessageStatusPath receives statuses of sent messages
+	MessageStatusPath = "/twilio/sms/status"
+
+	deliveryKind           = "twilio"
+	retryIncidentKind      = "twilio-delivery"
+	defaultDeliveryRetries = 1
+)
+
+// failedStatuses are final statuses of messages and calls that did not reach contact
+var failedStatuses = map[string]bool{
+	"failed":      true,
+	"undelivered": true,
+	"busy":        true,
+	"no-answer":   true,
+}
+
+// delivery is stored for every created message and call and updated by status callbacks
+type delivery struct {
+	SID       string               `json:"sid"`
+	Status    string               `json:"status"`
+	ErrorCode string               `json:"error_code,omitempty"`
+	Number    string               `json:"number"`
+	Events    notifier.EventsData  `json:"events"`
+	Trigger   notifier.TriggerData `json:"trigger"`
+	Contact   notifier.ContactData `json:"contact"`
+	Throttled bool                 `json:"throttled"`
+}
+
+// deliveryRetry counts failed deliveries of trigger incident to contact
+type deliveryRetry struct {
+	Attempt  int  `json:"attempt"`
+	FellBack bool `json:"fell_back"`
+}
+
+// parseCallback checks method and signature of Twilio callback request and parses its form,
+// error response is written if request is not valid
+func (sender *twilioSender) parseCallback(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return false
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return false
+	}
+	if !sender.api.validateSignature(sender.callbackURL+r.URL.RequestURI(), r.PostForm, r.Header.Get("X-Twilio-Signature")) {
+		sender.log.Warningf("Twilio request to %s has invalid signature", r.URL.Path)
+		http.Error(w, "Invalid signature", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+func (sender *twilioSender) saveDelivery(d *delivery) error {
+	value, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	return sender.db.SetDelivery(deliveryKind, d.SID, string(value))
+}
+
+// updateDelivery stores status reported by callback, nil is returned for unknown message
+func (sender *twilioSender) updateDelivery(sid, status, errorCode string) (*delivery, error) {
+	value, err := sender.db.GetDelivery(deliveryKind, sid)
+	if err != nil || value == "" {
+		return nil, err
+	}
+	d := &delivery{}
+	if err := json.Unmarshal([]byte(value), d); err != nil {
+		return nil, fmt.Errorf("Failed to decode delivery %s: %s", sid, err.Error())
+	}
+	d.Status = status
+	d.ErrorCode = errorCode
+	return d, sender.saveDelivery(d)
+}
+
+// handleDeliveryStatus reschedules failed delivery and resets failures of incident when contact is reached
+func (sender *twilioSender) handleDeliveryStatus(d *delivery) {
+	sender.log.Debugf("Delivery %s to %s has status %s", d.SID, d.Number, d.Status)
+	if failedStatuses[d.Status] {
+		sender.rescheduleFailed(d)
+		return
+	}
+	if d.Status == "delivered" || d.Status == "completed" {
+		if err := sender.db.RemoveTriggerIncident(retryIncidentKind, d.Contact.ID, d.Trigger.ID); err != nil {
+			sender.log.Errorf("Failed to reset delivery failures of trigger %s: %s", d.Trigger.ID, err.Error())
+		}
+	}
+}
+
+// rescheduleFailed reschedules events of failed delivery to the same contact while retries last,
+// then once to the same contact value with fallback type
+func (sender *twilioSender) rescheduleFailed(d *delivery) {
+	contact := d.Contact
+	retry, err := sender.getDeliveryRetry(contact, d.Trigger)
+	if err != nil {
+		sender.log.Errorf("Failed to get delivery failures of trigger %s: %s", d.Trigger.ID, err.Error())
+		return
+	}
+	switch {
+	case retry.Attempt < sender.deliveryRetries:
+		retry.Attempt++
+		sender.log.Warningf("Delivery %s to %s failed with status %s %s, retry %d is scheduled", d.SID, d.Number, d.Status, d.ErrorCode, retry.Attempt)
+	case sender.fallbackType != "" && !retry.FellBack:
+		retry = &deliveryRetry{FellBack: true}
+		contact.Type = sender.fallbackType
+		sender.log.Warningf("Delivery %s to %s failed with status %s %s, falling back to %s", d.SID, d.Number, d.Status, d.ErrorCode, contact.Type)
+	default:
+		sender.log.Errorf("Delivery %s to %s failed with status %s %s", d.SID, d.Number, d.Status, d.ErrorCode)
+		if err := sender.db.RemoveTriggerIncident(retryIncidentKind, contact.ID, d.Trigger.ID); err != nil {
+			sender.log.Errorf("Failed to reset delivery failures of trigger %s: %s", d.Trigger.ID, err.Error())
+		}
+		return
+	}
+	value, err := json.Marshal(retry)
+	if err == nil {
+		err = sender.db.SetTriggerIncident(retryIncidentKind, contact.ID, d.Trigger.ID, string(value))
+	}
+	if err != nil {
+		sender.log.Errorf("Failed to save delivery failures of trigger %s: %s", d.Trigger.ID, err.Error())
+		return
+	}
+	sender.schedule(d.Events, d.Trigger, contact, d.Throttled)
+}
+
+func (sender *twilioSender) getDeliveryRetry(contact notifier.ContactData, trigger notifier.TriggerData) (*deliveryRetry, error) {
+	retry := &deliveryRetry{}
+	value, err := sender.db.GetTriggerIncident(retryIncidentKind, contact.ID, trigger.ID)
+	if err != nil || value == "" {
+		return retry, err
+	}
+	if err := json.Unmarshal([]byte(value), retry); err != nil {
+		return nil, fmt.Errorf("Failed to decode delivery failures of trigger %s: %s", trigger.ID, err.Error())
+	}
+	return retry, nil
+}
+
+// schedule sends events to contact again after retry interval
+func (sender *twilioSender) schedule(events notifier.EventsData, trigger notifier.TriggerData, contact notifier.ContactData, throttled bool) {
+	timestamp := notifier.GetNow().Add(sender.retryInterval).Unix()
+	for _, event := range events {
+		notification := &notifier.ScheduledNotification{
+			Event:     event,
+			Trigger:   trigger,
+			Contact:   contact,
+			Throttled: throttled,
+			Timestamp: timestamp,
+		}
+		if err := sender.db.AddNotification(notification); err != nil {
+			sender.log.Errorf("Failed to schedule notification to %s: %s", contact.Value, err.Error())
+			return
+		}
+	}
+}
@@ -1,91 +1,117 @@
 package twilio
 
 import (
-	"bytes"
+	"context"
 	"fmt"
+	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
 	"time"
 
-	twilio "github.com/carlosdp/twiliogo"
+	"github.com/gosexy/to"
 	"github.com/moira-alert/notifier"
+	"github.com/moira-alert/notifier/render"
+	"github.com/moira-alert/notifier/sms"
 )
 
+// defaultSegments is number of segments SMS is composed in unless sms_segments is set
+const defaultSegments = 1
+
+// Database stores delivery statuses, call incidents and acknowledgements of triggers
+type Database interface {
+	GetTriggerIncident(kind, contactID, triggerID string) (string, error)
+	SetTriggerIncident(kind, contactID, triggerID, value string) error
+	RemoveTriggerIncident(kind, contactID, triggerID string) error
+	AckTrigger(triggerID, user string) error
+	IsTriggerMuted(triggerID string) (bool, error)
+	AddNotification(notification *notifier.ScheduledNotification) error
+	GetDelivery(kind, messageID string) (string, error)
+	SetDelivery(kind, messageID, value string) error
+}
+
 type sendEventsTwilio interface {
-	SendEvents(events notifier.EventsData, contact notifier.ContactData, trigger notifier.TriggerData, throttled bool) error
+	SendEvents(ctx context.Context, events notifier.EventsData, contact notifier.ContactData, trigger notifier.TriggerData, throttled bool) error
 }
 
 type twilioSender struct {
-	client       *twilio.TwilioClient
-	APIFromPhone string
-	log          notifier.Logger
+	api             *apiClient
+	db              Database
+	APIFromPhone    string
+	FrontURI        string
+	callbackURL     string
+	retryInterval   time.Duration
+	deliveryRetries int
+	fallbackType    string
+	log             notifier.Logger
+	renderer        *render.Renderer
 }
 
 type twilioSenderSms struct {
 	twilioSender
+	segments int
 }
 
-type twilioSenderVoice struct {
-	twilioSender
-	voiceURL      string
-	appendMessage bool
-}
-
-func (smsSender *twilioSenderSms) SendEvents(events notifier.EventsData, contact notifier.ContactData, trigger notifier.TriggerData, throttled bool) error {
-	var message bytes.Buffer
-
-	state := events.GetSubjectState()
-	tags := trigger.GetTags()
-
-	message.WriteString(fmt.Sprintf("%s %s %s (%d)\n", state, trigger.Name, tags, len(events)))
-
-	for _, event := range events {
-		value := strconv.FormatFloat(event.Value, 'f', -1, 64)
-		message.WriteString(fmt.Sprintf("\n%s: %s = %s (%s to %s)", time.Unix(event.Timestamp, 0).Format("15:04"), event.Metric, value, event.OldState, event.State))
-		if len(event.Message) > 0 {
-			message.WriteString(fmt.Sprintf(". %s", event.Message))
-		}
+func (smsSender *twilioSenderSms) SendEvents(ctx context.Context, events notifier.EventsData, contact notifier.ContactData, trigger notifier.TriggerData, throttled bool) error {
+	message, err := sms.Compose(smsSender.renderer.Contact(contact), render.NewView(events, contact, trigger, throttled, smsSender.FrontURI), smsSender.segments)
+	if err != nil {
+		return err
 	}
 
-	if len(events) > 5 {
-		message.WriteString(fmt.Sprintf("\n\n...and %d more events.", len(events)-5))
+	smsSender.log.Debugf("Calling twilio sms api to phone %s and message body %s", contact.Value, message)
+	form := url.Values{
+		"From": {smsSender.APIFromPhone},
+		"To":   {contact.Value},
+		"Body": {message},
 	}
-
-	if throttled {
-		message.WriteString("\n\nPlease, fix your system or tune this trigger to generate less events.")
+	if smsSender.callbackURL != "" {
+		form.Set("StatusCallback", smsSender.callbackURL+MessageStatusPath)
 	}
-
-	smsSender.log.Debugf("Calling twilio sms api to phone %s and message body %s", contact.Value, message.String())
-	twilioMessage, err := twilio.NewMessage(smsSender.client, smsSender.APIFromPhone, contact.Value, twilio.Body(message.String()))
-
+	twilioMessage, err := smsSender.api.create(ctx, "Messages", form)
 	if err != nil {
 		return fmt.Errorf("Failed to send message to contact %s: %s", contact.Value, err)
 	}
+	if failedStatuses[twilioMessage.Status] {
+		return fmt.Errorf("Failed to send message to contact %s: message %s has status %s", contact.Value, twilioMessage.SID, twilioMessage.Status)
+	}
 
-	smsSender.log.Debugf(fmt.Sprintf("message send to twilio with status: %s", twilioMessage.Status))
+	smsSender.log.Debugf(fmt.Sprintf("message %s send to twilio with status: %s", twilioMessage.SID, twilioMessage.Status))
 
-	return nil
+	if smsSender.callbackURL == "" {
+		return nil
+	}
+	return smsSender.saveDelivery(&delivery{
+		SID:       twilioMessage.SID,
+		Status:    twilioMessage.Status,
+		Number:    contact.Value,
+		Events:    events,
+		Trigger:   trigger,
+		Contact:   contact,
+		Throttled: throttled,
+	})
 }
 
-func (voiceSender *twilioSenderVoice) SendEvents(events notifier.EventsData, contact notifier.ContactData, trigger notifier.TriggerData, throttled bool) error {
-	voiceURL := voiceSender.voiceURL
-	if voiceSender.appendMessage {
-		voiceURL += url.QueryEscape(fmt.Sprintf("Hi! This is a notification for Moira trigger %s. Please, visit Moira web interface for details.", trigger.Name))
+// ServeHTTP handles Twilio message status callbacks
+func (smsSender *twilioSenderSms) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !smsSender.parseCallback(w, r) {
+		return
 	}
-
-	twilioCall, err := twilio.NewCall(voiceSender.client, voiceSender.APIFromPhone, contact.Value, twilio.Callback(voiceURL))
-
+	sid := r.PostForm.Get("MessageSid")
+	d, err := smsSender.updateDelivery(sid, r.PostForm.Get("MessageStatus"), r.PostForm.Get("ErrorCode"))
 	if err != nil {
-		return fmt.Errorf("Failed to make call to contact %s: %s", contact.Value, err.Error())
+		smsSender.log.Errorf("Failed to update status of message %s: %s", sid, err.Error())
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
 	}
-
-	voiceSender.log.Debugf("Call queued to twilio with status %s, callback url %s", twilioCall.Status, voiceURL)
-
-	return nil
+	if d != nil {
+		smsSender.handleDeliveryStatus(d)
+	}
+	w.WriteHeader(http.StatusNoContent)
 }
 
 // Sender implements moira sender interface via twilio
 type Sender struct {
+	DB     Database
 	sender sendEventsTwilio
 }
 
@@ -108,25 +134,78 @@ func (sender *Sender) Init(senderSettings map[string]string, logger notifier.Log
 		return fmt.Errorf("Can not read [%s] api_fromphone param from config", apiType)
 	}
 
-	twilioClient := twilio.NewClient(apiASID, apiAuthToken)
+	renderer, err := render.New(apiType, senderSettings["templates_dir"], senderSettings["language"])
+	if err != nil {
+		return err
+	}
+
+	baseSender := twilioSender{
+		api:             newAPIClient(senderSettings["api_url"], apiASID, apiAuthToken),
+		db:              sender.DB,
+		APIFromPhone:    apiFromPhone,
+		FrontURI:        senderSettings["front_uri"],
+		callbackURL:     strings.TrimSuffix(senderSettings["callback_url"], "/"),
+		retryInterval:   defaultRetryInterval,
+		deliveryRetries: defaultDeliveryRetries,
+		fallbackType:    senderSettings["fallback_type"],
+		log:             logger,
+		renderer:        renderer,
+	}
+	if baseSender.callbackURL != "" {
+		if sender.DB == nil {
+			return fmt.Errorf("Twilio callback_url requires database")
+		}
+		if senderSettings["retry_interval"] != "" {
+			baseSender.retryInterval = to.Duration(senderSettings["retry_interval"])
+		}
+		if senderSettings["delivery_retries"] != "" {
+			baseSender.deliveryRetries, err = strconv.Atoi(senderSettings["delivery_retries"])
+			if err != nil || baseSender.deliveryRetries < 0 {
+				return fmt.Errorf("Can not read [%s] delivery_retries from config: %s", apiType, senderSettings["delivery_retries"])
+			}
+		}
+	}
 
 	switch apiType {
 	case "twilio sms":
-		sender.sender = &twilioSenderSms{twilioSender{twilioClient, apiFromPhone, logger}}
+		smsSender := &twilioSenderSms{twilioSender: baseSender, segments: defaultSegments}
+		if senderSettings["sms_segments"] != "" {
+			smsSender.segments, err = strconv.Atoi(senderSettings["sms_segments"])
+			if err != nil || smsSender.segments < 1 {
+				return fmt.Errorf("Can not read [%s] sms_segments from config: %s", apiType, senderSettings["sms_segments"])
+			}
+		}
+		if smsSender.callbackURL != "" {
+			if err := notifier.RegisterHandler(MessageStatusPath, smsSender); err != nil {
+				return err
+			}
+		}
+		sender.sender = smsSender
 
 	case "twilio voice":
-		voiceURL := senderSettings["voiceurl"]
-		if voiceURL == "" {
-			return fmt.Errorf("Can not read [%s] voiceurl param from config", apiType)
+		voiceSender := &twilioSenderVoice{
+			twilioSender:  baseSender,
+			voiceURL:      senderSettings["voiceurl"],
+			appendMessage: senderSettings["append_message"] == "true",
+			retries:       defaultCallRetries,
 		}
-
-		appendMessage := senderSettings["append_message"] == "true"
-
-		sender.sender = &twilioSenderVoice{
-			twilioSender{twilioClient, apiFromPhone, logger},
-			voiceURL,
-			appendMessage,
+		if voiceSender.callbackURL == "" {
+			if voiceSender.voiceURL == "" {
+				return fmt.Errorf("Can not read [%s] callback_url or voiceurl param from config", apiType)
+			}
+			sender.sender = voiceSender
+			break
+		}
+		if senderSettings["call_retries"] != "" {
+			voiceSender.retries, err = strconv.Atoi(senderSettings["call_retries"])
+			if err != nil || voiceSender.retries < 0 {
+				return fmt.Errorf("Can not read [%s] call_retries from config: %s", apiType, senderSettings["call_retries"])
+			}
 		}
+		if err := voiceSender.registerHandlers(); err != nil {
+			return err
+		}
+		sender.sender = voiceSender
 
 	default:
 		return fmt.Errorf("Wrong twilio type: %s", apiType)
@@ -135,7 +214,18 @@ func (sender *Sender) Init(senderSettings map[string]string, logger notifier.Log
 	return nil
 }
 
+// Close stops handling twilio callbacks
+func (sender *Sender) Close() error {
+	switch impl := sender.sender.(type) {
+	case *twilioSenderSms:
+		notifier.UnregisterHandler(MessageStatusPath, impl)
+	case *twilioSenderVoice:
+		impl.unregisterHandlers()
+	}
+	return nil
+}
+
 //SendEvents implements Sender interface Send
-func (sender *Sender) SendEvents(events notifier.EventsData, contact notifier.ContactData, trigger notifier.TriggerData, throttled bool) error {
-	return sender.sender.SendEvents(events, contact, trigger, throttled)
+func (sender *Sender) SendEvents(ctx context.Context, events notifier.EventsData, contact notifier.ContactData, trigger notifier.TriggerData, throttled bool) error {
+	return sender.sender.SendEvents(ctx, events, contact, trigger, throttled)
 }
@@ -0,0 +1,383 @@
+package twilio
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/moira-alert/notifier"
+	"github.com/moira-alert/notifier/render"
+)
+
+const (
+	// VoicePath serves TwiML of calls
+	VoicePath = "/twilio/voice"
+	// GatherPath receives digits pressed during calls
+	GatherPath = "/twilio/voice/gather"
+	// CallStatusPath receives statuses of finished calls
+	CallStatusPath = "/twilio/voice/status"
+
+	callIncidentKind     = "twilio-voice"
+	ackDigit             = "1"
+	gatherTimeout        = 10
+	speechLoops          = 2
+	topMetrics           = 3
+	defaultCallRetries   = 2
+	defaultRetryInterval = 5 * time.Minute
+)
+
+var callLanguages = map[string]string{
+	"en": "en-US",
+	"ru": "ru-RU",
+}
+
+type twilioSenderVoice struct {
+	twilioSender
+	voiceURL      string
+	appendMessage bool
+	retries       int
+}
+
+// callIncident is stored for contact and trigger while call is in progress or waits for retry.
+// Attempt is advanced only when call has finished without acknowledgement, new packages of incident keep it
+type callIncident struct {
+	CallSID      string               `json:"call_sid"`
+	Number       string               `json:"number"`
+	Attempt      int                  `json:"attempt"`
+	Gather       bool                 `json:"gather"`
+	Acknowledged bool                 `json:"acknowledged"`
+	Speech       string               `json:"speech"`
+	Language     string               `json:"language"`
+	Events       notifier.EventsData  `json:"events"`
+	Trigger      notifier.TriggerData `json:"trigger"`
+	Contact      notifier.ContactData `json:"contact"`
+	Throttled    bool                 `json:"throttled"`
+}
+
+// speechView adds events read out during call to template data
+type speechView struct {
+	*render.View
+	TopEvents notifier.EventsData
+}
+
+// twiml is response to Twilio voice requests
+type twiml struct {
+	XMLName xml.Name  `xml:"Response"`
+	Gather  *gather   `xml:"Gather,omitempty"`
+	Say     []say     `xml:"Say"`
+	Hangup  *struct{} `xml:"Hangup,omitempty"`
+}
+
+type gather struct {
+	NumDigits int    `xml:"numDigits,attr"`
+	Timeout   int    `xml:"timeout,attr"`
+	Action    string `xml:"action,attr"`
+	Say       say    `xml:"Say"`
+}
+
+type say struct {
+	Language string `xml:"language,attr,omitempty"`
+	Loop     int    `xml:"loop,attr,omitempty"`
+	Text     string `xml:",chardata"`
+}
+
+func (voiceSender *twilioSenderVoice) SendEvents(ctx context.Context, events notifier.EventsData, contact notifier.ContactData, trigger notifier.TriggerData, throttled bool) error {
+	if voiceSender.callbackURL == "" {
+		return voiceSender.callStatic(ctx, events, contact, trigger, throttled)
+	}
+
+	renderer := voiceSender.renderer.Contact(contact)
+	view := render.NewView(events, contact, trigger, throttled, voiceSender.FrontURI)
+	incident := &callIncident{
+		Attempt:   1,
+		Gather:    trigger.ID != "" && view.State != "OK" && view.State != "TEST",
+		Language:  renderer.Language(),
+		Events:    events,
+		Trigger:   trigger,
+		Contact:   contact,
+		Throttled: throttled,
+	}
+	if incident.Gather {
+		muted, err := voiceSender.db.IsTriggerMuted(trigger.ID)
+		if err != nil {
+			return err
+		}
+		if muted {
+			voiceSender.log.Debugf("Trigger %s is acknowledged, call to %s is skipped", trigger.ID, contact.Value)
+			return voiceSender.db.RemoveTriggerIncident(callIncidentKind, contact.ID, trigger.ID)
+		}
+		previous, err := voiceSender.getCallIncident(contact.ID, trigger.ID)
+		if err != nil {
+			return err
+		}
+		if previous != nil && previous.Gather && !previous.Acknowledged {
+			incident.Attempt = previous.Attempt
+		}
+	}
+	incident.Number = voiceSender.callNumber(contact, incident.Attempt)
+	if incident.Number == "" {
+		voiceSender.log.Warningf("Nobody acknowledged trigger %s after %d calls", trigger.ID, incident.Attempt-1)
+		return voiceSender.db.RemoveTriggerIncident(callIncidentKind, contact.ID, trigger.ID)
+	}
+
+	var err error
+	incident.Speech, err = renderer.Render("speech", &speechView{View: view, TopEvents: events.GetMostCriticalEvents(topMetrics)})
+	if err != nil {
+		return err
+	}
+	// TwiML can be requested as soon as call is created, so incident is stored before
+	if err := voiceSender.saveCallIncident(incident); err != nil {
+		return err
+	}
+
+	query := "?" + url.Values{"contact": {contact.ID}, "trigger": {trigger.ID}}.Encode()
+	call, err := voiceSender.api.create(ctx, "Calls", url.Values{
+		"From":           {voiceSender.APIFromPhone},
+		"To":             {incident.Number},
+		"Url":            {voiceSender.callbackURL + VoicePath + query},
+		"StatusCallback": {voiceSender.callbackURL + CallStatusPath + query},
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to make call to contact %s: %s", incident.Number, err.Error())
+	}
+	voiceSender.log.Debugf("Call %s to %s queued to twilio with status %s, attempt %d", call.SID, incident.Number, call.Status, incident.Attempt)
+
+	incident.CallSID = call.SID
+	if err := voiceSender.saveCallIncident(incident); err != nil {
+		return err
+	}
+	return voiceSender.saveDelivery(&delivery{
+		SID:       call.SID,
+		Status:    call.Status,
+		Number:    incident.Number,
+		Events:    events,
+		Trigger:   trigger,
+		Contact:   contact,
+		Throttled: throttled,
+	})
+}
+
+// callStatic makes call with TwiML served by static voiceurl
+func (voiceSender *twilioSenderVoice) callStatic(ctx context.Context, events notifier.EventsData, contact notifier.ContactData, trigger notifier.TriggerData, throttled bool) error {
+	voiceURL := voiceSender.voiceURL
+	if voiceSender.appendMessage {
+		message, err := voiceSender.renderer.Contact(contact).Render("voice", render.NewView(events, contact, trigger, throttled, voiceSender.FrontURI))
+		if err != nil {
+			return err
+		}
+		voiceURL += url.QueryEscape(message)
+	}
+
+	call, err := voiceSender.api.create(ctx, "Calls", url.Values{
+		"From": {voiceSender.APIFromPhone},
+		"To":   {contact.Value},
+		"Url":  {voiceURL},
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to make call to contact %s: %s", contact.Value, err.Error())
+	}
+
+	voiceSender.log.Debugf("Call queued to twilio with status %s, callback url %s", call.Status, voiceURL)
+
+	return nil
+}
+
+// callNumber returns number called on attempt: contact itself while retries last,
+// then numbers listed in escalate_to contact setting one by one
+func (voiceSender *twilioSenderVoice) callNumber(contact notifier.ContactData, attempt int) string {
+	escalation := attempt - voiceSender.retries - 1
+	if escalation <= 0 {
+		return contact.Value
+	}
+	numbers := strings.FieldsFunc(contact.Settings["escalate_to"], func(r rune) bool {
+		return r == ',' || r == ' '
+	})
+	if escalation > len(numbers) {
+		return ""
+	}
+	return numbers[escalation-1]
+}
+
+func (voiceSender *twilioSenderVoice) registerHandlers() error {
+	for _, path := range []string{VoicePath, GatherPath, CallStatusPath} {
+		if err := notifier.RegisterHandler(path, voiceSender); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (voiceSender *twilioSenderVoice) unregisterHandlers() {
+	for _, path := range []string{VoicePath, GatherPath, CallStatusPath} {
+		notifier.UnregisterHandler(path, voiceSender)
+	}
+}
+
+// ServeHTTP handles Twilio requests for call TwiML, pressed digits and call statuses
+func (voiceSender *twilioSenderVoice) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !voiceSender.parseCallback(w, r) {
+		return
+	}
+	contactID, triggerID := r.URL.Query().Get("contact"), r.URL.Query().Get("trigger")
+	incident, err := voiceSender.getCallIncident(contactID, triggerID)
+	if err != nil {
+		voiceSender.log.Errorf("Failed to get call of contact %s and trigger %s: %s", contactID, triggerID, err.Error())
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	switch r.URL.Path {
+	case VoicePath:
+		voiceSender.writeTwiML(w, voiceSender.callTwiML(incident, r.URL.RawQuery))
+	case GatherPath:
+		voiceSender.writeTwiML(w, voiceSender.gatherTwiML(incident, r.URL.RawQuery, r.PostForm.Get("Digits")))
+	case CallStatusPath:
+		voiceSender.handleCallStatus(incident, r.PostForm.Get("CallSid"), r.PostForm.Get("CallStatus"))
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// callTwiML reads out notification and asks to press digit to acknowledge trigger
+func (voiceSender *twilioSenderVoice) callTwiML(incident *callIncident, query string) *twiml {
+	response := &twiml{Hangup: &struct{}{}}
+	if incident == nil {
+		return response
+	}
+	language := callLanguages[incident.Language]
+	if !incident.Gather {
+		response.Say = []say{{Language: language, Text: incident.Speech}}
+		return response
+	}
+	response.Gather = &gather{
+		NumDigits: 1,
+		Timeout:   gatherTimeout,
+		Action:    voiceSender.callbackURL + GatherPath + "?" + query,
+		Say: say{
+			Language: language,
+			Loop:     speechLoops,
+			Text:     incident.Speech + " " + render.Translate(incident.Language, "voice_ack_prompt", ackDigit),
+		},
+	}
+	response.Say = []say{{Language: language, Text: render.Translate(incident.Language, "voice_no_input")}}
+	return response
+}
+
+// gatherTwiML acknowledges trigger if ack digit has been pressed, otherwise repeats call
+func (voiceSender *twilioSenderVoice) gatherTwiML(incident *callIncident, query string, digits string) *twiml {
+	if incident == nil || !incident.Gather || digits != ackDigit {
+		return voiceSender.callTwiML(incident, query)
+	}
+	language := callLanguages[incident.Language]
+	if err := voiceSender.db.AckTrigger(incident.Trigger.ID, incident.Number); err != nil {
+		voiceSender.log.Errorf("Failed to acknowledge trigger %s by %s: %s", incident.Trigger.ID, incident.Number, err.Error())
+		return &twiml{
+			Say:    []say{{Language: language, Text: render.Translate(incident.Language, "voice_ack_failed")}},
+			Hangup: &struct{}{},
+		}
+	}
+	voiceSender.log.Infof("Trigger %s is acknowledged by %s", incident.Trigger.ID, incident.Number)
+	incident.Acknowledged = true
+	if err := voiceSender.saveCallIncident(incident); err != nil {
+		voiceSender.log.Errorf("Failed to save call of trigger %s: %s", incident.Trigger.ID, err.Error())
+	}
+	return &twiml{
+		Say:    []say{{Language: language, Text: render.Translate(incident.Language, "voice_acknowledged")}},
+		Hangup: &struct{}{},
+	}
+}
+
+// handleCallStatus schedules next call when last call of incident has finished without acknowledgement,
+// calls that do not ask for acknowledgement are rescheduled only when they fail
+func (voiceSender *twilioSenderVoice) handleCallStatus(incident *callIncident, callSID, status string) {
+	d, err := voiceSender.updateDelivery(callSID, status, "")
+	if err != nil {
+		voiceSender.log.Errorf("Failed to update status of call %s: %s", callSID, err.Error())
+	}
+	if incident == nil || incident.CallSID != callSID {
+		// call superseded by newer call of open incident is not retried, the newer one is
+		if d != nil && (incident == nil || !incident.Gather) {
+			voiceSender.handleDeliveryStatus(d)
+		}
+		return
+	}
+	voiceSender.log.Debugf("Call %s to %s finished with status %s", callSID, incident.Number, status)
+	contactID, triggerID := incident.Contact.ID, incident.Trigger.ID
+	if incident.Gather && !incident.Acknowledged {
+		muted, err := voiceSender.db.IsTriggerMuted(triggerID)
+		if err != nil {
+			voiceSender.log.Errorf("Failed to check acknowledgement of trigger %s: %s", triggerID, err.Error())
+			return
+		}
+		if !muted {
+			voiceSender.scheduleRetry(incident)
+			return
+		}
+	}
+	if err := voiceSender.db.RemoveTriggerIncident(callIncidentKind, contactID, triggerID); err != nil {
+		voiceSender.log.Errorf("Failed to remove call of trigger %s: %s", triggerID, err.Error())
+	}
+	if d != nil && !incident.Gather {
+		voiceSender.handleDeliveryStatus(d)
+	}
+}
+
+// scheduleRetry advances incident to the next attempt and reschedules its events to the same contact,
+// next call is made to number of the next attempt
+func (voiceSender *twilioSenderVoice) scheduleRetry(incident *callIncident) {
+	next := voiceSender.callNumber(incident.Contact, incident.Attempt+1)
+	if next == "" {
+		voiceSender.log.Warningf("Nobody acknowledged trigger %s after %d calls", incident.Trigger.ID, incident.Attempt)
+		if err := voiceSender.db.RemoveTriggerIncident(callIncidentKind, incident.Contact.ID, incident.Trigger.ID); err != nil {
+			voiceSender.log.Errorf("Failed to remove call of trigger %s: %s", incident.Trigger.ID, err.Error())
+		}
+		return
+	}
+	// finished call is forgotten, so repeated status of it does not advance incident once more
+	incident.Attempt++
+	incident.CallSID = ""
+	if err := voiceSender.saveCallIncident(incident); err != nil {
+		voiceSender.log.Errorf("Failed to save call of trigger %s: %s", incident.Trigger.ID, err.Error())
+		return
+	}
+	voiceSender.schedule(incident.Events, incident.Trigger, incident.Contact, incident.Throttled)
+	voiceSender.log.Infof("Trigger %s is not acknowledged, call to %s is scheduled", incident.Trigger.ID, next)
+}
+
+func (voiceSender *twilioSenderVoice) writeTwiML(w http.ResponseWriter, response *twiml) {
+	body, err := xml.Marshal(response)
+	if err != nil {
+		voiceSender.log.Errorf("Failed to marshal TwiML: %s", err.Error())
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.Write([]byte(xml.Header))
+	w.Write(body)
+}
+
+func (voiceSender *twilioSenderVoice) getCallIncident(contactID, triggerID string) (*callIncident, error) {
+	value, err := voiceSender.db.GetTriggerIncident(callIncidentKind, contactID, triggerID)
+	if err != nil || value == "" {
+		return nil, err
+	}
+	incident := &callIncident{}
+	if err := json.Unmarshal([]byte(value), incident); err != nil {
+		return nil, fmt.Errorf("Failed to decode call of contact %s and trigger %s: %s", contactID, triggerID, err.Error())
+	}
+	return incident, nil
+}
+
+func (voiceSender *twilioSenderVoice) saveCallIncident(incident *callIncident) error {
+	value, err := json.Marshal(incident)
+	if err != nil {
+		return err
+	}
+	return voiceSender.db.SetTriggerIncident(callIncidentKind, incident.Contact.ID, incident.Trigger.ID, string(value))
+}